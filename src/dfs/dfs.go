@@ -2,6 +2,11 @@ package main
 
 import (
     "os"
+    "bytes"
+    "path/filepath"
+    "net/url"
+    "strconv"
+    "time"
     "strings"
     "fmt"
     "errors"
@@ -16,7 +21,8 @@ import (
 
 // Standard errors
 var ArgumentError = errors.New("invalid arguments")
-var HashError = errors.New("hash wrong length")
+var HashError = errors.New("hash is not a valid address")
+var NameError = errors.New("invalid name in directory")
 
 // Handle errors
 func check(err error) bool {
@@ -46,9 +52,21 @@ func main() {
     args := os.Args[1:]
 
     if len(args) > 0 {
-        if args[0] == "store" {
+        if args[0] == "store" && len(args) > 1 && args[1] == "-r" {
+            r := handleStoreTree(&cConfig, args[2:])
+            println(r)
+        } else if args[0] == "store" {
             r := handleStore(&cConfig, args[1:])
             println(r)
+        } else if args[0] == "stat" {
+            stat := handleStat(&cConfig, args[1:])
+            println(stat)
+        } else if args[0] == "ls" {
+            listing := handleList(&cConfig, args[1:])
+            println(listing)
+        } else if args[0] == "get" {
+            dir := handleGet(&cConfig, args[1:])
+            println(dir)
         } else if args[0] == "cat" {
             content := handleCat(&cConfig, args[1:])
             println(content)
@@ -58,6 +76,15 @@ func main() {
         } else if args[0] == "unpin" {
             status := handleUnpin(&cConfig, args[1:])
             println(status)
+        } else if args[0] == "rm" {
+            status := handleRemove(&cConfig, args[1:])
+            println(status)
+        } else if args[0] == "publish" {
+            key := handlePublish(&cConfig, args[1:])
+            println(key)
+        } else if args[0] == "resolve" {
+            value := handleResolve(&cConfig, args[1:])
+            println(value)
         } else if args[0] == "routes" {
             contacts := handleContacts(&cConfig)
             println(contacts)
@@ -66,22 +93,55 @@ func main() {
             println(dataDump)
         }
     } else {
-        log.Fatal("Usage: dsf (store filename|cat hex-hash|pin hex-hash|unpin hex-hash)")
+        log.Fatal("Usage: dsf (store [-erasure|-cdc] [-meta] filename|store -r dir|stat hex-hash|ls hex-hash|get hex-hash dir|cat hex-hash|pin hex-hash|unpin hex-hash|rm hex-hash|publish value|resolve hex-key)")
     }
 }
 
 // Store data on client
 func handleStore(config *clientConfig, args []string) string {
+    // -erasure stores the file erasure coded, -cdc cuts it into blocks by content,
+    // -meta stores its name, type and modification time along with it
+    query := url.Values{}
+    meta := false
+    for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+        switch args[0] {
+        case "-erasure":
+            query.Set("erasure", "true")
+        case "-cdc":
+            query.Set("chunking", "cdc")
+        case "-meta":
+            meta = true
+        default:
+            check(ArgumentError)
+        }
+        args = args[1:]
+    }
     if len(args) != 1 {
         check(ArgumentError)
     }
+    if meta {
+        info, statErr := os.Stat(args[0])
+        check(statErr)
+        query.Set("name", info.Name())
+        query.Set("modtime", strconv.FormatInt(info.ModTime().Unix(), 10))
+    }
 
+    // Report status to user
+    if len(query) == 0 {
+        return storeFile(config, args[0], "")
+    }
+    return storeFile(config, args[0], "?"+query.Encode())
+}
+
+// Store one file, returns its hash
+func storeFile(config *clientConfig, path string, query string) string {
     // Load file
-    fileReader, fileErr := os.Open(args[0])
+    fileReader, fileErr := os.Open(path)
     check(fileErr)
+    defer fileReader.Close()
 
     // Perform request
-    request := fmt.Sprintf("http://%s/store", config.Address)
+    request := fmt.Sprintf("http://%s/store%s", config.Address, query)
     response, requestErr := http.Post(request, "application/octet-stream", fileReader)
     check(requestErr)
     defer response.Body.Close()
@@ -90,25 +150,191 @@ func handleStore(config *clientConfig, args []string) string {
     body, readErr := ioutil.ReadAll(response.Body)
     check(readErr)
 
-    // Fail if length mismatch
-    if len(body) != kademlia.IDLength {
+    // Fail unless it is a multihash
+    if _, err := kademlia.ParseMultihash(body); err != nil {
         print("body was:", body)
         check(HashError)
     }
+    return hex.EncodeToString(body)
+}
 
-    // Report status to user
+// Metadata of a file, as the REST layer sends it
+type fileStat struct {
+    Name     string
+    Size     int64
+    MimeType string
+    ModTime  time.Time
+    Content  string
+}
+
+// Show the name, size, type and modification time stored with a file
+func handleStat(config *clientConfig, args []string) string {
+    if len(args) != 1 {
+        check(ArgumentError)
+    }
+
+    hash := args[0]
+    if _, err := kademlia.ParseAddress(hash); err != nil {
+        check(HashError)
+    }
+
+    // Perform request
+    request := fmt.Sprintf("http://%s/stat/%s", config.Address, hash)
+    response, requestErr := http.Get(request)
+    check(requestErr)
+    defer response.Body.Close()
+
+    // Read response
+    body, readErr := ioutil.ReadAll(response.Body)
+    check(readErr)
+    if response.StatusCode != http.StatusOK {
+        return string(body)
+    }
+    var stat fileStat
+    check(json.Unmarshal(body, &stat))
+    return fmt.Sprintf("Name: %s\nSize: %d\nType: %s\nModified: %s\nContent: %s",
+        stat.Name, stat.Size, stat.MimeType, stat.ModTime.Format(time.RFC3339), stat.Content)
+}
+
+// An entry of a directory listing, as the REST layer sends it
+type dirEntry struct {
+    Name string
+    Hash string
+    Dir  bool
+    Size int64
+}
+
+// Store a directory tree, returns the hash of its top directory
+func handleStoreTree(config *clientConfig, args []string) string {
+    if len(args) != 1 {
+        check(ArgumentError)
+    }
+    return storeTree(config, args[0])
+}
+
+// Store the files of a directory and its subdirectories, then the directory listing them
+func storeTree(config *clientConfig, path string) string {
+    infos, readErr := ioutil.ReadDir(path)
+    check(readErr)
+    entries := []dirEntry{}
+    for _, info := range infos {
+        child := filepath.Join(path, info.Name())
+        if info.IsDir() {
+            entries = append(entries, dirEntry{Name: info.Name(), Hash: storeTree(config, child), Dir: true})
+        } else if info.Mode().IsRegular() {
+            // Links, devices and the like are left out
+            entries = append(entries, dirEntry{Name: info.Name(), Hash: storeFile(config, child, ""), Size: info.Size()})
+        }
+    }
+    listing, err := json.Marshal(entries)
+    check(err)
+
+    // Perform request
+    request := fmt.Sprintf("http://%s/dir", config.Address)
+    response, requestErr := http.Post(request, "application/json", bytes.NewReader(listing))
+    check(requestErr)
+    defer response.Body.Close()
+
+    // Read response body
+    body, readErr := ioutil.ReadAll(response.Body)
+    check(readErr)
+    if _, err := kademlia.ParseMultihash(body); err != nil {
+        print("body was:", string(body))
+        check(HashError)
+    }
     return hex.EncodeToString(body)
 }
 
+// List a directory, one entry per line
+func handleList(config *clientConfig, args []string) string {
+    if len(args) != 1 {
+        check(ArgumentError)
+    }
+
+    hash := args[0]
+    if _, err := kademlia.ParseAddress(hash); err != nil {
+        check(HashError)
+    }
+
+    var strOut string
+    for _, entry := range listDirectory(config, hash) {
+        kind := "-"
+        if entry.Dir {
+            kind = "d"
+        }
+        strOut += fmt.Sprintf("%s %s %10d %s\n", kind, entry.Hash, entry.Size, entry.Name)
+    }
+    return strOut
+}
+
+func listDirectory(config *clientConfig, hash string) []dirEntry {
+    // Perform request
+    request := fmt.Sprintf("http://%s/ls/%s", config.Address, hash)
+    response, requestErr := http.Get(request)
+    check(requestErr)
+    defer response.Body.Close()
+
+    // Read response
+    body, readErr := ioutil.ReadAll(response.Body)
+    check(readErr)
+    if response.StatusCode != http.StatusOK {
+        panic(string(body))
+    }
+    var entries []dirEntry
+    check(json.Unmarshal(body, &entries))
+    return entries
+}
+
+// Rebuild a stored directory tree on disk
+func handleGet(config *clientConfig, args []string) string {
+    if len(args) != 2 {
+        check(ArgumentError)
+    }
+
+    hash := args[0]
+    if _, err := kademlia.ParseAddress(hash); err != nil {
+        check(HashError)
+    }
+    getTree(config, hash, args[1])
+    return args[1]
+}
+
+func getTree(config *clientConfig, hash string, dir string) {
+    check(os.MkdirAll(dir, 0755))
+    for _, entry := range listDirectory(config, hash) {
+        // Listings come from the network, a name must not lead out of dir
+        if entry.Name != filepath.Base(entry.Name) || entry.Name == "." || entry.Name == ".." {
+            check(NameError)
+        }
+        target := filepath.Join(dir, entry.Name)
+        if entry.Dir {
+            getTree(config, entry.Hash, target)
+            continue
+        }
+
+        // Perform request
+        request := fmt.Sprintf("http://%s/cat/%s", config.Address, entry.Hash)
+        response, requestErr := http.Get(request)
+        check(requestErr)
+        body, readErr := ioutil.ReadAll(response.Body)
+        response.Body.Close()
+        check(readErr)
+        if response.StatusCode != http.StatusOK {
+            panic(fmt.Sprintf("%s: %s", target, body))
+        }
+        check(ioutil.WriteFile(target, body, 0644))
+    }
+}
+
 // Read data from network
 func handleCat(config *clientConfig, args []string) string {
     if len(args) != 1 {
         check(ArgumentError)
     }
 
-    // Fail if length mismatch
+    // Fail unless it is an address
     hash := args[0]
-    if len(hash) != 2*kademlia.IDLength {
+    if _, err := kademlia.ParseAddress(hash); err != nil {
         check(HashError)
     }
 
@@ -130,7 +356,7 @@ func handlePin(config *clientConfig, args []string) string {
     }
 
     hash := args[0]
-    if len(hash) != 2*kademlia.IDLength {
+    if _, err := kademlia.ParseAddress(hash); err != nil {
         check(HashError)
     }
 
@@ -152,7 +378,7 @@ func handleUnpin(config *clientConfig, args []string) string {
     }
 
     hash := args[0]
-    if len(hash) != 2*kademlia.IDLength {
+    if _, err := kademlia.ParseAddress(hash); err != nil {
         check(HashError)
     }
 
@@ -168,6 +394,77 @@ func handleUnpin(config *clientConfig, args []string) string {
     return string(body)
 }
 
+// Stop storing and advertising a file
+func handleRemove(config *clientConfig, args []string) string {
+    if len(args) != 1 {
+        check(ArgumentError)
+    }
+
+    hash := args[0]
+    if _, err := kademlia.ParseAddress(hash); err != nil {
+        check(HashError)
+    }
+
+    // Perform request
+    request, requestErr := http.NewRequest("DELETE", fmt.Sprintf("http://%s/store/%s", config.Address, hash), nil)
+    check(requestErr)
+    response, requestErr := http.DefaultClient.Do(request)
+    check(requestErr)
+    defer response.Body.Close()
+
+    // Return response
+    body, readErr := ioutil.ReadAll(response.Body)
+    check(readErr)
+    return string(body)
+}
+
+// Publish a value, typically the hash of a file, under the node's record key
+func handlePublish(config *clientConfig, args []string) string {
+    if len(args) != 1 {
+        check(ArgumentError)
+    }
+
+    // Perform request
+    request := fmt.Sprintf("http://%s/publish", config.Address)
+    response, requestErr := http.Post(request, "text/plain", strings.NewReader(args[0]))
+    check(requestErr)
+    defer response.Body.Close()
+
+    // Read response body
+    body, readErr := ioutil.ReadAll(response.Body)
+    check(readErr)
+
+    // Fail if length mismatch
+    if len(body) != kademlia.IDLength {
+        print("body was:", body)
+        check(HashError)
+    }
+    return hex.EncodeToString(body)
+}
+
+// Read the newest value published under a record key
+func handleResolve(config *clientConfig, args []string) string {
+    if len(args) != 1 {
+        check(ArgumentError)
+    }
+
+    key := args[0]
+    if len(key) != 2*kademlia.IDLength {
+        check(HashError)
+    }
+
+    // Perform request
+    request := fmt.Sprintf("http://%s/resolve/%s", config.Address, key)
+    response, requestErr := http.Get(request)
+    check(requestErr)
+    defer response.Body.Close()
+
+    // Read response
+    body, readErr := ioutil.ReadAll(response.Body)
+    check(readErr)
+    return string(body)
+}
+
 func handleContacts(config *clientConfig) string {
     // Perform request
     request := fmt.Sprintf("http://%s/contacts", config.Address)
@@ -8,12 +8,14 @@ import (
     "bytes"
     "net/http"
     "io/ioutil"
-    "crypto/sha1"
     "kademlia"
     "github.com/gorilla/mux"
     "github.com/BurntSushi/toml"
-    "io"
     "encoding/hex"
+    "context"
+    "path/filepath"
+    "strings"
+    "rest"
 )
 
 var testPort int = 7000
@@ -55,8 +57,7 @@ func testHandleCat(w http.ResponseWriter, r *http.Request) {
 func testHandleStore(w http.ResponseWriter, r *http.Request) {
     if r.Method == "POST" {
         b, _ := ioutil.ReadAll(r.Body)
-        sum := sha1.Sum(b)
-        w.Write(sum[:kademlia.IDLength])
+        w.Write(kademlia.NewKademliaIDFromBytes(b).Multihash())
     } else {
         w.Write([]byte("NOT_POST"))
     }
@@ -123,15 +124,8 @@ func TestStore(t *testing.T) {
     content, _ := ioutil.ReadAll(file)
     defer file.Close()
 
-    // Dump content of file into sha1 hasher
-    h := sha1.New()
-    if _, err := io.Copy(h, file); err != nil {
-        fmt.Println("Failed to copy from the file.")
-        t.Fail()
-    }
-    io.WriteString(h, string(content))
-    expected_hash := h.Sum(nil)
-    hexString := hex.EncodeToString(expected_hash[:kademlia.IDLength])
+    // The address is the SHA-256 multihash of the content
+    hexString := kademlia.NewKademliaIDFromBytes(content).Address()
 
     // Make sure that the response is the same as the hasher
     if response != hexString {
@@ -180,3 +174,43 @@ func TestContacts(t *testing.T) {
         t.Fail()
     }
 }
+
+// Upload a directory tree to a real node and rebuild it somewhere else
+func TestStoreGetTree(t *testing.T) {
+    k, err := kademlia.NewKademlia("127.0.0.1", getTestPort(), getTestPort(), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := k.Start(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    restPort := getTestPort()
+    go rest.Initialize(k, restPort)
+    time.Sleep(time.Second)
+    nodeConfig := clientConfig{Address: fmt.Sprintf("localhost:%d", restPort)}
+
+    src, _ := ioutil.TempDir("", "dfs-src")
+    dst, _ := ioutil.TempDir("", "dfs-dst")
+    defer os.RemoveAll(src)
+    defer os.RemoveAll(dst)
+    files := map[string]string{"a.txt": "first", "sub/b.txt": "second", "sub/deeper/c.txt": "third"}
+    for name, content := range files {
+        path := filepath.Join(src, name)
+        os.MkdirAll(filepath.Dir(path), 0755)
+        ioutil.WriteFile(path, []byte(content), 0644)
+    }
+
+    root := handleStoreTree(&nodeConfig, []string{src})
+    listing := handleList(&nodeConfig, []string{root})
+    if !strings.Contains(listing, "a.txt") || !strings.Contains(listing, "d ") {
+        t.Errorf("Unexpected listing %v", listing)
+    }
+    handleGet(&nodeConfig, []string{root, filepath.Join(dst, "copy")})
+    for name, content := range files {
+        got, err := ioutil.ReadFile(filepath.Join(dst, "copy", name))
+        if err != nil || string(got) != content {
+            t.Errorf("%v: expected %q, got %q (%v)", name, content, got, err)
+        }
+    }
+    k.Net.Close()
+}
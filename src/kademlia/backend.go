@@ -0,0 +1,204 @@
+package kademlia
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "sync"
+    "time"
+)
+
+// Error states
+var InvalidBackendError = errors.New("unknown store backend")
+
+// Where the store keeps its entries
+const (
+    // In memory, lost on restart
+    MemoryBackend = "memory"
+    // Files in Config.DataDir, see filebackend.go
+    FileBackend = "file"
+)
+
+// A provider of a provider record, as kept by a backend
+type ProviderEntry struct {
+    Contact   Contact
+    Expires   time.Time
+    Refreshed time.Time
+}
+
+// An entry of the store as kept by a backend: its bytes, and what eviction and republishing are scheduled
+// by. Republish functions cannot be kept, only whether there was one, see KVStore.SetRestoredRepublish.
+type Entry struct {
+    Key           KademliaID
+    Data          []byte
+    // Length of Data, which Iterate may leave out
+    Size          int
+    Pinned        bool
+    Compressed    bool
+    Value         bool
+    Record        bool
+    Providers     []ProviderEntry
+    EvictionTime  time.Time
+    RepublishTime time.Time
+    StoredAt      time.Time
+    LastRead      time.Time
+    Republish     bool
+}
+
+// Holds the entries of a KVStore. The store keeps what it schedules by in memory and goes to the backend
+// for the bytes. It reads and writes the bytes of files without holding its mutex, so backends must be safe
+// for concurrent use.
+type Backend interface {
+    // The entry stored under key, NotFoundError if there is none
+    Get(key KademliaID) (*Entry, error)
+    // The bytes stored under key for streaming, NotFoundError if there is no entry
+    Open(key KademliaID) (io.ReadSeekCloser, error)
+    // Store entry under its key, replacing what was there
+    Put(entry *Entry) error
+    // Store everything about entry but its bytes, which stay as they are. Data is not used.
+    Update(entry *Entry) error
+    // Remove the entry under key, there being none is not an error
+    Delete(key KademliaID) error
+    // Call f with every entry, until it returns false. Data may be left out.
+    Iterate(f func(*Entry) bool) error
+}
+
+// Creates the backend of a node from its settings
+type BackendFactory func(config *Config) (Backend, error)
+
+// Backends by the names Config.Backend takes, see RegisterBackend
+var backends = map[string]BackendFactory{
+    MemoryBackend: func(*Config) (Backend, error) { return newMemoryBackend(), nil },
+    FileBackend:   func(config *Config) (Backend, error) { return newFileBackend(config.DataDir) },
+}
+var backendsMutex = &sync.Mutex{}
+
+// Let nodes keep their store in a backend of their own, such as an embedded database, by setting
+// Config.Backend to name. Registering a name again replaces its factory.
+func RegisterBackend(name string, factory BackendFactory) {
+    backendsMutex.Lock()
+    backends[name] = factory
+    backendsMutex.Unlock()
+}
+
+func validBackend(backend string) bool {
+    backendsMutex.Lock()
+    defer backendsMutex.Unlock()
+    _, ok := backends[backend]
+    return ok
+}
+
+// The backend chosen by config
+func newBackend(config *Config) (Backend, error) {
+    backendsMutex.Lock()
+    factory, ok := backends[config.Backend]
+    backendsMutex.Unlock()
+    if !ok {
+        return nil, InvalidBackendError
+    }
+    return factory(config)
+}
+
+// The entry for data holding blob, blob is nil for updates leaving the bytes alone
+func newEntry(data *kvData, blob []byte) *Entry {
+    entry := &Entry{Key: data.id, Data: blob, Size: data.length, Pinned: data.pinned, Compressed: data.compressed, Value: data.value,
+        Record: data.record != nil, EvictionTime: data.evictionTime, RepublishTime: data.republishTime,
+        StoredAt: data.storedAt, LastRead: data.lastRead, Republish: data.republishFunc != nil}
+    for _, p := range data.providers {
+        entry.Providers = append(entry.Providers, ProviderEntry{Contact: p.contact, Expires: p.expires, Refreshed: p.refreshed})
+    }
+    return entry
+}
+
+// What the store keeps of entry in memory, republishFunc stands in for the republish function it had.
+// The data of signed records is needed to read them.
+func (entry *Entry) kvData(republishFunc func(*KademliaID)) (*kvData, error) {
+    data := &kvData{id: entry.Key, length: entry.Size, pinned: entry.Pinned, compressed: entry.Compressed,
+        value: entry.Value, evictionTime: entry.EvictionTime, republishTime: entry.RepublishTime,
+        storedAt: entry.StoredAt, lastRead: entry.LastRead}
+    if entry.Record {
+        var err error
+        if data.record, err = unmarshalRecord(entry.Data); err != nil {
+            return nil, err
+        }
+    }
+    if len(entry.Providers) > 0 {
+        data.providers = []*provider{}
+        for _, p := range entry.Providers {
+            data.providers = append(data.providers, &provider{contact: p.Contact, expires: p.Expires, refreshed: p.Refreshed})
+        }
+    }
+    if entry.Republish {
+        data.republishFunc = republishFunc
+    }
+    return data, nil
+}
+
+type memoryBackend struct {
+    entries map[KademliaID]*Entry
+    mutex   *sync.Mutex
+}
+
+func newMemoryBackend() *memoryBackend {
+    return &memoryBackend{entries: make(map[KademliaID]*Entry), mutex: &sync.Mutex{}}
+}
+
+func (backend *memoryBackend) Get(key KademliaID) (*Entry, error) {
+    backend.mutex.Lock()
+    defer backend.mutex.Unlock()
+    entry, ok := backend.entries[key]
+    if !ok {
+        return nil, NotFoundError
+    }
+    return entry, nil
+}
+
+func (backend *memoryBackend) Open(key KademliaID) (io.ReadSeekCloser, error) {
+    entry, err := backend.Get(key)
+    if err != nil {
+        return nil, err
+    }
+    return memoryFile{bytes.NewReader(entry.Data)}, nil
+}
+
+func (backend *memoryBackend) Put(entry *Entry) error {
+    backend.mutex.Lock()
+    backend.entries[entry.Key] = entry
+    backend.mutex.Unlock()
+    return nil
+}
+
+func (backend *memoryBackend) Update(entry *Entry) error {
+    backend.mutex.Lock()
+    defer backend.mutex.Unlock()
+    updated := *entry
+    updated.Data = nil
+    if current, ok := backend.entries[entry.Key]; ok {
+        updated.Data = current.Data
+    }
+    backend.entries[entry.Key] = &updated
+    return nil
+}
+
+func (backend *memoryBackend) Delete(key KademliaID) error {
+    backend.mutex.Lock()
+    delete(backend.entries, key)
+    backend.mutex.Unlock()
+    return nil
+}
+
+// f is called without the lock held, it may use the backend
+func (backend *memoryBackend) Iterate(f func(*Entry) bool) error {
+    backend.mutex.Lock()
+    entries := make([]*Entry, 0, len(backend.entries))
+    for _, entry := range backend.entries {
+        entries = append(entries, entry)
+    }
+    backend.mutex.Unlock()
+    for _, entry := range entries {
+        if !f(entry) {
+            break
+        }
+    }
+    return nil
+}
@@ -0,0 +1,304 @@
+package kademlia
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestFileBackendRestart(t *testing.T) {
+    dir, err := ioutil.TempDir("", "kvstore")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    config := DefaultConfig()
+    config.Backend = FileBackend
+    config.DataDir = dir
+    config.RepublishTime = 500 * time.Millisecond
+    republishFunc := func(*KademliaID) {}
+
+    kvStore, _ := NewKVStore(config)
+    pinned := NewKademliaIDFromBytes([]byte("pinned"))
+    kvStore.Insert(*pinned, true, []byte("pinned"), republishFunc)
+    file := NewKademliaIDFromBytes([]byte("file"))
+    stored, _ := kvStore.Insert(*file, false, []byte("file"), nil)
+    expiring := NewKademliaIDFromBytes([]byte("expiring"))
+    kvStore.InsertExpiring(*expiring, false, []byte("expiring"), nil, 50*time.Millisecond)
+    removed := NewKademliaIDFromBytes([]byte("removed"))
+    kvStore.Insert(*removed, false, []byte("removed"), nil)
+    kvStore.Remove(*removed)
+    provided := NewKademliaIDFromBytes([]byte("provided"))
+    provider := NewContact(NewRandomKademliaID(), "localhost", 8000, 8001)
+    kvStore.AddProvider(*provided, provider, time.Hour)
+    value := NewKademliaIDFromBytes([]byte("value"))
+    kvStore.PutValue(*value, []byte("value"), republishFunc)
+    kvStore.Close()
+    // Half written by a run which stopped while saving, and bytes whose entry was removed
+    halfWritten := filepath.Join(dir, NewRandomKademliaID().String()+tempSuffix)
+    ioutil.WriteFile(halfWritten, []byte("garbage"), 0644)
+    orphan := filepath.Join(dir, NewRandomKademliaID().String()+blobSuffix)
+    ioutil.WriteFile(orphan, []byte("garbage"), 0644)
+    // Not ours, the directory may be shared
+    unrelated := []string{filepath.Join(dir, "notes.txt"), filepath.Join(dir, "notes.txt"+tempSuffix)}
+    for _, path := range unrelated {
+        ioutil.WriteFile(path, []byte("keep me"), 0644)
+    }
+    time.Sleep(100 * time.Millisecond)
+
+    kvStore, _ = NewKVStore(config)
+    defer kvStore.Close()
+    for _, id := range []*KademliaID{pinned, file} {
+        if _, err := kvStore.Lookup(*id); err != nil {
+            t.Errorf("expected %v to be restored, got %v", id.String(), err)
+        }
+    }
+    for _, id := range []*KademliaID{expiring, removed} {
+        if _, err := kvStore.Lookup(*id); err != NotFoundError {
+            t.Errorf("expected %v to be gone, got %v", id.String(), err)
+        }
+        for _, path := range []string{filepath.Join(dir, id.String()), filepath.Join(dir, id.String()+blobSuffix)} {
+            if _, err := os.Stat(path); !os.IsNotExist(err) {
+                t.Errorf("expected %v to be removed, got %v", path, err)
+            }
+        }
+    }
+    for _, path := range []string{halfWritten, orphan} {
+        if _, err := os.Stat(path); !os.IsNotExist(err) {
+            t.Errorf("expected %v to be removed, got %v", path, err)
+        }
+    }
+    for _, path := range unrelated {
+        if _, err := os.Stat(path); err != nil {
+            t.Errorf("expected %v to be left alone, got %v", path, err)
+        }
+    }
+    kvStore.mutex.Lock()
+    if !kvStore.mapping[*pinned].pinned || kvStore.mapping[*file].pinned {
+        t.Errorf("expected pins to be restored")
+    }
+    if restored := kvStore.mapping[*file].evictionTime; !restored.Equal(stored.evictionTime) {
+        t.Errorf("expected eviction at %v, got %v", stored.evictionTime, restored)
+    }
+    if len(kvStore.evictionQueue) != 4 {
+        t.Errorf("expected 4 entries queued for eviction, got %v", len(kvStore.evictionQueue))
+    }
+    kvStore.mutex.Unlock()
+    if providers, err := kvStore.Providers(*provided); err != nil || len(providers) != 1 || !providers[0].ID.Equals(provider.ID) {
+        t.Errorf("expected the provider to be restored, got %v, %v", providers, err)
+    }
+    kvStore.mutex.Lock()
+    if refreshed := kvStore.mapping[*provided].providers[0].refreshed; refreshed.IsZero() {
+        t.Errorf("expected the refresh time of the provider to be restored")
+    }
+    kvStore.mutex.Unlock()
+    if restored, err := kvStore.GetValue(*value); err != nil || string(restored) != "value" {
+        t.Errorf("expected the value to be restored, got %q, %v", restored, err)
+    }
+
+    republished := make(chan KademliaID, 10)
+    kvStore.SetRestoredRepublish(func(id *KademliaID) { republished <- *id })
+    seen := map[KademliaID]bool{}
+    for len(seen) < 2 {
+        select {
+        case id := <-republished:
+            seen[id] = true
+        case <-time.After(2 * time.Second):
+            t.Fatalf("expected the pinned file and the value to be republished, got %v", seen)
+        }
+    }
+    if !seen[*pinned] || !seen[*valueKey(value)] {
+        t.Errorf("expected the pinned file and the value to be republished, got %v", seen)
+    }
+}
+
+// Any backend given to the store is used for the bytes, and what it holds already is restored
+func TestBackendRestore(t *testing.T) {
+    backend := newMemoryBackend()
+    kvStore, _ := NewKVStoreWithBackend(DefaultConfig(), backend)
+    file := NewKademliaIDFromBytes([]byte("file"))
+    kvStore.Insert(*file, true, []byte("file"), nil)
+    if entry, err := backend.Get(*file); err != nil || string(entry.Data) != "file" || !entry.Pinned {
+        t.Errorf("expected the file in the backend, got %v, %v", entry, err)
+    }
+    kvStore.Unpin(*file)
+    if entry, _ := backend.Get(*file); entry.Pinned || string(entry.Data) != "file" {
+        t.Errorf("expected the unpinned file in the backend, got %v", entry)
+    }
+    kvStore.Close()
+
+    kvStore, _ = NewKVStoreWithBackend(DefaultConfig(), backend)
+    defer kvStore.Close()
+    if data, err := kvStore.Lookup(*file); err != nil || string(data) != "file" {
+        t.Errorf("expected the file to be restored, got %q, %v", data, err)
+    }
+    if used := kvStore.Used(); used != 4 {
+        t.Errorf("expected 4 bytes used, got %v", used)
+    }
+    kvStore.Remove(*file)
+    if _, err := backend.Get(*file); err != NotFoundError {
+        t.Errorf("expected the file to be removed from the backend, got %v", err)
+    }
+}
+
+// A data directory which cannot be used fails the store instead of keeping it in memory
+func TestFileBackendUnusable(t *testing.T) {
+    file, err := ioutil.TempFile("", "kvstore")
+    if err != nil {
+        t.Fatal(err)
+    }
+    file.Close()
+    defer os.Remove(file.Name())
+    config := DefaultConfig()
+    config.Backend = FileBackend
+    config.DataDir = filepath.Join(file.Name(), "data")
+
+    if kvStore, err := NewKVStore(config); err == nil || kvStore != nil {
+        t.Errorf("expected the store to fail, got %v, %v", kvStore, err)
+    }
+    if kademlia, err := NewKademlia("127.0.0.1", 9690, 9691, config); err == nil || kademlia != nil {
+        t.Errorf("expected the node to fail, got %v, %v", kademlia, err)
+    }
+}
+
+// Pinning and republishing only write what changed about an entry, its bytes are left alone
+func TestFileBackendUpdate(t *testing.T) {
+    dir, err := ioutil.TempDir("", "kvstore")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    backend, err := newFileBackend(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    kvStore, _ := NewKVStoreWithBackend(DefaultConfig(), backend)
+    defer kvStore.Close()
+    file := NewKademliaIDFromBytes([]byte("file"))
+    kvStore.Insert(*file, false, []byte("file"), nil)
+    blob := filepath.Join(dir, file.String()+blobSuffix)
+    before, err := os.Stat(blob)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    kvStore.Pin(*file)
+    if after, err := os.Stat(blob); err != nil || !os.SameFile(before, after) {
+        t.Errorf("expected the bytes not to be written again, got %v", err)
+    }
+    if entry, err := backend.Get(*file); err != nil || !entry.Pinned || string(entry.Data) != "file" {
+        t.Errorf("expected the pinned file in the backend, got %v, %v", entry, err)
+    }
+
+    // Streamed from the file holding its bytes
+    opened, size, err := kvStore.Open(*file)
+    if err != nil || size != 4 {
+        t.Fatalf("Open returned size %v: %v", size, err)
+    }
+    defer opened.Close()
+    if _, ok := opened.(*os.File); !ok {
+        t.Errorf("expected the file to be streamed from disk, got %T", opened)
+    }
+    if data, err := ioutil.ReadAll(opened); err != nil || string(data) != "file" {
+        t.Errorf("expected the stored file, got %q, %v", data, err)
+    }
+}
+
+// Holds Put until release is closed
+type slowBackend struct {
+    *memoryBackend
+    writing chan bool
+    release chan bool
+}
+
+func (backend *slowBackend) Put(entry *Entry) error {
+    backend.writing <- true
+    <-backend.release
+    return backend.memoryBackend.Put(entry)
+}
+
+// Writing a file does not hold up the rest of the store, reading it waits for it to be written
+func TestBackendSlowWrite(t *testing.T) {
+    backend := &slowBackend{newMemoryBackend(), make(chan bool, 2), make(chan bool)}
+    kvStore, _ := NewKVStoreWithBackend(DefaultConfig(), backend)
+    defer kvStore.Close()
+    other := NewKademliaIDFromBytes([]byte("other"))
+    close(backend.release)
+    kvStore.Insert(*other, false, []byte("other"), nil)
+    <-backend.writing
+    backend.release = make(chan bool)
+
+    file := NewKademliaIDFromBytes([]byte("file"))
+    done := make(chan bool)
+    go func() {
+        kvStore.Insert(*file, false, []byte("file"), nil)
+        done <- true
+    }()
+    <-backend.writing
+    if data, err := kvStore.Lookup(*other); err != nil || string(data) != "other" {
+        t.Errorf("expected to read other files while writing, got %q, %v", data, err)
+    }
+    if err := kvStore.Pin(*other); err != nil {
+        t.Errorf("expected to pin other files while writing, got %v", err)
+    }
+    read := make(chan []byte)
+    go func() {
+        data, _ := kvStore.Lookup(*file)
+        read <- data
+    }()
+    select {
+    case data := <-read:
+        t.Errorf("expected the read to wait for the write, got %q", data)
+    case <-time.After(100 * time.Millisecond):
+    }
+    close(backend.release)
+    <-done
+    if data := <-read; string(data) != "file" {
+        t.Errorf("expected the written file, got %q", data)
+    }
+}
+
+// Counts the entries put into it
+type countingBackend struct {
+    *memoryBackend
+    puts chan KademliaID
+}
+
+func (backend *countingBackend) Put(entry *Entry) error {
+    backend.puts <- entry.Key
+    return backend.memoryBackend.Put(entry)
+}
+
+// Nodes keep their store in backends registered under the name set in their config
+func TestRegisterBackend(t *testing.T) {
+    backend := &countingBackend{newMemoryBackend(), make(chan KademliaID, 10)}
+    RegisterBackend("counting", func(config *Config) (Backend, error) { return backend, nil })
+    config := DefaultConfig()
+    config.Backend = "counting"
+    kademlia := newTestKademlia(config)
+    defer kademlia.Net.Close()
+
+    data := []byte("kept by the counting backend")
+    hash, err := kademlia.Store(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for put := false; !put; {
+        select {
+        case key := <-backend.puts:
+            put = key.Equals(&hash)
+        case <-time.After(time.Second):
+            t.Fatalf("expected %v to be put into the backend", hash.String())
+        }
+    }
+    if read, err := kademlia.Cat(&hash); err != nil || string(read) != string(data) {
+        t.Errorf("expected the stored file, got %q, %v", read, err)
+    }
+
+    config.Backend = "unregistered"
+    if _, err := NewKademlia("127.0.0.1", 9692, 9693, config); err != InvalidBackendError {
+        t.Errorf("expected InvalidBackendError, got %v", err)
+    }
+}
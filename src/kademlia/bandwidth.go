@@ -0,0 +1,291 @@
+package kademlia
+
+import (
+    "errors"
+    "math"
+    "net"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Error states
+var InvalidBandwidthLimitError = errors.New("invalid bandwidth limit")
+
+// Smallest limit accepted, slower peers would time out between two writes
+const minBandwidthLimit = 1 << 10
+
+// Peers which have not transferred anything for this long are forgotten
+const peerIdleTime = 10 * time.Minute
+
+// Time over which throughput is averaged
+const throughputWindow = 5 * time.Second
+
+// Limits on transfers over TCP in bytes per second, 0 means unlimited. Upload and Download apply to all
+// transfers together, PeerUpload and PeerDownload to the transfers with each peer.
+type BandwidthLimits struct {
+    Upload       int
+    Download     int
+    PeerUpload   int
+    PeerDownload int
+}
+
+func (config *Config) bandwidthLimits() BandwidthLimits {
+    return BandwidthLimits{Upload: config.UploadLimit, Download: config.DownloadLimit,
+        PeerUpload: config.PeerUploadLimit, PeerDownload: config.PeerDownloadLimit}
+}
+
+func (limits BandwidthLimits) validate() error {
+    for _, limit := range []int{limits.Upload, limits.Download, limits.PeerUpload, limits.PeerDownload} {
+        if limit != 0 && limit < minBandwidthLimit {
+            return InvalidBandwidthLimitError
+        }
+    }
+    return nil
+}
+
+// What has been transferred with a peer. Rates are in bytes per second, averaged over the last seconds.
+type PeerThroughput struct {
+    Peer         string
+    Uploaded     int64
+    Downloaded   int64
+    UploadRate   float64
+    DownloadRate float64
+}
+
+// A token bucket holding up to one second of bytes. Transfers take tokens up front and may run the bucket
+// into debt, which the next transfer waits out.
+type rateLimiter struct {
+    rate   int
+    tokens float64
+    last   time.Time
+}
+
+// How long to wait before sending n bytes
+func (limiter *rateLimiter) reserve(n int, now time.Time) time.Duration {
+    if limiter.rate == 0 {
+        return 0
+    }
+    limiter.tokens = math.Min(limiter.tokens+now.Sub(limiter.last).Seconds()*float64(limiter.rate), float64(limiter.rate))
+    limiter.last = now
+    limiter.tokens -= float64(n)
+    if limiter.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-limiter.tokens / float64(limiter.rate) * float64(time.Second))
+}
+
+func (limiter *rateLimiter) setRate(rate int, now time.Time) {
+    limiter.rate = rate
+    limiter.tokens = math.Min(limiter.tokens, float64(rate))
+    limiter.last = now
+}
+
+// Bytes transferred, in total and as a moving average rate
+type meter struct {
+    total int64
+    rate  float64
+    last  time.Time
+}
+
+func (m *meter) add(n int, now time.Time) {
+    m.rate = m.current(now) + float64(n)/throughputWindow.Seconds()
+    m.total += int64(n)
+    m.last = now
+}
+
+func (m *meter) current(now time.Time) float64 {
+    return m.rate * math.Exp(-now.Sub(m.last).Seconds()/throughputWindow.Seconds())
+}
+
+type peerBandwidth struct {
+    upload     rateLimiter
+    download   rateLimiter
+    uploaded   meter
+    downloaded meter
+}
+
+// Throttles and measures the transfers of a node
+type bandwidth struct {
+    limits   BandwidthLimits
+    upload   rateLimiter
+    download rateLimiter
+    peers    map[string]*peerBandwidth
+    mutex    sync.Mutex
+}
+
+func newBandwidth(limits BandwidthLimits) *bandwidth {
+    bw := &bandwidth{peers: make(map[string]*peerBandwidth)}
+    bw.setLimits(limits)
+    return bw
+}
+
+func (bw *bandwidth) getLimits() BandwidthLimits {
+    bw.mutex.Lock()
+    defer bw.mutex.Unlock()
+    return bw.limits
+}
+
+// Change the limits, transfers under way slow down or speed up with their next write
+func (bw *bandwidth) setLimits(limits BandwidthLimits) error {
+    if err := limits.validate(); err != nil {
+        return err
+    }
+    bw.mutex.Lock()
+    defer bw.mutex.Unlock()
+    now := time.Now()
+    bw.limits = limits
+    bw.upload.setRate(limits.Upload, now)
+    bw.download.setRate(limits.Download, now)
+    for _, peer := range bw.peers {
+        peer.upload.setRate(limits.PeerUpload, now)
+        peer.download.setRate(limits.PeerDownload, now)
+    }
+    return nil
+}
+
+// Must hold the mutex
+func (bw *bandwidth) peer(name string, now time.Time) *peerBandwidth {
+    peer, ok := bw.peers[name]
+    if !ok {
+        for other, idle := range bw.peers {
+            if now.Sub(idle.uploaded.last) > peerIdleTime && now.Sub(idle.downloaded.last) > peerIdleTime {
+                delete(bw.peers, other)
+            }
+        }
+        peer = &peerBandwidth{}
+        peer.upload.setRate(bw.limits.PeerUpload, now)
+        peer.download.setRate(bw.limits.PeerDownload, now)
+        bw.peers[name] = peer
+    }
+    return peer
+}
+
+// Account for n bytes sent to or received from a peer, and wait until the limits allow them. Returns
+// whether it waited.
+func (bw *bandwidth) wait(name string, upload bool, n int) bool {
+    bw.mutex.Lock()
+    now := time.Now()
+    peer := bw.peer(name, now)
+    var delay time.Duration
+    if upload {
+        peer.uploaded.add(n, now)
+        delay = maxDuration(bw.upload.reserve(n, now), peer.upload.reserve(n, now))
+    } else {
+        peer.downloaded.add(n, now)
+        delay = maxDuration(bw.download.reserve(n, now), peer.download.reserve(n, now))
+    }
+    bw.mutex.Unlock()
+    if delay <= 0 {
+        return false
+    }
+    time.Sleep(delay)
+    return true
+}
+
+// Largest read or write in one go, a quarter second at the lowest limit in that direction
+func (bw *bandwidth) pieceSize(upload bool) int {
+    bw.mutex.Lock()
+    defer bw.mutex.Unlock()
+    size := transferChunkSize
+    limits := []int{bw.limits.Download, bw.limits.PeerDownload}
+    if upload {
+        limits = []int{bw.limits.Upload, bw.limits.PeerUpload}
+    }
+    for _, limit := range limits {
+        if limit != 0 && limit/4 < size {
+            size = limit / 4
+        }
+    }
+    return size
+}
+
+// Throughput with every peer transferred with lately, sorted by peer
+func (bw *bandwidth) throughput() []PeerThroughput {
+    bw.mutex.Lock()
+    defer bw.mutex.Unlock()
+    now := time.Now()
+    result := []PeerThroughput{}
+    for name, peer := range bw.peers {
+        result = append(result, PeerThroughput{Peer: name, Uploaded: peer.uploaded.total, Downloaded: peer.downloaded.total,
+            UploadRate: peer.uploaded.current(now), DownloadRate: peer.downloaded.current(now)})
+    }
+    sort.Slice(result, func(i, j int) bool { return result[i].Peer < result[j].Peer })
+    return result
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+    if a >= b {
+        return a
+    }
+    return b
+}
+
+// How peers are told apart, by the IP address at the other end of a connection. What a peer says about
+// itself in its messages cannot be trusted, and the port of a connection it opened is picked by its system.
+func peerName(remote net.Addr) string {
+    host, _, err := net.SplitHostPort(remote.String())
+    if err != nil {
+        return remote.String()
+    }
+    return host
+}
+
+// A connection whose reads and writes are throttled by the limits with a peer. Waiting renews the
+// deadline of the connection, so a throttled transfer does not time out.
+type limitedConn struct {
+    net.Conn
+    bandwidth *bandwidth
+    peer      string
+    timeout   time.Duration
+}
+
+func (bw *bandwidth) limit(connection net.Conn, peer string, timeout time.Duration) net.Conn {
+    return &limitedConn{Conn: connection, bandwidth: bw, peer: peer, timeout: timeout}
+}
+
+func (connection *limitedConn) Read(p []byte) (int, error) {
+    if size := connection.bandwidth.pieceSize(false); len(p) > size {
+        p = p[:size]
+    }
+    n, err := connection.Conn.Read(p)
+    if n > 0 && connection.bandwidth.wait(connection.peer, false, n) {
+        connection.Conn.SetReadDeadline(time.Now().Add(connection.timeout))
+    }
+    return n, err
+}
+
+func (connection *limitedConn) Write(p []byte) (int, error) {
+    written := 0
+    for written < len(p) {
+        piece := p[written:]
+        if size := connection.bandwidth.pieceSize(true); len(piece) > size {
+            piece = piece[:size]
+        }
+        if connection.bandwidth.wait(connection.peer, true, len(piece)) {
+            connection.Conn.SetWriteDeadline(time.Now().Add(connection.timeout))
+        }
+        n, err := connection.Conn.Write(piece)
+        written += n
+        if err != nil {
+            return written, err
+        }
+    }
+    return written, nil
+}
+
+// Limits in force on the transfers of this node
+func (network *Network) BandwidthLimits() BandwidthLimits {
+    return network.bandwidth.getLimits()
+}
+
+// Change the limits on the transfers of this node. Returns InvalidBandwidthLimitError, and keeps the old
+// limits, if one is below 1 kB/s.
+func (network *Network) SetBandwidthLimits(limits BandwidthLimits) error {
+    return network.bandwidth.setLimits(limits)
+}
+
+// Bytes transferred with each peer lately
+func (network *Network) Throughput() []PeerThroughput {
+    return network.bandwidth.throughput()
+}
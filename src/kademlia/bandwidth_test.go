@@ -0,0 +1,70 @@
+package kademlia
+
+import (
+    "bytes"
+    "io/ioutil"
+    "math/rand"
+    "testing"
+    "time"
+)
+
+func TestRateLimiter(t *testing.T) {
+    now := time.Now()
+    limiter := rateLimiter{}
+    if delay := limiter.reserve(1<<20, now); delay != 0 {
+        t.Errorf("unlimited transfer had to wait %v", delay)
+    }
+    limiter.setRate(1000, now)
+    if delay := limiter.reserve(500, now); delay != 500*time.Millisecond {
+        t.Errorf("expected to wait 500ms, got %v", delay)
+    }
+    // The debt is paid off after half a second, then a full bucket builds up over one second
+    if delay := limiter.reserve(1000, now.Add(2*time.Second)); delay != 0 {
+        t.Errorf("expected a full bucket, had to wait %v", delay)
+    }
+    if delay := limiter.reserve(250, now.Add(2*time.Second)); delay != 250*time.Millisecond {
+        t.Errorf("expected to wait 250ms, got %v", delay)
+    }
+}
+
+func TestBandwidthLimitedTransfer(t *testing.T) {
+    limited := DefaultConfig()
+    limited.PeerDownloadLimit = 64 << 10
+    node1 := newTestNetwork(limited)
+    node2 := newTestNetwork(nil)
+    // Random data, which compression does not help with
+    data := make([]byte, 128<<10)
+    rand.Read(data)
+    hash := NewKademliaIDFromBytes(data)
+    node2.Store.Insert(*hash, false, data, nil)
+    // Transfers are accounted to the address they come from, not to the one a peer claims
+    node1.Routing.Me.Address.IP = "10.1.2.3"
+
+    start := time.Now()
+    reader, err := node1.SendDownloadMessage(hash, &node2.Routing.Me)
+    if err != nil {
+        t.Fatal("transfer failed:", err)
+    }
+    got, err := ioutil.ReadAll(reader)
+    reader.Close()
+    if err != nil || !bytes.Equal(data, got) {
+        t.Errorf("expected %v bytes, got %v (%v)", len(data), len(got), err)
+    }
+    if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+        t.Errorf("128 kB at 64 kB/s took only %v", elapsed)
+    }
+
+    peers := node1.Throughput()
+    if len(peers) != 1 || peers[0].Peer != "127.0.0.1" || peers[0].Downloaded < int64(len(data)) ||
+        peers[0].DownloadRate <= 0 {
+        t.Errorf("unexpected throughput %v", peers)
+    }
+    if peers := node2.Throughput(); len(peers) != 1 || peers[0].Peer != "127.0.0.1" || peers[0].Uploaded < int64(len(data)) {
+        t.Errorf("unexpected throughput of the sender %v", peers)
+    }
+    if err := node1.SetBandwidthLimits(BandwidthLimits{Upload: 10}); err != InvalidBandwidthLimitError {
+        t.Error("expected InvalidBandwidthLimitError, got", err)
+    }
+    node1.Close()
+    node2.Close()
+}
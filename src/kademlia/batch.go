@@ -0,0 +1,279 @@
+package kademlia
+
+import (
+    "bytes"
+    "fmt"
+    "math/bits"
+    "sort"
+    "log"
+    "net"
+    "sync"
+    "github.com/vmihailenco/msgpack"
+    "rpc"
+)
+
+// Most keys per batch message, which keeps messages well below the 64 kB UDP limit
+const maxStoreBatchSize = 1000
+const maxFindBatchSize = 20
+
+// Bytes a key takes in a marshaled batch, a contact at most in a FIND_DATA answer, and room for the rest
+// of a message
+const (
+    batchKeySize     = IDLength + 2
+    batchContactSize = 160
+    batchOverhead    = 512
+)
+
+// Keys per batch message, so that messages of keySize bytes per key fit the receive buffer. Other nodes
+// are assumed to use a buffer as large as ours.
+func (network *Network) batchSize(keySize int, most int) int {
+    size := (network.config.ReceiveBufferSize - batchOverhead) / keySize
+    if size > most {
+        return most
+    }
+    if size < 1 {
+        return 1
+    }
+    return size
+}
+
+// STORE_DATA_BATCH_MSG carries the keys
+func (network *Network) storeBatchSize() int {
+    return network.batchSize(batchKeySize, maxStoreBatchSize)
+}
+
+// The answer to FIND_DATA_BATCH_MSG carries up to MaxProviders contacts per key
+func (network *Network) findBatchSize() int {
+    return network.batchSize(batchKeySize+network.config.MaxProviders*batchContactSize, maxFindBatchSize)
+}
+
+// One key of a FIND_DATA_BATCH_MSG answer, keys without owners are left out
+type findDataEntry struct {
+    Key    KademliaID
+    Owners []Contact
+}
+
+// Split keys into slices of at most size keys
+func splitKeys(keys []KademliaID, size int) [][]KademliaID {
+    batches := [][]KademliaID{}
+    for len(keys) > size {
+        batches = append(batches, keys[:size])
+        keys = keys[size:]
+    }
+    if len(keys) > 0 {
+        batches = append(batches, keys)
+    }
+    return batches
+}
+
+// Someone provides the data for many keys at once
+func (network *Network) receiveStoreBatchMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var keys []KademliaID
+    if err := msgpack.Unmarshal(message.Data, &keys); err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    for _, key := range keys {
+        // Keys for which we hold the data ourselves are skipped, as for STORE_DATA_MSG, and so are the
+        // keys we have no room for
+        network.Store.AddProvider(key, message.Origin, network.config.EvictionTime)
+    }
+    fmt.Printf("%v stored %v hash keys from %v\n", network.Routing.Me.Address, len(keys), message.Origin.String())
+}
+
+// Someone wants the owners of many keys at once
+func (network *Network) receiveFindDataBatchMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var keys []KademliaID
+    if err := msgpack.Unmarshal(message.Data, &keys); err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    found := []findDataEntry{}
+    for _, key := range keys {
+        if owners, err := network.findOwners(key); err == nil {
+            found = append(found, findDataEntry{Key: key, Owners: owners})
+        }
+    }
+    data, err := msgpack.Marshal(found)
+    if err != nil {
+        log.Printf("%v failed to marshal value for %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    msg := NetworkMessage{MsgType: rpc.FIND_DATA_BATCH_MSG, Origin: network.Routing.Me, RpcID: message.RpcID, Data: data}
+    go network.SendMessageToUdpConnection(&msg, remote_addr, connection)
+}
+
+// Tell another node to Store <hash,me> for every hash, in as few messages as possible
+func (network *Network) SendStoreBatchMessage(hashes []KademliaID, receiver *Contact) {
+    for _, batch := range splitKeys(hashes, network.storeBatchSize()) {
+        batchMsg, err := msgpack.Marshal(batch)
+        if err != nil {
+            log.Printf("%v could not marshal %v kademlia IDs\n", network.Routing.Me, len(batch))
+            return
+        }
+        network.sendOneWay(rpc.STORE_DATA_BATCH_MSG, batchMsg, receiver)
+    }
+}
+
+// Ask another node for the owners of every hash. Hashes it knows no owners for are missing from the result.
+func (network *Network) SendFindDataBatchMessage(hashes []KademliaID, receiver *Contact) map[KademliaID][]Contact {
+    owners := make(map[KademliaID][]Contact)
+    for _, batch := range splitKeys(hashes, network.findBatchSize()) {
+        batchMsg, err := msgpack.Marshal(batch)
+        if err != nil {
+            log.Printf("%v could not marshal %v kademlia IDs\n", network.Routing.Me, len(batch))
+            return owners
+        }
+        message := NetworkMessage{MsgType: rpc.FIND_DATA_BATCH_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: batchMsg}
+        // Blocks until response
+        response := network.SendReceiveMessage(UDP, &message, receiver)
+        if response == nil || response.MsgType != rpc.FIND_DATA_BATCH_MSG {
+            // The receiver is unreachable, the remaining batches would time out as well
+            return owners
+        }
+        var found []findDataEntry
+        if err := msgpack.Unmarshal(response.Data, &found); err != nil {
+            log.Printf("%v received invalid answer from %v\n", network.Routing.Me.Address, response.Origin.Address)
+            continue
+        }
+        for _, entry := range found {
+            owners[entry.Key] = entry.Owners
+        }
+    }
+    return owners
+}
+
+// Keys grouped by the node they are sent to
+type contactKeys struct {
+    contact Contact
+    keys    []KademliaID
+}
+
+// Index of the highest bit set in a distance, -1 for none. Keys whose distance to each other has a lower
+// highest bit than their distance to a node are in the same subtree of the ID space as seen from that node.
+func highestBit(distance *KademliaID) int {
+    for i, b := range distance {
+        if b != 0 {
+            return (IDLength-i)*8 - 1 - bits.LeadingZeros8(b)
+        }
+    }
+    return -1
+}
+
+// Find the k closest nodes for each hash, then group the hashes by node. Hashes are taken in order, and
+// those in the subtree spanned by the k nodes found for the last lookup share its result instead of
+// having a lookup of their own. This is an approximation: nodes outside of the subtree are farther from
+// them than those inside, so their own k closest nodes are in the subtree too, but where it holds more
+// than k nodes those need not be the k closest to the target of the lookup.
+func (kademlia *Kademlia) groupByClosest(hashes []KademliaID) map[KademliaID]*contactKeys {
+    sorted := append([]KademliaID{}, hashes...)
+    sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i][:], sorted[j][:]) < 0 })
+    groups := make(map[KademliaID]*contactKeys)
+    var target *KademliaID
+    var closest []Contact
+    // Highest bit of the distance from target to the farthest node found
+    radius := -1
+    lookups := 0
+    for i := range sorted {
+        full := len(closest) >= kademlia.Config.ReplicationFactor
+        if target == nil || full && highestBit(sorted[i].CalcDistance(target)) >= radius {
+            target = &sorted[i]
+            closest = kademlia.LookupContact(target)
+            lookups++
+            radius = -1
+            for _, contact := range closest {
+                if bit := highestBit(contact.ID.CalcDistance(target)); bit > radius {
+                    radius = bit
+                }
+            }
+        }
+        for _, contact := range closest {
+            group, ok := groups[*contact.ID]
+            if !ok {
+                group = &contactKeys{contact: contact}
+                groups[*contact.ID] = group
+            }
+            group.keys = append(group.keys, sorted[i])
+        }
+    }
+    fmt.Printf("%v grouped %v hashes with %v lookups\n", kademlia.Net.Routing.Me.Address, len(hashes), lookups)
+    return groups
+}
+
+// Tell the relevant nodes that we have all of these files available, with one batch message per node
+// instead of one message per file and node
+func (kademlia *Kademlia) RepublishMany(hashes []KademliaID) {
+    fmt.Printf("%v publishes %v hashes\n", kademlia.Net.Routing.Me.Address, len(hashes))
+    for _, group := range kademlia.groupByClosest(hashes) {
+        kademlia.Net.SendStoreBatchMessage(group.keys, &group.contact)
+    }
+}
+
+// Find the owners of many files. Each node is asked once for all of the hashes it is close to.
+// Hashes without owners are missing from the result.
+func (kademlia *Kademlia) LookupDataMany(hashes []KademliaID) map[KademliaID][]Contact {
+    result := make(map[KademliaID][]Contact)
+    remote := []KademliaID{}
+    for _, hash := range hashes {
+        if owners, err := kademlia.Net.findOwners(hash); err == nil {
+            result[hash] = owners
+        } else {
+            remote = append(remote, hash)
+        }
+    }
+
+    mutex := &sync.Mutex{}
+    wait := &sync.WaitGroup{}
+    for _, group := range kademlia.groupByClosest(remote) {
+        wait.Add(1)
+        go func(group *contactKeys) {
+            defer wait.Done()
+            found := kademlia.Net.SendFindDataBatchMessage(group.keys, &group.contact)
+            mutex.Lock()
+            defer mutex.Unlock()
+            for hash, owners := range found {
+                result[hash] = mergeContacts(result[hash], owners)
+            }
+        }(group)
+    }
+    wait.Wait()
+    return result
+}
+
+// Append the contacts of more which are not in contacts yet
+func mergeContacts(contacts []Contact, more []Contact) []Contact {
+    for _, contact := range more {
+        known := false
+        for _, other := range contacts {
+            if other.ID.Equals(contact.ID) {
+                known = true
+                break
+            }
+        }
+        if !known {
+            contacts = append(contacts, contact)
+        }
+    }
+    return contacts
+}
+
+// Whether one of contacts has id
+func containsContact(contacts []Contact, id *KademliaID) bool {
+    for _, contact := range contacts {
+        if contact.ID.Equals(id) {
+            return true
+        }
+    }
+    return false
+}
+
+// Contacts without the one with id
+func removeContact(contacts []Contact, id *KademliaID) []Contact {
+    kept := []Contact{}
+    for _, contact := range contacts {
+        if !contact.ID.Equals(id) {
+            kept = append(kept, contact)
+        }
+    }
+    return kept
+}
@@ -3,53 +3,175 @@ package kademlia
 import (
     "log"
     "errors"
+    "fmt"
     "math/rand"
+    "time"
 )
 
-func (kad *Kademlia) Bootstrap(bootAddr string, tcpPort int, bootPort int) {
-    netw := kad.Net
-    tmpID := NewKademliaID("0000000000000000000000000000000000000000") // dummy ID
-    boot := NewContact(tmpID, bootAddr, tcpPort, bootPort)
-
-    // k should be a list of contacts returning, targetID to boot
-    k, bootID := netw.SendFindContactAndIdMessage(netw.Routing.Me.ID, &boot)
-    //k, bootID := netw.FindContactAndID(netw.Routing.Me.ID, &boot)
-    /* TODO: bootstrapping works fine without this?
-	if netw.Routing.Me.ID.Equals(&bootID) {
+// Error states
+var SeedsUnreachableError = errors.New("no bootstrap seed was reachable")
+
+// Outcome of a bootstrap, reported back to the daemon
+type BootstrapResult struct {
+    // Seeds which answered, with their real IDs
+    Reachable []Contact
+    // Seeds which did not answer during the last attempt
+    Unreachable []Address
+    // Contacts added to the routing table while bootstrapping
+    ContactsLearned int
+    // Non-empty buckets in the routing table afterwards
+    BucketsFilled int
+    // Rounds over all seeds until one answered, or until giving up
+    Attempts int
+}
+
+func (result *BootstrapResult) String() string {
+    return fmt.Sprintf("bootstrap(reachable=%v, unreachable=%v, learned=%v, buckets=%v, attempts=%v)",
+        len(result.Reachable), len(result.Unreachable), result.ContactsLearned, result.BucketsFilled, result.Attempts)
+}
+
+// Double the delay, but never beyond the configured maximum
+func (kad *Kademlia) nextBackoff(delay time.Duration) time.Duration {
+    delay *= 2
+    if delay > kad.Config.BootstrapMaxBackoff {
+        delay = kad.Config.BootstrapMaxBackoff
+    }
+    return delay
+}
+
+// Join the network through any of the seeds. Seeds are tried with exponential backoff, and if none of them
+// answers, the node keeps retrying in the background for as long as its routing table stays empty.
+func (kad *Kademlia) Bootstrap(seeds []Address) (*BootstrapResult, error) {
+    // Seeds pointing at ourselves are the base case, the first node of a network boots to itself
+    others := []Address{}
+    for _, seed := range seeds {
+        if seed.IP == kad.Net.Routing.Me.Address.IP && seed.UdpPort == kad.Net.Routing.Me.Address.UdpPort {
+            continue
+        }
+        others = append(others, seed)
+    }
+    if len(others) == 0 {
         log.Println("No bootstrap required.")
-		return
-	}*/
+        return &BootstrapResult{BucketsFilled: kad.Net.Routing.FilledBuckets()}, nil
+    }
+
+    result := kad.bootstrapWithBackoff(others, kad.Config.BootstrapAttempts)
+    if len(result.Reachable) == 0 {
+        kad.startBootstrapRetry(others)
+        return result, SeedsUnreachableError
+    }
+    return result, nil
+}
+
+// Try all seeds up to attempts times, sleeping with exponential backoff in between
+func (kad *Kademlia) bootstrapWithBackoff(seeds []Address, attempts int) *BootstrapResult {
+    var result *BootstrapResult
+    delay := kad.Config.BootstrapBackoff
+    for attempt := 1; attempt <= attempts; attempt++ {
+        result = kad.bootstrapOnce(seeds)
+        result.Attempts = attempt
+        if len(result.Reachable) > 0 {
+            break
+        }
+        if attempt < attempts {
+            log.Printf("%v no seed reachable, retrying in %v\n", kad.Net.Routing.Me.Address, delay)
+            if !kad.sleep(delay) {
+                break
+            }
+            delay = kad.nextBackoff(delay)
+        }
+    }
+    return result
+}
+
+// Only one background retry may run per node, and none after Stop
+func (kad *Kademlia) startBootstrapRetry(seeds []Address) {
+    kad.mutex.Lock()
+    defer kad.mutex.Unlock()
+    if kad.bootRetrying || kad.stopped {
+        return
+    }
+    kad.bootRetrying = true
+    kad.running.Add(1)
+    go kad.bootstrapRetryThread(seeds)
+}
 
-    for _, contact := range k {
-        netw.Routing.AddContact(contact, nil)
+// Keep bootstrapping until someone ends up in the routing table, either through a seed answering
+// or through another node contacting us
+func (kad *Kademlia) bootstrapRetryThread(seeds []Address) {
+    defer kad.running.Done()
+    delay := kad.Config.BootstrapBackoff
+    for kad.Net.Routing.Len() == 0 {
+        if !kad.sleep(delay) || kad.Net.Routing.Len() > 0 {
+            break
+        }
+        result := kad.bootstrapOnce(seeds)
+        fmt.Printf("%v background %v\n", kad.Net.Routing.Me.Address, result.String())
+        delay = kad.nextBackoff(delay)
     }
+    kad.mutex.Lock()
+    kad.bootRetrying = false
+    kad.mutex.Unlock()
+}
 
-    boot = NewContact(&bootID, bootAddr, tcpPort, bootPort)
-    b, _ := netw.Routing.AddContact(boot, netw.SendPingMessage)
+// A single bootstrap round: ask every seed for contacts close to us, then refresh the buckets further away
+func (kad *Kademlia) bootstrapOnce(seeds []Address) *BootstrapResult {
+    netw := kad.Net
+    result := &BootstrapResult{Reachable: []Contact{}, Unreachable: []Address{}}
+    before := netw.Routing.Len()
 
-    if !b {
-        errors.New("contact couldn't be added")
+    // all index from 0 to the bootIndex is further away from the node than the closest seed
+    bootIndex := -1
+    for _, seed := range seeds {
+        tmpID := NewKademliaID("0000000000000000000000000000000000000000") // dummy ID
+        boot := NewContact(tmpID, seed.IP, seed.TcpPort, seed.UdpPort)
+
+        // k should be a list of contacts returning, origin is the seed with its real ID
+        k, origin := netw.SendFindContactAndOriginMessage(netw.Routing.Me.ID, &boot)
+        if origin == nil {
+            result.Unreachable = append(result.Unreachable, seed)
+            continue
+        }
+        result.Reachable = append(result.Reachable, *origin)
+        for _, contact := range k {
+            if !contact.ID.Equals(netw.Routing.Me.ID) {
+                netw.Routing.AddContact(contact, nil)
+            }
+        }
+        if added, _ := netw.Routing.AddContact(*origin, netw.SendPingMessage); !added {
+            log.Printf("%v seed %v couldn't be added\n", netw.Routing.Me.Address, origin.Address)
+        }
+        if index := netw.Routing.getBucketIndex(origin.ID); index > bootIndex {
+            bootIndex = index
+        }
     }
-    kad.Net.Routing.mutex.Lock()
-    // all index from 0 to the bootIndex is further away from the nóde than the boot node
-    bootIndex := netw.Routing.getBucketIndex(boot.ID)
+
     // pick a random node in each bucket to send node lookup on
+    netw.Routing.mutex.Lock()
+    refresh := []Contact{}
     for i := 0; i < bootIndex; i++ {
-        // get the bucket we're going to pick a random index from
-        if bucket := netw.Routing.GetBucket(i); bucket.Len() > 0 {
+        if bucket := netw.Routing.buckets[i]; bucket.Len() > 0 {
             j := rand.Intn(bucket.Len())
             n := 0
             for e := bucket.list.Front(); e != nil; e = e.Next() {
                 if j == n {
-                    contact := e.Value.(Contact) // this might not work
-                    nodeID := e.Value.(Contact).ID
-                    netw.SendFindContactMessage(nodeID, &contact)
+                    refresh = append(refresh, e.Value.(Contact))
                 }
                 n++
             }
-        } else {
-            log.Println("No buckets to ping.")
         }
     }
-    kad.Net.Routing.mutex.Unlock()
+    netw.Routing.mutex.Unlock()
+    // Messages are sent outside the lock, since answers may add contacts to the table
+    for _, contact := range refresh {
+        for _, newContact := range netw.SendFindContactMessage(contact.ID, &contact) {
+            if !newContact.ID.Equals(netw.Routing.Me.ID) {
+                netw.Routing.AddContact(newContact, nil)
+            }
+        }
+    }
+
+    result.ContactsLearned = netw.Routing.Len() - before
+    result.BucketsFilled = netw.Routing.FilledBuckets()
+    return result
 }
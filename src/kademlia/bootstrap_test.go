@@ -1,9 +1,11 @@
 package kademlia
 
 import (
+    "context"
     "testing"
     "rpc"
     "fmt"
+    "time"
 )
 
 func imin(a, b int) int {
@@ -15,17 +17,18 @@ func imin(a, b int) int {
 
 func TestBootstrap(t *testing.T) {
     // Crete a star topofmty
-    NewKademlia("127.0.0.1", 4000, 4001)
+    boot, _ := NewKademlia("127.0.0.1", 4000, 4001, nil)
+    boot.Start(context.Background())
     nodes := 9
     //expected := imin(nodes+1, ReplicationFactor)
 
     k := make([]*Kademlia, nodes)
     for i := 0; i < len(k); i++ {
-        k[i] = NewKademlia("127.0.0.1", getTestPort(), getTestPort())
+        k[i] = newTestKademlia(nil)
     }
 
     for i := 0; i < len(k); i++ {
-        k[i].Bootstrap("127.0.0.1", 4000, 4001)
+        k[i].Bootstrap([]Address{{IP: "127.0.0.1", TcpPort: 4000, UdpPort: 4001}})
     }
 
     // Test finding another node
@@ -42,7 +45,7 @@ func TestBootstrap(t *testing.T) {
     //TODO: one more contact is returned than expected
     /*
     con1 := <-cc[0]
-	fmt.Println("k",ReplicationFactor," nodes",nodes," expected",expected)
+	fmt.Println("k",DefaultConfig().ReplicationFactor," nodes",nodes," expected",expected)
     if len(con1) != expected {
         fmt.Println("incorrect amount of contacts returned, got",len(con1),"expected",expected)
         t.Fail()
@@ -76,3 +79,68 @@ func TestBootstrap(t *testing.T) {
     }
 
 }
+
+// One dead and one live seed, the live one should be enough
+func TestBootstrapMultipleSeeds(t *testing.T) {
+    config := DefaultConfig()
+    config.ConnectionTimeout = 500 * time.Millisecond
+    config.BootstrapAttempts = 2
+
+    seed := newTestKademlia(config)
+    k := newTestKademlia(config)
+    dead := Address{IP: "127.0.0.1", TcpPort: getTestPort(), UdpPort: getTestPort()}
+
+    result, err := k.Bootstrap([]Address{dead, seed.Net.Routing.Me.Address})
+    if err != nil {
+        fmt.Println("Bootstrap failed:", err)
+        t.Fail()
+    }
+    if len(result.Reachable) != 1 || !result.Reachable[0].ID.Equals(seed.Net.Routing.Me.ID) {
+        fmt.Println("Wrong reachable seeds:", result.Reachable)
+        t.Fail()
+    }
+    if len(result.Unreachable) != 1 || result.Unreachable[0] != dead {
+        fmt.Println("Wrong unreachable seeds:", result.Unreachable)
+        t.Fail()
+    }
+    if result.ContactsLearned < 1 || result.BucketsFilled < 1 || result.Attempts != 1 {
+        fmt.Println("Wrong bootstrap result:", result.String())
+        t.Fail()
+    }
+    seed.Net.Close()
+    k.Net.Close()
+}
+
+// A node started before its seed should join once the seed comes up
+func TestBootstrapRetry(t *testing.T) {
+    config := DefaultConfig()
+    config.ConnectionTimeout = 500 * time.Millisecond
+    config.BootstrapAttempts = 2
+    config.BootstrapBackoff = 100 * time.Millisecond
+
+    k := newTestKademlia(config)
+    seedAddress := Address{IP: "127.0.0.1", TcpPort: getTestPort(), UdpPort: getTestPort()}
+
+    result, err := k.Bootstrap([]Address{seedAddress})
+    if err != SeedsUnreachableError {
+        fmt.Println("Expected unreachable seeds, got", err)
+        t.Fail()
+    }
+    if len(result.Reachable) != 0 || len(result.Unreachable) != 1 || result.Attempts != 2 {
+        fmt.Println("Wrong bootstrap result:", result.String())
+        t.Fail()
+    }
+
+    // Bring the seed up, the background retry should find it
+    seed, _ := NewKademlia(seedAddress.IP, seedAddress.TcpPort, seedAddress.UdpPort, nil)
+    seed.Start(context.Background())
+    for i := 0; i < 50 && k.Net.Routing.Len() == 0; i++ {
+        time.Sleep(100 * time.Millisecond)
+    }
+    if k.Net.Routing.Len() == 0 {
+        fmt.Println("Background bootstrap never reached the seed")
+        t.Fail()
+    }
+    seed.Net.Close()
+    k.Net.Close()
+}
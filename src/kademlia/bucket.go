@@ -6,11 +6,13 @@ import (
 
 type bucket struct {
     list *list.List
+    size int
 }
 
-func newBucket() *bucket {
+func newBucket(size int) *bucket {
     bucket := &bucket{}
     bucket.list = list.New()
+    bucket.size = size
     return bucket
 }
 
@@ -23,7 +25,7 @@ func (bucket *bucket) addContact(contact Contact, pingFunc func(*Contact) bool)
         }
     }
     if element == nil {
-        if bucket.list.Len() < ReplicationFactor {
+        if bucket.list.Len() < bucket.size {
             bucket.list.PushFront(contact)
         } else if pingFunc != nil {
             last := bucket.list.Back().Value.(Contact)
@@ -6,14 +6,14 @@ import (
 )
 
 func TestNewBucket(t *testing.T) {
-    element := newBucket()
+    element := newBucket(DefaultConfig().ReplicationFactor)
     if element.list == nil {
         t.Fail()
     }
 }
 
 func TestAddContact(t *testing.T) {
-    storage := newBucket()
+    storage := newBucket(DefaultConfig().ReplicationFactor)
     a := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost", 0, 0)
     b := NewContact(NewKademliaID("0000000000000000000000000000000000000001"), "localhost", 0, 0)
     c := NewContact(NewKademliaID("0000000000000000000000000000000000000011"), "localhost", 0, 0)
@@ -33,7 +33,7 @@ func TestAddContact(t *testing.T) {
 }
 
 func TestGetContactAndCalcDistance(t *testing.T) {
-    storage := newBucket()
+    storage := newBucket(DefaultConfig().ReplicationFactor)
     a := NewContact(NewKademliaID("1010101010101010101010101010101010101010"), "localhost", 0, 0)
     b := NewContact(NewKademliaID("0101010101010101010101010101010101010101"), "localhost", 0, 0)
     e := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost", 0, 0)
@@ -56,7 +56,7 @@ func TestGetContactAndCalcDistance(t *testing.T) {
 }
 
 func TestLen(t *testing.T) {
-    storage := newBucket()
+    storage := newBucket(DefaultConfig().ReplicationFactor)
 
     for i := 0; i < 20; i++ {
         storage.addContact(NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost", 0, 0), nil)
@@ -67,7 +67,7 @@ func TestLen(t *testing.T) {
         t.Fail()
     }
 
-    storage = newBucket()
+    storage = newBucket(DefaultConfig().ReplicationFactor)
     storage.addContact(NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "localhost", 0, 0), nil)
     storage.addContact(NewContact(NewKademliaID("1000000000000000000000000000000000000000"), "localhost", 0, 0), nil)
     storage.addContact(NewContact(NewKademliaID("2000000000000000000000000000000000000000"), "localhost", 0, 0), nil)
@@ -82,7 +82,7 @@ func TestLen(t *testing.T) {
 }
 
 func TestDumpContacts(t *testing.T) {
-    b := newBucket()
+    b := newBucket(DefaultConfig().ReplicationFactor)
     con1 := NewContact(NewKademliaID("0000000000000000000000000000000000000000"), "123.123.123.123", 1234, 4321)
     con2 := NewContact(NewKademliaID("1010101010101010101010101010101010101010"), "456.456.456.456", 5678, 8765)
 
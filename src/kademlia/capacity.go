@@ -0,0 +1,204 @@
+package kademlia
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "time"
+)
+
+// Error states
+var StoreFullError = errors.New("store is full")
+var InvalidCapacityError = errors.New("invalid store capacity")
+var InvalidEvictionPolicyError = errors.New("unknown eviction policy")
+
+// Which entries make room when the store is full
+const (
+    // Least recently read first
+    LRUPolicy = "lru"
+    // Least recently stored first
+    OldestFirstPolicy = "oldest"
+    // Farthest from our ID first, those are the keys other nodes are more likely to hold
+    FarthestFirstPolicy = "farthest"
+)
+
+// What a provider record is charged per provider, about what it takes in memory
+const providerRecordSize = 128
+
+func validEvictionPolicy(policy string) bool {
+    return policy == LRUPolicy || policy == OldestFirstPolicy || policy == FarthestFirstPolicy
+}
+
+// Bytes the entry takes up against the capacity
+func (data *kvData) size() int {
+    return data.length + len(data.providers)*providerRecordSize
+}
+
+// Bytes held by the store
+func (kvStore *KVStore) Used() int {
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    return kvStore.used
+}
+
+// Bring the bytes used up to date after data changed size. Must hold the mutex.
+func (kvStore *KVStore) charge(data *kvData) {
+    kvStore.used += data.size() - data.charged
+    data.charged = data.size()
+}
+
+// Remove data from the map and the backend. Must hold the mutex.
+func (kvStore *KVStore) drop(data *kvData) {
+    delete(kvStore.mapping, data.id)
+    kvStore.unsave(data.id)
+    kvStore.used -= data.charged
+    data.charged = 0
+}
+
+// Put data holding blob in the map and the backend, replacing whatever was stored under its key, after
+// making room for it. Must hold the mutex.
+func (kvStore *KVStore) put(data *kvData, blob []byte) error {
+    if err := kvStore.reserve(data, len(blob)); err != nil {
+        return err
+    }
+    if err := kvStore.backend.Put(newEntry(data, blob)); err != nil {
+        kvStore.release(data)
+        return err
+    }
+    kvStore.install(data)
+    return nil
+}
+
+// Make room for data holding length bytes and charge it before it is written. Must hold the mutex.
+func (kvStore *KVStore) reserve(data *kvData, length int) error {
+    data.length = length
+    if err := kvStore.makeRoom(data.id, data.size()); err != nil {
+        return err
+    }
+    now := time.Now()
+    data.storedAt, data.lastRead = now, now
+    kvStore.charge(data)
+    return nil
+}
+
+// Put reserved data which was written in the map, in place of whatever was stored under its key. Must hold
+// the mutex.
+func (kvStore *KVStore) install(data *kvData) {
+    if current, ok := kvStore.mapping[data.id]; ok {
+        kvStore.used -= current.charged
+        current.charged = 0
+    }
+    kvStore.mapping[data.id] = data
+}
+
+// Give back the room reserved for data which could not be written. The backend may hold part of it, so
+// what was stored under its key is removed as well. Must hold the mutex.
+func (kvStore *KVStore) release(data *kvData) {
+    kvStore.used -= data.charged
+    data.charged = 0
+    if current, ok := kvStore.mapping[data.id]; ok {
+        kvStore.drop(current)
+    } else {
+        kvStore.unsave(data.id)
+    }
+}
+
+// Evict unpinned entries until size bytes fit under key, counting what key holds now as free. Nothing
+// is evicted if that would not be enough, StoreFullError is returned instead. Must hold the mutex.
+func (kvStore *KVStore) makeRoom(key KademliaID, size int) error {
+    capacity := kvStore.config.Capacity
+    if capacity == 0 {
+        return nil
+    }
+    need := kvStore.used + size - capacity
+    if current, ok := kvStore.mapping[key]; ok {
+        need -= current.charged
+    }
+    if need <= 0 {
+        return nil
+    }
+    candidates := []*kvData{}
+    available := 0
+    for _, data := range kvStore.mapping {
+        if kvStore.evictable(data) && data.id != key {
+            candidates = append(candidates, data)
+            available += data.charged
+        }
+    }
+    if available < need {
+        fmt.Println("Store full, no room for", size, "bytes under", key.String())
+        return StoreFullError
+    }
+    kvStore.sortForEviction(candidates)
+    for _, data := range candidates {
+        if need <= 0 {
+            break
+        }
+        need -= data.charged
+        kvStore.drop(data)
+        fmt.Println("Evicted", data.id.String(), "to make room")
+    }
+    return nil
+}
+
+// Whether data may be evicted to make room. Must hold the mutex.
+func (kvStore *KVStore) evictable(data *kvData) bool {
+    return !data.pinned && data.charged > 0 && kvStore.protected[data.id] == 0
+}
+
+// Whether size more bytes can be stored, evicting entries to make room if need be
+func (kvStore *KVStore) fits(size int) bool {
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    capacity := kvStore.config.Capacity
+    if capacity == 0 {
+        return true
+    }
+    available := capacity - kvStore.used
+    for _, data := range kvStore.mapping {
+        if kvStore.evictable(data) {
+            available += data.charged
+        }
+    }
+    return size <= available
+}
+
+// Keep the entry under id from being evicted to make room, while the file it is part of is being stored.
+// Protections are counted, so that stores sharing blocks can overlap.
+func (kvStore *KVStore) protect(id KademliaID) {
+    kvStore.mutex.Lock()
+    kvStore.protected[id]++
+    kvStore.mutex.Unlock()
+}
+
+func (kvStore *KVStore) unprotect(ids []KademliaID) {
+    kvStore.mutex.Lock()
+    for _, id := range ids {
+        if kvStore.protected[id]--; kvStore.protected[id] <= 0 {
+            delete(kvStore.protected, id)
+        }
+    }
+    kvStore.mutex.Unlock()
+}
+
+// Whether an entry is stored under id, without counting as a read
+func (kvStore *KVStore) contains(id KademliaID) bool {
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    _, ok := kvStore.mapping[id]
+    return ok
+}
+
+// Order entries by how soon the eviction policy lets them go
+func (kvStore *KVStore) sortForEviction(candidates []*kvData) {
+    switch kvStore.config.EvictionPolicy {
+    case OldestFirstPolicy:
+        sort.Slice(candidates, func(i, j int) bool { return candidates[i].storedAt.Before(candidates[j].storedAt) })
+    case FarthestFirstPolicy:
+        sort.Slice(candidates, func(i, j int) bool {
+            return candidates[j].id.CalcDistance(&kvStore.self).Less(candidates[i].id.CalcDistance(&kvStore.self))
+        })
+    default:
+        sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastRead.Before(candidates[j].lastRead) })
+    }
+}
@@ -0,0 +1,166 @@
+package kademlia
+
+import (
+    "bytes"
+    "crypto/rand"
+    "testing"
+    "time"
+)
+
+// A store holding three 100 byte entries, with the first one read since
+func fullStore(policy string) (*KVStore, []KademliaID) {
+    config := DefaultConfig()
+    config.Capacity = 300
+    config.EvictionPolicy = policy
+    kvStore, _ := NewKVStore(config)
+    ids := []KademliaID{}
+    for i := 0; i < 3; i++ {
+        data := bytes.Repeat([]byte{byte(i)}, 100)
+        id := NewKademliaIDFromBytes(data)
+        kvStore.Insert(*id, false, data, nil)
+        ids = append(ids, *id)
+        time.Sleep(10 * time.Millisecond)
+    }
+    kvStore.Lookup(ids[0])
+    return kvStore, ids
+}
+
+func TestCapacityEvictionPolicies(t *testing.T) {
+    for policy, evicted := range map[string]int{LRUPolicy: 1, OldestFirstPolicy: 0} {
+        kvStore, ids := fullStore(policy)
+        data := bytes.Repeat([]byte{3}, 100)
+        if _, err := kvStore.Insert(*NewKademliaIDFromBytes(data), false, data, nil); err != nil {
+            t.Errorf("%v: insert failed: %v", policy, err)
+        }
+        for i, id := range ids {
+            if _, err := kvStore.Lookup(id); (err == NotFoundError) != (i == evicted) {
+                t.Errorf("%v: expected entry %v to be evicted, entry %v was looked up with %v", policy, evicted, i, err)
+            }
+        }
+        if used := kvStore.Used(); used != 300 {
+            t.Errorf("%v: expected 300 bytes used, got %v", policy, used)
+        }
+        kvStore.Close()
+    }
+
+    kvStore, ids := fullStore(FarthestFirstPolicy)
+    kvStore.self = ids[2]
+    farthest := 0
+    if ids[0].CalcDistance(&ids[2]).Less(ids[1].CalcDistance(&ids[2])) {
+        farthest = 1
+    }
+    data := bytes.Repeat([]byte{3}, 100)
+    kvStore.Insert(*NewKademliaIDFromBytes(data), false, data, nil)
+    if _, err := kvStore.Lookup(ids[farthest]); err != NotFoundError {
+        t.Errorf("expected the entry farthest from our ID to be evicted, got %v", err)
+    }
+    kvStore.Close()
+}
+
+func TestCapacityFull(t *testing.T) {
+    kvStore, ids := fullStore(LRUPolicy)
+    for _, id := range ids {
+        kvStore.Pin(id)
+    }
+    data := bytes.Repeat([]byte{3}, 100)
+    if _, err := kvStore.Insert(*NewKademliaIDFromBytes(data), false, data, nil); err != StoreFullError {
+        t.Error("expected StoreFullError, got", err)
+    }
+    if err := kvStore.PutValue(*KeyFromName("name"), data, nil); err != StoreFullError {
+        t.Error("expected StoreFullError for a value, got", err)
+    }
+    if err := kvStore.AddProvider(*KeyFromName("key"), NewContact(NewRandomKademliaID(), "127.0.0.1", 1, 2), time.Hour); err != StoreFullError {
+        t.Error("expected StoreFullError for a provider, got", err)
+    }
+    for _, id := range ids {
+        if _, err := kvStore.Lookup(id); err != nil {
+            t.Errorf("pinned entry %v was evicted: %v", id.String(), err)
+        }
+    }
+
+    // Replacing an entry only counts the difference, removing it frees its bytes
+    kvStore.Insert(ids[0], true, bytes.Repeat([]byte{0}, 100), nil)
+    kvStore.Remove(ids[1])
+    if used := kvStore.Used(); used != 200 {
+        t.Errorf("expected 200 bytes used, got %v", used)
+    }
+    // Larger than the whole store
+    large := bytes.Repeat([]byte{4}, 400)
+    if _, err := kvStore.Insert(*NewKademliaIDFromBytes(large), false, large, nil); err != StoreFullError {
+        t.Error("expected StoreFullError, got", err)
+    }
+    kvStore.Close()
+}
+
+// A file is stored whole or not at all, its blocks do not make room for each other
+func TestStoreFileFull(t *testing.T) {
+    config := DefaultConfig()
+    config.Capacity = 128 << 10
+    config.BlockSize = 32 << 10
+    k := newTestKademlia(config)
+    defer k.Net.Close()
+    large := make([]byte, 600<<10)
+    rand.Read(large)
+    if _, err := k.Store(large); err != StoreFullError {
+        t.Error("expected StoreFullError, got", err)
+    }
+    if used := k.Net.Store.Used(); used != 0 {
+        t.Errorf("expected nothing kept of the file, %v bytes are used", used)
+    }
+
+    // Older entries are evicted for a file which fits, the blocks of the file are not
+    old := make([]byte, 64<<10)
+    rand.Read(old)
+    oldHash, _ := k.Store(old)
+    data := make([]byte, 100<<10)
+    rand.Read(data)
+    root, err := k.Store(data)
+    if err != nil {
+        t.Fatal("store failed:", err)
+    }
+    if read, err := k.Cat(&root); err != nil || !bytes.Equal(read, data) {
+        t.Errorf("Cat returned %v of %v bytes: %v", len(read), len(data), err)
+    }
+    if _, err := k.Cat(&oldHash); err == nil {
+        t.Error("expected the older file to make room")
+    }
+}
+
+// Republishing is not reading, it must not keep entries from being evicted first under LRUPolicy
+func TestRepublishNotRead(t *testing.T) {
+    config := DefaultConfig()
+    config.RepublishTime = 50 * time.Millisecond
+    kvStore, _ := NewKVStore(config)
+    defer kvStore.Close()
+    republished := make(chan bool, 10)
+    data := []byte("republished")
+    id := NewKademliaIDFromBytes(data)
+    stored, _ := kvStore.Insert(*id, false, data, func(*KademliaID) { republished <- true })
+    select {
+    case <-republished:
+    case <-time.After(2 * time.Second):
+        t.Fatal("entry was not republished")
+    }
+    kvStore.mutex.Lock()
+    lastRead := kvStore.mapping[*id].lastRead
+    kvStore.mutex.Unlock()
+    if !lastRead.Equal(stored.lastRead) {
+        t.Errorf("republishing moved the last read from %v to %v", stored.lastRead, lastRead)
+    }
+}
+
+func TestPushRefusedWhenFull(t *testing.T) {
+    full := DefaultConfig()
+    full.Capacity = 64
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(full)
+    block := bytes.Repeat([]byte("block"), 100)
+    if err := node1.SendPushDataMessage(block, &node2.Routing.Me); err != PushRefusedError {
+        t.Error("expected PushRefusedError, got", err)
+    }
+    if _, err := node2.Store.Lookup(*NewKademliaIDFromBytes(block)); err != NotFoundError {
+        t.Error("full node kept the block:", err)
+    }
+    node1.Close()
+    node2.Close()
+}
@@ -0,0 +1,74 @@
+package kademlia
+
+import (
+    "crypto/sha1"
+    "encoding/binary"
+)
+
+// Splits data into blocks of at most blockSize bytes
+type chunker func(data []byte, blockSize int) [][]byte
+
+// Blocks of exactly blockSize bytes, the last one shorter
+func fixedChunks(data []byte, blockSize int) [][]byte {
+    chunks := [][]byte{}
+    for offset := 0; offset < len(data); offset += blockSize {
+        end := offset + blockSize
+        if end > len(data) {
+            end = len(data)
+        }
+        chunks = append(chunks, data[offset:end])
+    }
+    return chunks
+}
+
+// Random values for the gear hash. They are derived from SHA-1 rather than a random source, every node
+// and every version must cut the same data at the same places.
+var gearTable [256]uint64
+
+func init() {
+    for i := range gearTable {
+        sum := sha1.Sum([]byte{byte(i)})
+        gearTable[i] = binary.BigEndian.Uint64(sum[:8])
+    }
+}
+
+// Content defined blocks, cut with FastCDC where a rolling hash over the last 64 bytes matches a mask.
+// An insertion or deletion only moves the cuts around it, so two versions of a file share all blocks
+// away from their differences. Blocks are between blockSize/8 and blockSize bytes, about blockSize/2
+// on average.
+func cdcChunks(data []byte, blockSize int) [][]byte {
+    minSize, averageSize := blockSize/8, blockSize/2
+    bits := uint(0)
+    for 1<<(bits+1) <= averageSize {
+        bits++
+    }
+    // Normalized chunking: a harder mask before the average size and an easier one after it keep
+    // block sizes close to the average
+    hardMask := ^uint64(0) << (64 - bits - 2)
+    easyMask := ^uint64(0) << (64 - bits + 2)
+
+    chunks := [][]byte{}
+    for len(data) > 0 {
+        cut := len(data)
+        if cut > blockSize {
+            cut = blockSize
+        }
+        if cut > minSize {
+            hash := uint64(0)
+            for i := minSize; i < cut; i++ {
+                hash = hash<<1 + gearTable[data[i]]
+                mask := easyMask
+                if i < averageSize {
+                    mask = hardMask
+                }
+                if hash&mask == 0 {
+                    cut = i + 1
+                    break
+                }
+            }
+        }
+        chunks = append(chunks, data[:cut])
+        data = data[cut:]
+    }
+    return chunks
+}
@@ -0,0 +1,53 @@
+package kademlia
+
+import (
+    "bytes"
+    "io/ioutil"
+    "testing"
+)
+
+func TestCDCChunks(t *testing.T) {
+    blockSize := 32 << 10
+    data, _ := ioutil.ReadFile("test.bin")
+    chunks := cdcChunks(data, blockSize)
+    if !bytes.Equal(data, bytes.Join(chunks, nil)) {
+        t.Fatal("Chunks do not add up to the data")
+    }
+    for i, chunk := range chunks {
+        if len(chunk) > blockSize || len(chunk) < blockSize/8 && i != len(chunks)-1 {
+            t.Errorf("Chunk %v has %v bytes", i, len(chunk))
+        }
+    }
+
+    // A few bytes inserted in the middle only change the chunks around them
+    edited := append(append(append([]byte{}, data[:len(data)/2]...), []byte("inserted")...), data[len(data)/2:]...)
+    known := make(map[KademliaID]bool)
+    for _, chunk := range chunks {
+        known[*NewKademliaIDFromBytes(chunk)] = true
+    }
+    changed := 0
+    for _, chunk := range cdcChunks(edited, blockSize) {
+        if !known[*NewKademliaIDFromBytes(chunk)] {
+            changed++
+        }
+    }
+    if changed > 2 {
+        t.Errorf("Expected at most 2 new chunks, got %v of %v", changed, len(chunks))
+    }
+    // Fixed size chunks all move
+    if fixed := fixedChunks(edited, blockSize); bytes.Equal(fixed[len(fixed)-2], fixedChunks(data, blockSize)[len(fixed)-2]) {
+        t.Errorf("Fixed chunks were not expected to line up")
+    }
+}
+
+func TestStoreCDC(t *testing.T) {
+    config := DefaultConfig()
+    config.BlockSize = 32 << 10
+    k := newTestKademlia(config)
+    data, _ := ioutil.ReadFile("test.bin")
+    root, _ := k.StoreCDC(data)
+    if read, err := k.Cat(&root); err != nil || !bytes.Equal(data, read) {
+        t.Errorf("Cat returned %v of %v bytes: %v", len(read), len(data), err)
+    }
+    k.Net.Close()
+}
@@ -0,0 +1,81 @@
+package kademlia
+
+import (
+    "bytes"
+    "compress/gzip"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net"
+    "time"
+)
+
+// Error states
+var UnknownCodecError = errors.New("unknown compression codec")
+
+// Codecs transfers can be compressed with, in order of preference. The downloader offers the ones it
+// accepts, the sender picks the first it knows. An empty codec means raw bytes.
+const gzipCodec = "gzip"
+
+var transferCodecs = []string{gzipCodec}
+
+// The first of the offered codecs we know, or raw bytes if there is none
+func chooseCodec(offered []string) string {
+    for _, codec := range offered {
+        for _, known := range transferCodecs {
+            if codec == known {
+                return codec
+            }
+        }
+    }
+    return ""
+}
+
+// Wrap a connection for writing with codec. The returned function flushes what is left and must be
+// called once everything is written.
+func compressWriter(connection net.Conn, codec string, timeout time.Duration) (io.Writer, func() error, error) {
+    switch codec {
+    case "":
+        return connection, func() error { return nil }, nil
+    case gzipCodec:
+        writer := gzip.NewWriter(connection)
+        return writer, func() error {
+            connection.SetWriteDeadline(time.Now().Add(timeout))
+            return writer.Close()
+        }, nil
+    }
+    return nil, nil, UnknownCodecError
+}
+
+// Wrap a connection for reading what was written with codec
+func decompressReader(connection net.Conn, codec string) (io.Reader, error) {
+    switch codec {
+    case "":
+        return connection, nil
+    case gzipCodec:
+        return gzip.NewReader(connection)
+    }
+    return nil, UnknownCodecError
+}
+
+// Compress data for the store
+func compress(data []byte) ([]byte, error) {
+    buffer := &bytes.Buffer{}
+    writer := gzip.NewWriter(buffer)
+    if _, err := writer.Write(data); err != nil {
+        return nil, err
+    }
+    if err := writer.Close(); err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+    reader, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    defer reader.Close()
+    return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,174 @@
+package kademlia
+
+import (
+    "crypto/ed25519"
+    "errors"
+    "time"
+)
+
+// Error states
+var InvalidAlphaError = errors.New("invalid alpha value")
+var InvalidReplicationFactorError = errors.New("invalid replication factor")
+var InvalidTimeoutError = errors.New("invalid connection timeout")
+var InvalidRetryDelayError = errors.New("invalid connection retry delay")
+var BufferTooSmallError = errors.New("receive buffer size too small")
+var InvalidEvictionTimeError = errors.New("invalid eviction time")
+var InvalidRepublishTimeError = errors.New("invalid republish time")
+var InvalidBootstrapError = errors.New("invalid bootstrap setting")
+var InvalidMaxProvidersError = errors.New("invalid provider limit")
+var InvalidSigningKeyError = errors.New("invalid signing key")
+var InvalidMaxValueSizeError = errors.New("invalid value size limit")
+var InvalidSubscriptionTimeError = errors.New("invalid subscription time")
+var InvalidDownloadAttemptsError = errors.New("invalid download attempts")
+var InvalidBlockSizeError = errors.New("invalid block size")
+var InvalidBanTimeError = errors.New("invalid ban time")
+
+// Settings of one node. Every part of a node (network, routing table and store) reads from the same Config,
+// so nodes with different settings can live in the same process.
+type Config struct {
+    // Number of parallel lookups
+    Alpha int
+    // Bucket size, and number of nodes a hash is published to (k)
+    ReplicationFactor int
+    // How long to wait for a response
+    ConnectionTimeout time.Duration
+    // How long to wait before reading a failed connection again
+    ConnectionRetryDelay time.Duration
+    // Largest UDP message, and read size for TCP
+    ReceiveBufferSize int
+    // Unpinned values are removed after this long
+    EvictionTime time.Duration
+    // Stored files are announced to the network this often
+    RepublishTime time.Duration
+    // Rounds over all seeds before bootstrapping continues in the background
+    BootstrapAttempts int
+    // First delay between bootstrap rounds, doubled after each round
+    BootstrapBackoff time.Duration
+    // Upper bound for the delay between bootstrap rounds
+    BootstrapMaxBackoff time.Duration
+    // Most providers remembered for one hash
+    MaxProviders int
+    // Largest value accepted by Put, must fit in one UDP message
+    MaxValueSize int
+    // Topic nodes forget subscribers which did not renew within this time
+    SubscriptionTime time.Duration
+    // Files larger than this are split into blocks of this size
+    BlockSize int
+    // Connections tried before giving up on a download, resuming where the previous one stopped
+    DownloadAttempts int
+    // Peers caught sending corrupt data too often are not downloaded from for this long
+    BanTime time.Duration
+    // Erasure coded files are split into stripes of DataShards blocks, each with ParityShards extra blocks,
+    // and survive the loss of any ParityShards blocks of a stripe
+    DataShards   int
+    ParityShards int
+    // Offer and accept compressed transfers
+    CompressTransfers bool
+    // Keep files compressed in the store when that makes them smaller
+    CompressStore bool
+    // Bytes the store holds at most, 0 for no limit. When it is full, unpinned entries are evicted by
+    // EvictionPolicy: LRUPolicy, OldestFirstPolicy or FarthestFirstPolicy.
+    Capacity       int
+    EvictionPolicy string
+    // Where the store keeps its entries, MemoryBackend, FileBackend in DataDir, which keeps them across
+    // restarts, or a backend added with RegisterBackend
+    Backend string
+    DataDir string
+    // Transfer limits in bytes per second for all peers together and for each peer, 0 for unlimited.
+    // They can be changed later with Network.SetBandwidthLimits.
+    UploadLimit       int
+    DownloadLimit     int
+    PeerUploadLimit   int
+    PeerDownloadLimit int
+    // Also publish the SHA-1 address files had before SHA-256, so old addresses keep working
+    LegacyAddresses bool
+    // Key records are published with, a new one is generated when nil
+    SigningKey ed25519.PrivateKey
+}
+
+func DefaultConfig() *Config {
+    return &Config{
+        Alpha:                3,
+        ReplicationFactor:    20,
+        ConnectionTimeout:    time.Second * 5,
+        ConnectionRetryDelay: time.Second,
+        ReceiveBufferSize:    1 << 20, // One MB
+        EvictionTime:         24 * time.Hour,
+        RepublishTime:        24 * time.Hour,
+        BootstrapAttempts:    5,
+        BootstrapBackoff:     time.Second,
+        BootstrapMaxBackoff:  time.Minute,
+        MaxProviders:         20,
+        MaxValueSize:         64 << 10, // 64 kB
+        SubscriptionTime:     10 * time.Minute,
+        DownloadAttempts:     5,
+        BlockSize:            256 << 10, // 256 kB
+        BanTime:              time.Hour,
+        DataShards:           4,
+        ParityShards:         2,
+        CompressTransfers:    true,
+        Capacity:             1 << 30, // One GB
+        EvictionPolicy:       LRUPolicy,
+        Backend:              MemoryBackend,
+        LegacyAddresses:      true,
+    }
+}
+
+// Check that the settings make sense, returns the first problem found
+func (config *Config) Validate() error {
+    switch {
+    case config.Alpha < 1:
+        return InvalidAlphaError
+    case config.ReplicationFactor < 1:
+        return InvalidReplicationFactorError
+    case config.ConnectionTimeout <= 0:
+        return InvalidTimeoutError
+    case config.ConnectionRetryDelay < 0:
+        return InvalidRetryDelayError
+    case config.ReceiveBufferSize < 1024:
+        return BufferTooSmallError
+    case config.EvictionTime <= 0:
+        return InvalidEvictionTimeError
+    case config.RepublishTime <= 0:
+        return InvalidRepublishTimeError
+    case config.BootstrapAttempts < 1 || config.BootstrapBackoff < 0 || config.BootstrapMaxBackoff < config.BootstrapBackoff:
+        return InvalidBootstrapError
+    case config.MaxProviders < 1:
+        return InvalidMaxProvidersError
+    case config.MaxValueSize < 1 || config.MaxValueSize > config.ReceiveBufferSize/2:
+        return InvalidMaxValueSizeError
+    case config.SubscriptionTime <= 0:
+        return InvalidSubscriptionTimeError
+    case config.DownloadAttempts < 1:
+        return InvalidDownloadAttemptsError
+    case config.BlockSize < 32<<10:
+        // Smaller blocks would need deep trees of manifests, see maxLinks
+        return InvalidBlockSizeError
+    case config.BanTime <= 0:
+        return InvalidBanTimeError
+    case config.DataShards < 1 || config.ParityShards < 1 || config.DataShards+config.ParityShards > 256:
+        return InvalidShardsError
+    case config.Capacity < 0:
+        return InvalidCapacityError
+    case !validEvictionPolicy(config.EvictionPolicy):
+        return InvalidEvictionPolicyError
+    case !validBackend(config.Backend) || config.Backend == FileBackend && config.DataDir == "":
+        return InvalidBackendError
+    case config.bandwidthLimits().validate() != nil:
+        return InvalidBandwidthLimitError
+    case config.SigningKey != nil && len(config.SigningKey) != ed25519.PrivateKeySize:
+        return InvalidSigningKeyError
+    }
+    return nil
+}
+
+// Constructors take nil to mean the defaults, and return the error of Validate for invalid settings
+func checkConfig(config *Config) (*Config, error) {
+    if config == nil {
+        return DefaultConfig(), nil
+    }
+    if err := config.Validate(); err != nil {
+        return nil, err
+    }
+    return config, nil
+}
@@ -0,0 +1,92 @@
+package kademlia
+
+import (
+    "testing"
+    "time"
+)
+
+func TestConfigValidate(t *testing.T) {
+    if err := DefaultConfig().Validate(); err != nil {
+        t.Error("default config is invalid:", err)
+    }
+
+    config := DefaultConfig()
+    config.Alpha = 0
+    if err := config.Validate(); err != InvalidAlphaError {
+        t.Error("expected InvalidAlphaError, got", err)
+    }
+
+    config = DefaultConfig()
+    config.ReceiveBufferSize = 10
+    if err := config.Validate(); err != BufferTooSmallError {
+        t.Error("expected BufferTooSmallError, got", err)
+    }
+
+    config = DefaultConfig()
+    config.BootstrapMaxBackoff = config.BootstrapBackoff / 2
+    if err := config.Validate(); err != InvalidBootstrapError {
+        t.Error("expected InvalidBootstrapError, got", err)
+    }
+
+    config = DefaultConfig()
+    config.EvictionPolicy = "random"
+    if err := config.Validate(); err != InvalidEvictionPolicyError {
+        t.Error("expected InvalidEvictionPolicyError, got", err)
+    }
+
+    config = DefaultConfig()
+    config.Backend = FileBackend
+    if err := config.Validate(); err != InvalidBackendError {
+        t.Error("expected InvalidBackendError without a data directory, got", err)
+    }
+
+    config = DefaultConfig()
+    config.PeerUploadLimit = 100
+    if err := config.Validate(); err != InvalidBandwidthLimitError {
+        t.Error("expected InvalidBandwidthLimitError, got", err)
+    }
+
+    config = DefaultConfig()
+    config.SigningKey = make([]byte, 12)
+    if err := config.Validate(); err != InvalidSigningKeyError {
+        t.Error("expected InvalidSigningKeyError, got", err)
+    }
+}
+
+// Two nodes in the same process must keep their own settings
+func TestConfigPerInstance(t *testing.T) {
+    config1 := DefaultConfig()
+    config1.ReplicationFactor = 2
+    config1.EvictionTime = time.Hour
+    config2 := DefaultConfig()
+
+    node1 := newTestKademlia(config1)
+    node2 := newTestKademlia(config2)
+
+    if node1.Net.Routing.buckets[0].size != 2 || node2.Net.Routing.buckets[0].size != 20 {
+        t.Error("bucket sizes were shared between nodes")
+    }
+    if node1.Net.Store.config.EvictionTime != time.Hour || node2.Net.Store.config.EvictionTime != 24*time.Hour {
+        t.Error("eviction times were shared between nodes")
+    }
+    node1.Net.Close()
+    node2.Net.Close()
+}
+
+// Invalid settings are returned to the caller instead of killing the process
+func TestConfigInvalidConstructors(t *testing.T) {
+    config := DefaultConfig()
+    config.Alpha = 0
+    if _, err := NewKademlia("127.0.0.1", 0, 0, config); err != InvalidAlphaError {
+        t.Error("expected InvalidAlphaError from NewKademlia, got", err)
+    }
+    if _, err := NewNetwork("127.0.0.1", 0, 0, config); err != InvalidAlphaError {
+        t.Error("expected InvalidAlphaError from NewNetwork, got", err)
+    }
+    if _, err := NewKVStore(config); err != InvalidAlphaError {
+        t.Error("expected InvalidAlphaError from NewKVStore, got", err)
+    }
+    if _, err := NewRoutingTable(NewContact(NewKademliaIDRandom(), "127.0.0.1", 0, 0), config); err != InvalidAlphaError {
+        t.Error("expected InvalidAlphaError from NewRoutingTable, got", err)
+    }
+}
@@ -0,0 +1,287 @@
+package kademlia
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "github.com/vmihailenco/msgpack"
+)
+
+// Error states
+var CorruptFileError = errors.New("file does not match its manifest")
+var ManifestTooLargeError = errors.New("manifest does not fit in a block")
+
+// Bytes a link takes in a marshaled manifest, and room left for the rest of it
+const (
+    manifestLinkSize = IDLength + 2
+    manifestOverhead = 64
+)
+
+// Most children listed by one manifest, so that it fits in a block. Files with more blocks get manifests
+// of manifests.
+func maxLinks(blockSize int) int {
+    return (blockSize - manifestOverhead) / manifestLinkSize
+}
+
+// Blocks other than file data start with blockMarker, a byte msgpack never uses, and a byte naming
+// their kind. Data starting with blockMarker is stored as a raw block, so what a block holds follows from
+// its first two bytes alone and no file can pass for a manifest. Other data is stored as it is and keeps
+// the hash of its content as address.
+const blockMarker = 0xc1
+
+// Bytes the marker and the kind take
+const blockHeaderSize = 2
+
+// Kinds of blocks. Directories, metadata and erasure manifests have theirs next to their parsers.
+const (
+    rawBlock      = 0
+    manifestBlock = 1
+)
+
+// The block holding data
+func leafBlock(data []byte) []byte {
+    if len(data) == 0 || data[0] != blockMarker {
+        return data
+    }
+    return append([]byte{blockMarker, rawBlock}, data...)
+}
+
+// The data held by block, false if it is not a raw block
+func leafData(block []byte) ([]byte, bool) {
+    if len(block) == 0 || block[0] != blockMarker {
+        return block, true
+    }
+    if len(block) < blockHeaderSize || block[1] != rawBlock {
+        return nil, false
+    }
+    return block[blockHeaderSize:], true
+}
+
+// A block of the given kind holding v
+func encodeBlock(kind byte, v interface{}) []byte {
+    encoded, err := msgpack.Marshal(v)
+    if err != nil {
+        panic(err)
+    }
+    return append([]byte{blockMarker, kind}, encoded...)
+}
+
+// Decode block into v, false if it is not a block of the given kind
+func decodeBlock(block []byte, kind byte, v interface{}) bool {
+    if len(block) < blockHeaderSize || block[0] != blockMarker || block[1] != kind {
+        return false
+    }
+    return msgpack.Unmarshal(block[blockHeaderSize:], v) == nil
+}
+
+// A block listing the blocks a file is made of, in order. Children are raw blocks or further manifests,
+// so the root hash covers the whole file like the root of a Merkle tree.
+type manifest struct {
+    // Size of the file this manifest describes, for checking the reassembled file
+    Size  int64
+    Links []KademliaID
+}
+
+// The manifest in block, or nil if it is not one
+func parseManifest(block []byte) *manifest {
+    var m manifest
+    if !decodeBlock(block, manifestBlock, &m) {
+        return nil
+    }
+    return &m
+}
+
+// Store one block locally, without publishing it. Returns StoreFullError if there is no room for it.
+func (kademlia *Kademlia) storeBlock(block []byte) (KademliaID, error) {
+    hash := NewKademliaIDFromBytes(block)
+    _, err := kademlia.Net.Store.Insert(*hash, false, block, kademlia.Republish)
+    return *hash, err
+}
+
+// Split data into blocks with split, store them and build the manifests above them. Returns the root hash
+// and every hash stored, root included. Returns StoreFullError, and stores nothing, if the file does not
+// fit: its blocks are not evicted to make room for each other.
+func (kademlia *Kademlia) storeDAG(data []byte, split chunker) (KademliaID, []KademliaID, error) {
+    blockSize := kademlia.Config.BlockSize
+    if leaf := leafBlock(data); len(leaf) <= blockSize {
+        // Small files stay a single block, addressed by the hash of their content
+        hash, err := kademlia.storeBlock(leaf)
+        return hash, []KademliaID{hash}, err
+    }
+    store := kademlia.Net.Store
+    // Leave room for the header of chunks which have to be stored as raw blocks
+    chunks := split(data, blockSize-blockHeaderSize)
+    // Every block is linked from a manifest, which is at most one more link and overhead per block
+    if !store.fits(len(data) + len(chunks)*(manifestLinkSize+manifestOverhead)) {
+        fmt.Printf("%v has no room for %v bytes\n", kademlia.Net.Routing.Me.Address, len(data))
+        return KademliaID{}, nil, StoreFullError
+    }
+    protected := []KademliaID{}
+    defer func() { store.unprotect(protected) }()
+    // Blocks which were not stored before, removed again if the file does not fit after all
+    added := []KademliaID{}
+    put := func(block []byte) (KademliaID, error) {
+        hash := NewKademliaIDFromBytes(block)
+        store.protect(*hash)
+        protected = append(protected, *hash)
+        if !store.contains(*hash) {
+            added = append(added, *hash)
+        }
+        return kademlia.storeBlock(block)
+    }
+    fail := func(err error) (KademliaID, []KademliaID, error) {
+        for _, hash := range added {
+            store.Remove(hash)
+        }
+        return KademliaID{}, nil, err
+    }
+
+    stored := []KademliaID{}
+    type child struct {
+        hash KademliaID
+        size int64
+    }
+    level := []child{}
+    for _, chunk := range chunks {
+        hash, err := put(leafBlock(chunk))
+        if err != nil {
+            return fail(err)
+        }
+        stored = append(stored, hash)
+        level = append(level, child{hash, int64(len(chunk))})
+    }
+    // Group the children into manifests until a single root is left
+    links := maxLinks(blockSize)
+    for len(level) > 1 {
+        parents := []child{}
+        for start := 0; start < len(level); start += links {
+            end := start + links
+            if end > len(level) {
+                end = len(level)
+            }
+            m := manifest{Links: []KademliaID{}}
+            for _, c := range level[start:end] {
+                m.Links = append(m.Links, c.hash)
+                m.Size += c.size
+            }
+            block := encodeBlock(manifestBlock, m)
+            if len(block) > blockSize {
+                return fail(ManifestTooLargeError)
+            }
+            hash, err := put(block)
+            if err != nil {
+                return fail(err)
+            }
+            stored = append(stored, hash)
+            parents = append(parents, child{hash, m.Size})
+        }
+        level = parents
+    }
+    return level[0].hash, stored, nil
+}
+
+// Read a block from the local store
+func (kademlia *Kademlia) readLocal(hash *KademliaID) ([]byte, error) {
+    file, _, err := kademlia.Net.Store.Open(*hash)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    buffer := &bytes.Buffer{}
+    _, err = buffer.ReadFrom(file)
+    return buffer.Bytes(), err
+}
+
+// Read a file stored with Store, following its manifests and metadata, or by its legacy address. The blocks of each manifest are downloaded in
+// parallel from all of their providers. Every block is checked against its hash, and the reassembled
+// parts against the sizes in the manifests.
+func (kademlia *Kademlia) Cat(root *KademliaID) ([]byte, error) {
+    data, _, err := kademlia.CatWithMetadata(root)
+    return data, err
+}
+
+// Cat, together with the metadata of files stored with it, nil for files stored without. The root is
+// only fetched once for both.
+func (kademlia *Kademlia) CatWithMetadata(root *KademliaID) ([]byte, *Metadata, error) {
+    if root.IsLegacy() {
+        data, err := kademlia.catLegacy(root)
+        return data, nil, err
+    }
+    block, owners, err := kademlia.fetchRoot(root)
+    if err != nil {
+        return nil, nil, err
+    }
+    if parseDirectory(block) != nil {
+        return nil, nil, IsADirectoryError
+    }
+    if meta := parseMetadata(block); meta != nil {
+        data, err := kademlia.Cat(&meta.Content)
+        if err == nil && int64(len(data)) != meta.Size {
+            fmt.Printf("%v expected %v bytes for %v, got %v\n", kademlia.Net.Routing.Me.Address, meta.Size, root.String(), len(data))
+            return nil, nil, CorruptFileError
+        }
+        if err != nil {
+            return nil, nil, err
+        }
+        return data, meta, nil
+    }
+    data, err := kademlia.assemble(root, block, owners)
+    return data, nil, err
+}
+
+// The block under hash, read locally or downloaded from its owners, who are returned as well
+func (kademlia *Kademlia) fetchRoot(hash *KademliaID) ([]byte, []Contact, error) {
+    if block, err := kademlia.readLocal(hash); err == nil {
+        return block, []Contact{}, nil
+    }
+    owners := *kademlia.LookupData(hash)
+    blocks, err := kademlia.downloadBlocks([]KademliaID{*hash}, map[KademliaID][]Contact{*hash: owners})
+    if err != nil {
+        return nil, nil, err
+    }
+    return blocks[*hash], owners, nil
+}
+
+// Room to make for a file of size bytes in blocks blocks. Sizes come from manifests other nodes serve, so
+// no more than the blocks can hold of our block size is trusted.
+func (kademlia *Kademlia) preallocSize(size int64, blocks int) int64 {
+    if limit := int64(blocks) * int64(kademlia.Config.BlockSize); size > limit {
+        return limit
+    }
+    return size
+}
+
+// The file below block. Whoever provides a manifest most likely has its children too, so the
+// providers of the manifest are tried for them as well.
+func (kademlia *Kademlia) assemble(hash *KademliaID, block []byte, providers []Contact) ([]byte, error) {
+    if erasure := parseErasureManifest(block); erasure != nil {
+        return kademlia.assembleErasure(hash, erasure)
+    }
+    m := parseManifest(block)
+    if m == nil {
+        if data, ok := leafData(block); ok {
+            return data, nil
+        }
+        return nil, CorruptFileError
+    }
+    if m.Size < 0 {
+        return nil, CorruptFileError
+    }
+    children, err := kademlia.fetchBlocks(m.Links, providers)
+    if err != nil {
+        return nil, err
+    }
+    data := make([]byte, 0, kademlia.preallocSize(m.Size, len(m.Links)))
+    for i := range m.Links {
+        part, err := kademlia.assemble(&m.Links[i], children[i], providers)
+        if err != nil {
+            return nil, err
+        }
+        data = append(data, part...)
+    }
+    if int64(len(data)) != m.Size {
+        fmt.Printf("%v expected %v bytes for %v, got %v\n", kademlia.Net.Routing.Me.Address, m.Size, hash.String(), len(data))
+        return nil, CorruptFileError
+    }
+    return data, nil
+}
@@ -0,0 +1,108 @@
+package kademlia
+
+import (
+    "errors"
+    "sort"
+    "strings"
+)
+
+// Error states
+var NotADirectoryError = errors.New("not a directory")
+var IsADirectoryError = errors.New("is a directory")
+var InvalidNameError = errors.New("invalid or duplicate name in directory")
+var DirectoryTooLargeError = errors.New("directory has too many entries for one block")
+
+// Kind of directory blocks, see blockMarker
+const directoryBlock = 2
+
+// One name in a directory, pointing to a file stored with Store or to another directory
+type DirEntry struct {
+    Name string
+    Hash KademliaID
+    Dir  bool
+    // Size of a file, 0 for directories
+    Size int64
+}
+
+// A block mapping names to files and subdirectories, sorted by name. Since children are referred to
+// by hash, the hash of a directory covers the whole tree below it.
+type directory struct {
+    Entries []DirEntry
+}
+
+// The directory in block, or nil if it is not one
+func parseDirectory(block []byte) *directory {
+    var dir directory
+    if !decodeBlock(block, directoryBlock, &dir) {
+        return nil
+    }
+    return &dir
+}
+
+// Names are single path components
+func validName(name string) bool {
+    return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// Store a directory of entries. Returns the hash of the directory, which ListDirectory and ResolvePath read.
+func (kademlia *Kademlia) StoreDirectory(entries []DirEntry) (KademliaID, error) {
+    sorted := append([]DirEntry{}, entries...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+    for i, entry := range sorted {
+        if !validName(entry.Name) || i > 0 && sorted[i-1].Name == entry.Name {
+            return KademliaID{}, InvalidNameError
+        }
+    }
+    block := encodeBlock(directoryBlock, directory{Entries: sorted})
+    if len(block) > kademlia.Config.BlockSize {
+        return KademliaID{}, DirectoryTooLargeError
+    }
+    hash, err := kademlia.storeBlock(block)
+    if err != nil {
+        return KademliaID{}, err
+    }
+    kademlia.Republish(&hash)
+    return hash, nil
+}
+
+// The entries of the directory stored under hash
+func (kademlia *Kademlia) ListDirectory(hash *KademliaID) ([]DirEntry, error) {
+    block, _, err := kademlia.fetchRoot(hash)
+    if err != nil {
+        return nil, err
+    }
+    dir := parseDirectory(block)
+    if dir == nil {
+        return nil, NotADirectoryError
+    }
+    return dir.Entries, nil
+}
+
+// Follow path, one name per element, from the directory under root. Empty names are skipped, so a path
+// split on "/" may have leading, trailing or double slashes. Returns the entry the path leads to.
+func (kademlia *Kademlia) ResolvePath(root *KademliaID, path []string) (DirEntry, error) {
+    entry := DirEntry{Hash: *root, Dir: true}
+    for _, name := range path {
+        if name == "" {
+            continue
+        }
+        if !entry.Dir {
+            return DirEntry{}, NotADirectoryError
+        }
+        entries, err := kademlia.ListDirectory(&entry.Hash)
+        if err != nil {
+            return DirEntry{}, err
+        }
+        found := false
+        for _, child := range entries {
+            if child.Name == name {
+                entry, found = child, true
+                break
+            }
+        }
+        if !found {
+            return DirEntry{}, NotFoundError
+        }
+    }
+    return entry, nil
+}
@@ -0,0 +1,61 @@
+package kademlia
+
+import (
+    "testing"
+    "time"
+)
+
+func TestDirectories(t *testing.T) {
+    kademlias := createKademliaMesh(3, 3, nil)
+    owner := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+
+    file, _ := owner.Store([]byte("file content"))
+    sub, err := owner.StoreDirectory([]DirEntry{{Name: "file.txt", Hash: file, Size: 12}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    root, err := owner.StoreDirectory([]DirEntry{{Name: "sub", Hash: sub, Dir: true}, {Name: "a.txt", Hash: file, Size: 12}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, bad := range [][]DirEntry{{{Name: "../up", Hash: file}}, {{Name: "x", Hash: file}, {Name: "x", Hash: sub}}, {{Name: "", Hash: file}}} {
+        if _, err := owner.StoreDirectory(bad); err != InvalidNameError {
+            t.Errorf("Expected InvalidNameError for %v, got %v", bad, err)
+        }
+    }
+    time.Sleep(time.Second)
+
+    entries, err := reader.ListDirectory(&root)
+    if err != nil || len(entries) != 2 || entries[0].Name != "a.txt" || !entries[1].Dir {
+        t.Errorf("Unexpected listing %v: %v", entries, err)
+    }
+    entry, err := reader.ResolvePath(&root, []string{"sub", "file.txt"})
+    if err != nil || !entry.Hash.Equals(&file) {
+        t.Errorf("Resolved to %v: %v", entry, err)
+    }
+    if _, err := reader.ResolvePath(&root, []string{"sub", "missing"}); err != NotFoundError {
+        t.Errorf("Expected NotFoundError, got %v", err)
+    }
+    if _, err := reader.ResolvePath(&root, []string{"a.txt", "below"}); err != NotADirectoryError {
+        t.Errorf("Expected NotADirectoryError, got %v", err)
+    }
+    if _, err := reader.Cat(&root); err != IsADirectoryError {
+        t.Errorf("Expected IsADirectoryError, got %v", err)
+    }
+    if _, err := reader.ListDirectory(&file); err != NotADirectoryError {
+        t.Errorf("Expected NotADirectoryError, got %v", err)
+    }
+    // A file with the bytes of a directory is still a file
+    lookalike := encodeBlock(directoryBlock, directory{Entries: []DirEntry{{Name: "a.txt", Hash: file, Size: 12}}})
+    stored, _ := owner.Store(lookalike)
+    if read, err := owner.Cat(&stored); err != nil || string(read) != string(lookalike) {
+        t.Errorf("Cat of a directory lookalike returned %q: %v", read, err)
+    }
+    if _, err := owner.ListDirectory(&stored); err != NotADirectoryError {
+        t.Errorf("Expected NotADirectoryError for a directory lookalike, got %v", err)
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
@@ -0,0 +1,247 @@
+package kademlia
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "time"
+    "github.com/vmihailenco/msgpack"
+    "rpc"
+)
+
+// Error states
+var ErasureManifestTooLargeError = errors.New("file has too many stripes for one manifest")
+var PushRefusedError = errors.New("node did not take the pushed block")
+
+// Kind of erasure manifest blocks, see blockMarker
+const erasureBlock = 4
+
+// One stripe of an erasure coded file: the hashes of its data shards followed by those of its parity shards
+type erasureStripe struct {
+    // Bytes of the file in this stripe, the last data shard is padded with zeros
+    Size   int64
+    Shards []KademliaID
+}
+
+// Layout of an erasure coded file. Each stripe holds up to DataShards blocks of the file.
+type erasureManifest struct {
+    Size         int64
+    DataShards   int
+    ParityShards int
+    Stripes      []erasureStripe
+}
+
+// The erasure manifest in block, or nil if it is not one
+func parseErasureManifest(block []byte) *erasureManifest {
+    var m erasureManifest
+    if !decodeBlock(block, erasureBlock, &m) {
+        return nil
+    }
+    return &m
+}
+
+// Someone asks us to keep a block, one shard of an erasure coded file. The block is stored under its
+// own hash, so there is nothing to check it against.
+func (network *Network) receivePushDataMessage(connection net.Conn, message *NetworkMessage) {
+    if len(message.Data) > network.config.BlockSize {
+        log.Printf("%v refuses block of %v bytes from %v\n", network.Routing.Me.Address, len(message.Data), message.Origin.Address)
+        return
+    }
+    hash := NewKademliaIDFromBytes(message.Data)
+    if _, err := network.Store.Insert(*hash, false, message.Data, func(id *KademliaID) {
+        network.Store.announce([]KademliaID{*id})
+    }); err != nil {
+        // No answer makes the sender try the next node
+        log.Printf("%v refuses block %v from %v: %v\n", network.Routing.Me.Address, hash.String(), message.Origin.Address, err)
+        return
+    }
+    fmt.Printf("%v keeps block %v pushed by %v\n", network.Routing.Me.Address, hash.String(), message.Origin.Address)
+    // We provide the block from now on
+    go network.Store.announce([]KademliaID{*hash})
+
+    response := NetworkMessage{MsgType: rpc.PUSH_DATA_MSG, Origin: network.Routing.Me, RpcID: message.RpcID, Data: hash[:]}
+    marshaledResponse, err := msgpack.Marshal(response)
+    if err != nil {
+        log.Printf("%v failed to marshal push answer: %v\n", network.Routing.Me.Address, err)
+        return
+    }
+    connection.SetWriteDeadline(time.Now().Add(network.config.ConnectionTimeout))
+    if err := writeFrame(connection, marshaledResponse); err != nil {
+        log.Printf("%v failed to answer push from %v: %v\n", network.Routing.Me.Address, message.Origin.Address, err)
+    }
+}
+
+// Ask another node to keep a block. Returns once the receiver has stored it.
+func (network *Network) SendPushDataMessage(block []byte, receiver *Contact) error {
+    hash := NewKademliaIDFromBytes(block)
+    message := NetworkMessage{MsgType: rpc.PUSH_DATA_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: block}
+    // Blocks until response
+    response := network.SendReceiveMessage(TCP, &message, receiver)
+    if response == nil || response.MsgType != rpc.PUSH_DATA_MSG || !bytes.Equal(response.Data, hash[:]) {
+        return PushRefusedError
+    }
+    return nil
+}
+
+// Push a block to the node closest to its hash which is not in exclude and takes it. If none does, the
+// block is kept and published locally instead. Returns the hash of the block and the node which took it,
+// nil if it was kept locally, or StoreFullError if nobody had room for it.
+func (kademlia *Kademlia) pushBlock(block []byte, exclude []Contact) (KademliaID, *Contact, error) {
+    hash := NewKademliaIDFromBytes(block)
+    for _, contact := range kademlia.LookupContact(hash) {
+        if contact.ID.Equals(kademlia.Net.Routing.Me.ID) || containsContact(exclude, contact.ID) {
+            continue
+        }
+        if err := kademlia.Net.SendPushDataMessage(block, &contact); err != nil {
+            log.Printf("%v could not push %v to %v: %v\n", kademlia.Net.Routing.Me.Address, hash.String(), contact.Address, err)
+            continue
+        }
+        holder := contact
+        return *hash, &holder, nil
+    }
+    log.Printf("%v found no node to take %v, keeping it\n", kademlia.Net.Routing.Me.Address, hash.String())
+    if _, err := kademlia.storeBlock(block); err != nil {
+        return KademliaID{}, nil, err
+    }
+    kademlia.Republish(hash)
+    return *hash, nil, nil
+}
+
+// Store a file erasure coded instead of as plain blocks. Every stripe of DataShards blocks gets
+// ParityShards parity blocks, and each block of a stripe is pushed to a different node close to its
+// hash, so the file survives the loss of any ParityShards nodes per stripe. The manifest is kept
+// locally and pushed to ParityShards+1 more nodes. Returns the hash of the manifest, which Cat reads.
+func (kademlia *Kademlia) StoreErasure(data []byte) (KademliaID, error) {
+    dataShards, parityShards := kademlia.Config.DataShards, kademlia.Config.ParityShards
+    rs, err := newReedSolomon(dataShards, parityShards)
+    if err != nil {
+        return KademliaID{}, err
+    }
+    blockSize := kademlia.Config.BlockSize
+    m := erasureManifest{Size: int64(len(data)), DataShards: dataShards, ParityShards: parityShards,
+        Stripes: []erasureStripe{}}
+    for offset := 0; offset < len(data); offset += dataShards * blockSize {
+        end := offset + dataShards*blockSize
+        if end > len(data) {
+            end = len(data)
+        }
+        stripe := data[offset:end]
+        // Short stripes get smaller shards rather than a lot of padding
+        shardSize := (len(stripe) + dataShards - 1) / dataShards
+        shards := make([][]byte, dataShards)
+        for i := range shards {
+            shards[i] = make([]byte, shardSize)
+            if start := i * shardSize; start < len(stripe) {
+                copy(shards[i], stripe[start:])
+            }
+        }
+        shards = append(shards, rs.encode(shards)...)
+        hashes := []KademliaID{}
+        holders := []Contact{}
+        for _, shard := range shards {
+            hash, holder, err := kademlia.pushBlock(shard, holders)
+            if err != nil {
+                return KademliaID{}, err
+            }
+            if holder != nil {
+                holders = append(holders, *holder)
+            }
+            hashes = append(hashes, hash)
+        }
+        m.Stripes = append(m.Stripes, erasureStripe{Size: int64(len(stripe)), Shards: hashes})
+    }
+
+    block := encodeBlock(erasureBlock, m)
+    if len(block) > blockSize {
+        return KademliaID{}, ErasureManifestTooLargeError
+    }
+    root, err := kademlia.storeBlock(block)
+    if err != nil {
+        return KademliaID{}, err
+    }
+    kademlia.Republish(&root)
+    holders := []Contact{}
+    for i := 0; i <= parityShards; i++ {
+        _, holder, _ := kademlia.pushBlock(block, holders)
+        if holder == nil {
+            break
+        }
+        holders = append(holders, *holder)
+    }
+    kademlia.publishLegacyAddress(data, &root)
+    fmt.Printf("%v stored %v in %v stripes of %v+%v shards\n", kademlia.Net.Routing.Me.Address, root.String(), len(m.Stripes), dataShards, parityShards)
+    return root, nil
+}
+
+// Rebuild an erasure coded file. The data shards are fetched first, parity shards only for the
+// stripes which miss some of them.
+func (kademlia *Kademlia) assembleErasure(hash *KademliaID, m *erasureManifest) ([]byte, error) {
+    rs, err := newReedSolomon(m.DataShards, m.ParityShards)
+    if err != nil || m.Size < 0 {
+        return nil, CorruptFileError
+    }
+    shards := make([][][]byte, len(m.Stripes))
+    wanted := []KademliaID{}
+    for i, stripe := range m.Stripes {
+        if len(stripe.Shards) != m.DataShards+m.ParityShards {
+            return nil, CorruptFileError
+        }
+        shards[i] = make([][]byte, len(stripe.Shards))
+        wanted = append(wanted, stripe.Shards[:m.DataShards]...)
+    }
+    found := kademlia.collectBlocks(wanted, nil)
+    wanted = []KademliaID{}
+    for i, stripe := range m.Stripes {
+        complete := true
+        for j := 0; j < m.DataShards; j++ {
+            if block, ok := found[stripe.Shards[j]]; ok {
+                shards[i][j] = block
+            } else {
+                complete = false
+            }
+        }
+        if !complete {
+            wanted = append(wanted, stripe.Shards[m.DataShards:]...)
+        }
+    }
+    if len(wanted) > 0 {
+        fmt.Printf("%v rebuilds %v from parity shards\n", kademlia.Net.Routing.Me.Address, hash.String())
+        found = kademlia.collectBlocks(wanted, nil)
+        for i, stripe := range m.Stripes {
+            for j := m.DataShards; j < len(stripe.Shards); j++ {
+                if block, ok := found[stripe.Shards[j]]; ok {
+                    shards[i][j] = block
+                }
+            }
+        }
+    }
+
+    data := make([]byte, 0, kademlia.preallocSize(m.Size, len(m.Stripes)*m.DataShards))
+    for i, stripe := range m.Stripes {
+        // The code only works on shards of one size
+        shardSize := -1
+        for _, shard := range shards[i] {
+            if shard != nil && shardSize >= 0 && len(shard) != shardSize {
+                return nil, CorruptFileError
+            } else if shard != nil {
+                shardSize = len(shard)
+            }
+        }
+        if err := rs.reconstruct(shards[i]); err != nil {
+            log.Printf("%v cannot rebuild stripe %v of %v: %v\n", kademlia.Net.Routing.Me.Address, i, hash.String(), err)
+            return nil, err
+        }
+        part := bytes.Join(shards[i][:m.DataShards], nil)
+        if stripe.Size < 0 || int64(len(part)) < stripe.Size {
+            return nil, CorruptFileError
+        }
+        data = append(data, part[:stripe.Size]...)
+    }
+    if int64(len(data)) != m.Size {
+        fmt.Printf("%v expected %v bytes for %v, got %v\n", kademlia.Net.Routing.Me.Address, m.Size, hash.String(), len(data))
+        return nil, CorruptFileError
+    }
+    return data, nil
+}
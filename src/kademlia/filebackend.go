@@ -0,0 +1,202 @@
+package kademlia
+
+import (
+    "bytes"
+    "encoding/hex"
+    "errors"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "github.com/vmihailenco/msgpack"
+)
+
+// Error states
+var CorruptEntryError = errors.New("store entry does not match its bytes")
+
+// Suffix of files being written, which are renamed into place once complete
+const tempSuffix = ".tmp"
+
+// Suffix of the file holding the bytes of an entry
+const blobSuffix = ".blob"
+
+// Keeps the entries of a KVStore in a directory. Every entry has a msgpack file named by its hex encoded key,
+// and a file with the same name and blobSuffix for its bytes, so that updates do not rewrite the bytes.
+type fileBackend struct {
+    dir string
+}
+
+// A backend in dir, which is created if need be. Returns an error if entries cannot be written there.
+func newFileBackend(dir string) (*fileBackend, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    probe, err := ioutil.TempFile(dir, "probe")
+    if err != nil {
+        return nil, err
+    }
+    probe.Close()
+    os.Remove(probe.Name())
+    return &fileBackend{dir: dir}, nil
+}
+
+func (backend *fileBackend) path(key KademliaID) string {
+    return filepath.Join(backend.dir, hex.EncodeToString(key[:]))
+}
+
+func (backend *fileBackend) Get(key KademliaID) (*Entry, error) {
+    path := backend.path(key)
+    entry, err := readEntry(path)
+    if err == nil && entry.Size > 0 {
+        entry.Data, err = ioutil.ReadFile(path + blobSuffix)
+    }
+    if os.IsNotExist(err) {
+        return nil, NotFoundError
+    }
+    if err == nil && len(entry.Data) != entry.Size {
+        return nil, CorruptEntryError
+    }
+    return entry, err
+}
+
+// Entries without bytes have no file for them
+func (backend *fileBackend) Open(key KademliaID) (io.ReadSeekCloser, error) {
+    path := backend.path(key)
+    file, err := os.Open(path + blobSuffix)
+    if os.IsNotExist(err) {
+        if entry, err := readEntry(path); err == nil && entry.Size == 0 {
+            return memoryFile{bytes.NewReader(nil)}, nil
+        }
+        return nil, NotFoundError
+    }
+    if err != nil {
+        return nil, err
+    }
+    return file, nil
+}
+
+// Write the bytes of an entry and then the rest of it, each replacing the older version only once complete
+func (backend *fileBackend) Put(entry *Entry) error {
+    path := backend.path(entry.Key)
+    if len(entry.Data) > 0 {
+        if err := writeFile(path+blobSuffix, entry.Data); err != nil {
+            return err
+        }
+    } else if err := os.Remove(path + blobSuffix); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return backend.Update(entry)
+}
+
+func (backend *fileBackend) Update(entry *Entry) error {
+    meta := *entry
+    meta.Data = nil
+    encoded, err := msgpack.Marshal(&meta)
+    if err != nil {
+        return err
+    }
+    return writeFile(backend.path(entry.Key), encoded)
+}
+
+// The entry goes first, so that a blob is never taken for the bytes of an entry it does not belong to
+func (backend *fileBackend) Delete(key KademliaID) error {
+    path := backend.path(key)
+    for _, name := range []string{path, path + blobSuffix} {
+        if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    return nil
+}
+
+// Whether name is that of an entry, a hex encoded key
+func isEntryName(name string) bool {
+    key, err := hex.DecodeString(name)
+    return err == nil && len(key) == IDLength && hex.EncodeToString(key) == name
+}
+
+// Entries are passed without their bytes, Get reads them. Unreadable entries, entries without their bytes,
+// bytes without their entry and files left half written are skipped and removed. Other files are left alone,
+// the directory may be shared.
+func (backend *fileBackend) Iterate(f func(*Entry) bool) error {
+    files, err := ioutil.ReadDir(backend.dir)
+    if err != nil {
+        return err
+    }
+    blobs := map[string]int64{}
+    entries := []string{}
+    for _, info := range files {
+        name := info.Name()
+        path := filepath.Join(backend.dir, name)
+        base := strings.TrimSuffix(strings.TrimSuffix(name, tempSuffix), blobSuffix)
+        if info.IsDir() || !isEntryName(base) {
+            log.Printf("skipping %v, not a store entry\n", path)
+        } else if strings.HasSuffix(name, tempSuffix) {
+            os.Remove(path)
+        } else if strings.HasSuffix(name, blobSuffix) {
+            blobs[base] = info.Size()
+        } else {
+            entries = append(entries, name)
+        }
+    }
+    for _, name := range entries {
+        path := filepath.Join(backend.dir, name)
+        entry, err := readEntry(path)
+        if err == nil && hex.EncodeToString(entry.Key[:]) != name {
+            err = CorruptEntryError
+        }
+        if size, ok := blobs[name]; err == nil && entry.Size > 0 && (!ok || size != int64(entry.Size)) {
+            err = CorruptEntryError
+        }
+        delete(blobs, name)
+        if err != nil {
+            log.Printf("skipping unreadable store entry %v: %v\n", path, err)
+            os.Remove(path)
+            os.Remove(path + blobSuffix)
+            continue
+        }
+        if !f(entry) {
+            return nil
+        }
+    }
+    for name := range blobs {
+        path := filepath.Join(backend.dir, name+blobSuffix)
+        log.Printf("removing %v, its entry is gone\n", path)
+        os.Remove(path)
+    }
+    return nil
+}
+
+func readEntry(path string) (*Entry, error) {
+    encoded, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var entry Entry
+    if err := msgpack.Unmarshal(encoded, &entry); err != nil {
+        return nil, err
+    }
+    return &entry, nil
+}
+
+// Write data to path through a temporary file, so that path holds either its old or its new content
+func writeFile(path string, data []byte) error {
+    file, err := os.Create(path + tempSuffix)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(data); err != nil {
+        file.Close()
+        return err
+    }
+    if err := file.Sync(); err != nil {
+        file.Close()
+        return err
+    }
+    if err := file.Close(); err != nil {
+        return err
+    }
+    return os.Rename(path+tempSuffix, path)
+}
@@ -0,0 +1,143 @@
+package kademlia
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "hash"
+    "io"
+    "net"
+    "time"
+)
+
+// Error states
+var FrameTooLargeError = errors.New("frame is larger than the receive buffer")
+var ChecksumError = errors.New("content checksum failure")
+var MalformedTransferError = errors.New("malformed transfer header")
+var TransferTooLargeError = errors.New("transfer is larger than a block")
+
+// Read and write chunk size for streamed transfers
+const transferChunkSize = 32 << 10
+
+// TCP messages are framed as a 4 byte big endian length followed by that many bytes, so a message no longer
+// has to arrive in a single read
+func writeFrame(w io.Writer, payload []byte) error {
+    header := make([]byte, 4)
+    binary.BigEndian.PutUint32(header, uint32(len(payload)))
+    if _, err := w.Write(header); err != nil {
+        return err
+    }
+    _, err := w.Write(payload)
+    return err
+}
+
+// Read one frame, refusing frames larger than max bytes
+func readFrame(r io.Reader, max int) ([]byte, error) {
+    header := make([]byte, 4)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return nil, err
+    }
+    length := binary.BigEndian.Uint32(header)
+    if uint64(length) > uint64(max) {
+        return nil, FrameTooLargeError
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        return nil, err
+    }
+    return payload, nil
+}
+
+// Payload of a TRANSFER_DATA_MSG request: which bytes of which file. A Length of 0 means up to the end.
+// Codecs are the compression codecs the requester accepts, see compression.go.
+type transferRequest struct {
+    Hash   KademliaID
+    Offset int64
+    Length int64
+    Codecs []string
+}
+
+// Payload of the TRANSFER_DATA_MSG header frame. Size is the size of the whole file, the requested range
+// follows the header as Length bytes, compressed with Codec unless it is empty. Sizes, offsets and the
+// hash always refer to the uncompressed bytes.
+type transferHeader struct {
+    Size   int64
+    Offset int64
+    Length int64
+    Codec  string
+}
+
+// Copy size bytes from src to dst, which writes to connection, giving the peer timeout to accept each chunk
+func streamTo(connection net.Conn, dst io.Writer, src io.Reader, size int64, timeout time.Duration) error {
+    buffer := make([]byte, transferChunkSize)
+    for size > 0 {
+        chunk := buffer
+        if int64(len(chunk)) > size {
+            chunk = chunk[:size]
+        }
+        n, err := src.Read(chunk)
+        if n > 0 {
+            connection.SetWriteDeadline(time.Now().Add(timeout))
+            if _, err := dst.Write(buffer[:n]); err != nil {
+                return err
+            }
+            size -= int64(n)
+        }
+        if err == io.EOF && size > 0 {
+            return io.ErrUnexpectedEOF
+        } else if err != nil && err != io.EOF {
+            return err
+        }
+    }
+    return nil
+}
+
+// A file, or range of one, being downloaded. Reads come straight from the connection, each one may take
+// up to the timeout. Whole files are checked against their hash once they have been read completely.
+type downloadReader struct {
+    connection net.Conn
+    // The connection, or a decompressor reading from it
+    source    io.Reader
+    remaining int64
+    // Nil for ranges, which cannot be checked on their own
+    expected *KademliaID
+    sum      hash.Hash
+    timeout  time.Duration
+}
+
+func newDownloadReader(connection net.Conn, codec string, length int64, expected *KademliaID, timeout time.Duration) (*downloadReader, error) {
+    source, err := decompressReader(connection, codec)
+    if err != nil {
+        return nil, err
+    }
+    // Ranges are not checked. Legacy IDs never match a SHA-256 sum, their content is only read by catLegacy.
+    return &downloadReader{connection: connection, source: source, remaining: length, expected: expected, sum: sha256.New(), timeout: timeout}, nil
+}
+
+func (reader *downloadReader) Read(p []byte) (int, error) {
+    if reader.remaining <= 0 {
+        var sum KademliaID
+        copy(sum[:], reader.sum.Sum(nil))
+        if reader.expected != nil && !sum.Equals(reader.expected) {
+            return 0, ChecksumError
+        }
+        return 0, io.EOF
+    }
+    if int64(len(p)) > reader.remaining {
+        p = p[:reader.remaining]
+    }
+    reader.connection.SetReadDeadline(time.Now().Add(reader.timeout))
+    n, err := reader.source.Read(p)
+    reader.sum.Write(p[:n])
+    reader.remaining -= int64(n)
+    if err == io.EOF && reader.remaining > 0 {
+        return n, io.ErrUnexpectedEOF
+    } else if err == io.EOF {
+        err = nil
+    }
+    return n, err
+}
+
+func (reader *downloadReader) Close() error {
+    return reader.connection.Close()
+}
@@ -1,30 +1,140 @@
 package kademlia
 
 import (
+    "bytes"
+    "context"
+    "crypto/ed25519"
+    "crypto/rand"
+    "errors"
     "fmt"
+    "io"
+    "log"
     "reflect"
     "sync"
-    "github.com/vmihailenco/msgpack"
+    "time"
 )
 
-var Alpha = 3
-var ReplicationFactor = 20
+// Error states
+var AlreadyStartedError = errors.New("node was already started")
+var StoppedError = errors.New("node was stopped")
 
 type Kademlia struct {
-    Net *Network
+    Net    *Network
+    Config *Config
+    // Signs the records this node publishes
+    signingKey ed25519.PrivateKey
+    // Set while bootstrapping is retried in the background
+    bootRetrying bool
+    // Lifecycle, see Start and Stop
+    started bool
+    stopped bool
+    stop    chan bool
+    running *sync.WaitGroup
+    mutex   *sync.Mutex
 }
 
-func NewKademlia(ip string, tcpPort int, udpPort int) *Kademlia {
+// Create a node. It does not touch the network until Start is called. Returns the error of
+// Config.Validate for invalid settings.
+func NewKademlia(ip string, tcpPort int, udpPort int, config *Config) (*Kademlia, error) {
+    config, err := checkConfig(config)
+    if err != nil {
+        return nil, err
+    }
     kademlia := new(Kademlia)
-    kademlia.Net = NewNetwork(ip, tcpPort, udpPort)
-    return kademlia
+    kademlia.Config = config
+    if kademlia.Net, err = NewNetwork(ip, tcpPort, udpPort, config); err != nil {
+        return nil, err
+    }
+    kademlia.Net.Store.SetRepublishMany(kademlia.RepublishMany)
+    kademlia.Net.Store.SetRestoredRepublish(kademlia.republishRestored)
+    kademlia.signingKey = kademlia.Config.SigningKey
+    if kademlia.signingKey == nil {
+        _, kademlia.signingKey, _ = ed25519.GenerateKey(rand.Reader)
+    }
+    kademlia.stop = make(chan bool)
+    kademlia.running = &sync.WaitGroup{}
+    kademlia.mutex = &sync.Mutex{}
+    return kademlia, nil
+}
+
+// Bind the TCP and UDP ports and start answering other nodes. Ports given as 0 are picked by the system,
+// Net.Routing.Me holds the ports actually bound once Start returns.
+func (kademlia *Kademlia) Start(ctx context.Context) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    kademlia.mutex.Lock()
+    defer kademlia.mutex.Unlock()
+    if kademlia.stopped {
+        return StoppedError
+    }
+    if kademlia.started {
+        return AlreadyStartedError
+    }
+    if err := kademlia.Net.Listen(); err != nil {
+        return err
+    }
+    kademlia.started = true
+    return nil
+}
+
+// Stop every background goroutine of the node: listeners, open connections, background bootstrapping and
+// the eviction and republish threads. Returns the context error if they did not finish in time.
+// A stopped node cannot be started again.
+func (kademlia *Kademlia) Stop(ctx context.Context) error {
+    kademlia.mutex.Lock()
+    if kademlia.stopped {
+        kademlia.mutex.Unlock()
+        return nil
+    }
+    kademlia.stopped = true
+    close(kademlia.stop)
+    kademlia.mutex.Unlock()
+
+    done := make(chan bool)
+    go func() {
+        kademlia.running.Wait()
+        kademlia.Net.Close()
+        kademlia.Net.Store.Close()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// Run f in a goroutine which Stop waits for. Nothing is run once the node is stopped.
+func (kademlia *Kademlia) background(f func()) {
+    kademlia.mutex.Lock()
+    defer kademlia.mutex.Unlock()
+    if kademlia.stopped {
+        return
+    }
+    kademlia.running.Add(1)
+    go func() {
+        defer kademlia.running.Done()
+        f()
+    }()
+}
+
+// Sleep for a while, returns false if the node was stopped in the meantime
+func (kademlia *Kademlia) sleep(duration time.Duration) bool {
+    select {
+    case <-time.After(duration):
+        return true
+    case <-kademlia.stop:
+        return false
+    }
 }
 
 // Lookup the k participants which have a kademlia ID closest to another ID
 func (kademlia *Kademlia) LookupContact(target *KademliaID) ([]Contact) {
     me := kademlia.Net.Routing.Me
     // The lookup initiator starts by picking \alpha nodes from its closest non-empty k-bucket...
-    closestContacts := kademlia.Net.Routing.FindClosestContacts(target, Alpha)
+    closestContacts := kademlia.Net.Routing.FindClosestContacts(target, kademlia.Config.Alpha)
     // This holds the nodes we have already queried
     contactsVisited := make(map[KademliaID]Contact)
     contactsVisited[*me.ID] = me
@@ -73,7 +183,7 @@ func (kademlia *Kademlia) LookupContact(target *KademliaID) ([]Contact) {
             contactsToVisit := []Contact{}
             // Check if we have already visited these contacts. If not, queue them for future visits.
             // Simpler version than the rules in the paper
-            for i := 0; i < min(ReplicationFactor, len(receivedContacts)); i++ {
+            for i := 0; i < min(kademlia.Config.ReplicationFactor, len(receivedContacts)); i++ {
                 newContact := receivedContacts[i]
                 mutex.Lock()
                 if _, ok := contactsVisited[*newContact.ID]; !ok {
@@ -126,21 +236,17 @@ func (kademlia *Kademlia) LookupContact(target *KademliaID) ([]Contact) {
         contactCandidates.contacts = append(contactCandidates.contacts, candidate)
     }
     contactCandidates.Sort()
-    return contactCandidates.contacts[0:min(ReplicationFactor, len(candidates))]
+    return contactCandidates.contacts[0:min(kademlia.Config.ReplicationFactor, len(candidates))]
 }
 
 // Find the owner of a file with specific hash.
 func (kademlia *Kademlia) LookupData(hash *KademliaID) *[]Contact {
-    // Check if we have the data locally
-    value, err := kademlia.Net.Store.Lookup(*hash)
-    if err != NotFoundError {
-        var owners []Contact
-        err = msgpack.Unmarshal(value, &owners)
-        if err == nil {
-            return &owners
-        } else {
-            return &[]Contact{kademlia.Net.Routing.Me}
-        }
+    // Check if we have the data, or know who has it, locally
+    owners, err := kademlia.Net.Store.Providers(*hash)
+    if err == IsDataError {
+        return &[]Contact{kademlia.Net.Routing.Me}
+    } else if err == nil {
+        return &owners
     }
     // First find the contacts of the nodes with closest ID to hash
     closestContacts := kademlia.LookupContact(hash)
@@ -161,6 +267,8 @@ func (kademlia *Kademlia) LookupData(hash *KademliaID) *[]Contact {
         }(hash, &closestContacts[i], rpcChannels[i])
     }
     ownerMap := make(map[KademliaID]Contact)
+    // Which of the queried contacts did not have the value
+    missed := make([]bool, len(closestContacts))
 
     for range closestContacts {
         // Block until we get one or more responses from RPCs
@@ -171,8 +279,9 @@ func (kademlia *Kademlia) LookupData(hash *KademliaID) *[]Contact {
                 Chan: reflect.ValueOf(ch),
             })
         }
-        _, valValue, _ := reflect.Select(set)
+        chosen, valValue, _ := reflect.Select(set)
         newContacts := valValue.Interface().([]Contact)
+        missed[chosen] = len(newContacts) == 0
         if newContacts != nil && len(newContacts) > 0 {
             // Return all of the owners if there are many?
             for _, newContact := range newContacts {
@@ -182,26 +291,142 @@ func (kademlia *Kademlia) LookupData(hash *KademliaID) *[]Contact {
             }
         }
     }
-    owners := []Contact{}
+    owners = []Contact{}
     for _, value := range ownerMap {
         owners = append(owners, value)
     }
+    if len(owners) > 0 {
+        // Cache the owners at the closest node on the path which did not have them, so that popular hashes
+        // spread out instead of overloading the few nodes closest to the key. Contacts are sorted by distance.
+        for i := range closestContacts {
+            if missed[i] {
+                kademlia.Net.SendCacheMessage(hash, owners, &closestContacts[i])
+                break
+            }
+        }
+    }
     return &owners
 }
 
-// Store the data locally, then have other nodes Store the contact of ones holding the data
-func (kademlia *Kademlia) Store(data []byte) KademliaID {
-    hash := NewKademliaIDFromBytes(data)
-    kademlia.Net.Store.Insert(*hash, false, data, kademlia.Republish)
-    kademlia.Republish(hash)
-    return *hash
+// Store the data locally, then have other nodes Store the contact of ones holding the data. Files larger
+// than a block are split into blocks under a manifest, the returned root hash is what Cat reads.
+// Returns StoreFullError if the local store has no room for the file.
+func (kademlia *Kademlia) Store(data []byte) (KademliaID, error) {
+    return kademlia.storeWith(data, fixedChunks)
+}
+
+// Store the data like Store, but cut into blocks by content rather than at fixed offsets. Files which
+// share most of their content, like successive snapshots, share most of their blocks, which are then
+// only stored and transferred once.
+func (kademlia *Kademlia) StoreCDC(data []byte) (KademliaID, error) {
+    return kademlia.storeWith(data, cdcChunks)
 }
 
-// Download data from another kademlia participant
+func (kademlia *Kademlia) storeWith(data []byte, split chunker) (KademliaID, error) {
+    root, hashes, err := kademlia.storeDAG(data, split)
+    if err != nil {
+        return KademliaID{}, err
+    }
+    if len(hashes) == 1 {
+        kademlia.Republish(&root)
+    } else {
+        kademlia.RepublishMany(hashes)
+    }
+    kademlia.publishLegacyAddress(data, &root)
+    return root, nil
+}
+
+// Download data from another kademlia participant. An interrupted transfer is resumed where it stopped,
+// from the same node while it makes progress, otherwise from the other owners found by LookupData.
+// Data which does not match the hash is thrown away, the nodes which sent it are penalised and the
+// download starts over from the next owner. Legacy SHA-1 IDs are refused, see catLegacy.
 func (kademlia *Kademlia) Download(hash *KademliaID, from *Contact) []byte {
-    data := kademlia.Net.SendDownloadMessage(hash, from)
-    kademlia.Store(data)
-    return data
+    if hash.IsLegacy() {
+        log.Printf("%v refuses to download legacy address %v\n", kademlia.Net.Routing.Me.Address, hash.String())
+        return []byte{}
+    }
+    data := &bytes.Buffer{}
+    size := int64(-1)
+    providers := []Contact{*from}
+    // Nodes which sent part of data
+    contributors := []Contact{}
+    lookedUp := false
+    for attempt := 0; attempt < kademlia.Config.DownloadAttempts; attempt++ {
+        for len(providers) > 0 && kademlia.Net.scores.isBanned(providers[0].ID) {
+            log.Printf("%v skips banned provider %v\n", kademlia.Net.Routing.Me.Address, providers[0].Address)
+            providers = providers[1:]
+        }
+        if len(providers) == 0 {
+            if lookedUp {
+                break
+            }
+            lookedUp = true
+            for _, owner := range *kademlia.LookupData(hash) {
+                if !owner.ID.Equals(kademlia.Net.Routing.Me.ID) && !kademlia.Net.scores.isBanned(owner.ID) {
+                    providers = append(providers, owner)
+                }
+            }
+            continue
+        }
+        provider := providers[0]
+        offset := int64(data.Len())
+        file, total, err := kademlia.Net.SendDownloadRangeMessage(hash, &provider, offset, 0)
+        if err == nil && total > int64(kademlia.Config.BlockSize) {
+            // Only blocks are downloaded, anything larger is not kept in memory
+            err = TransferTooLargeError
+        }
+        if err != nil || (size >= 0 && total != size) {
+            // Unreachable, or a different file than the one we started on
+            log.Printf("%v cannot resume %v from %v: %v\n", kademlia.Net.Routing.Me.Address, hash.String(), provider.Address, err)
+            if file != nil {
+                file.Close()
+            }
+            providers = providers[1:]
+            continue
+        }
+        size = total
+        n, err := io.Copy(data, io.LimitReader(file, size-offset))
+        file.Close()
+        if n > 0 {
+            contributors = mergeContacts(contributors, []Contact{provider})
+        }
+        if err != nil {
+            log.Printf("%v download of %v interrupted after %v bytes: %v\n", kademlia.Net.Routing.Me.Address, hash.String(), offset+n, err)
+            if n == 0 {
+                providers = providers[1:]
+            }
+            continue
+        }
+        if int64(data.Len()) != size {
+            continue
+        }
+        if hash.Matches(data.Bytes()) {
+            break
+        }
+        log.Printf("%v received corrupt data for %v\n", kademlia.Net.Routing.Me.Address, hash.String())
+        for i := range contributors {
+            kademlia.Net.scores.reportCorrupt(&contributors[i])
+            providers = removeContact(providers, contributors[i].ID)
+        }
+        data.Reset()
+        size = -1
+        contributors = []Contact{}
+    }
+    if int64(data.Len()) != size || !hash.Matches(data.Bytes()) {
+        log.Println("Failed to download", hash.String())
+        return []byte{}
+    }
+    fmt.Println("Checksum passed.")
+    for i := range contributors {
+        kademlia.Net.scores.reportGood(&contributors[i])
+    }
+    // Downloaded blocks are kept as they are, and we become one of their owners if there is room
+    if _, err := kademlia.storeBlock(data.Bytes()); err != nil {
+        log.Printf("%v cannot keep %v: %v\n", kademlia.Net.Routing.Me.Address, hash.String(), err)
+    } else {
+        kademlia.Republish(hash)
+    }
+    return data.Bytes()
 }
 
 // Tell relevant nodes in network that you have a file available
@@ -212,3 +437,120 @@ func (kademlia *Kademlia) Republish(hash *KademliaID) {
         kademlia.Net.SendStoreMessage(hash, &contact)
     }
 }
+
+// Stop providing a file: remove it locally, then tell the nodes holding its provider records to forget us.
+// The retraction is sent even if the file was not stored here, returns NotFoundError in that case.
+func (kademlia *Kademlia) Unpublish(hash *KademliaID) error {
+    err := kademlia.Net.Store.Remove(*hash)
+    fmt.Printf("%v unpublishes %v\n", kademlia.Net.Routing.Me.Address, hash.String())
+    contacts := kademlia.LookupContact(hash)
+    for _, contact := range contacts {
+        kademlia.Net.SendUnpublishMessage(hash, &contact)
+    }
+    return err
+}
+
+// The name this node publishes its record under
+func (kademlia *Kademlia) RecordKey() *KademliaID {
+    return RecordKey(kademlia.signingKey.Public().(ed25519.PublicKey))
+}
+
+// Publish value as the next version of this node's record, on this node and the k closest nodes to its key
+func (kademlia *Kademlia) PutRecord(value []byte) (*Record, error) {
+    sequence := uint64(1)
+    if current, err := kademlia.GetRecord(kademlia.RecordKey()); err == nil {
+        sequence = current.Sequence + 1
+    }
+    record := NewRecord(kademlia.signingKey, sequence, value)
+    if err := kademlia.Net.Store.PutRecord(record, kademlia.RepublishRecord); err != nil {
+        return nil, err
+    }
+    kademlia.RepublishRecord(record.Key())
+    return record, nil
+}
+
+// Send the record we hold under key to the k closest nodes again
+func (kademlia *Kademlia) RepublishRecord(key *KademliaID) {
+    record, err := kademlia.Net.Store.GetRecord(*key)
+    if err != nil {
+        return
+    }
+    fmt.Printf("%v publishes %v\n", kademlia.Net.Routing.Me.Address, record.String())
+    for _, contact := range kademlia.LookupContact(key) {
+        kademlia.Net.SendPutRecordMessage(record, &contact)
+    }
+}
+
+// Find the newest version of the record stored under key, among our own and those of the k closest nodes
+func (kademlia *Kademlia) GetRecord(key *KademliaID) (*Record, error) {
+    newest, _ := kademlia.Net.Store.GetRecord(*key)
+    closestContacts := kademlia.LookupContact(key)
+    records := make(chan *Record, len(closestContacts))
+    for i := range closestContacts {
+        go func(receiver *Contact) {
+            records <- kademlia.Net.SendGetRecordMessage(key, receiver)
+        }(&closestContacts[i])
+    }
+    for range closestContacts {
+        if record := <-records; record != nil && (newest == nil || record.Sequence > newest.Sequence) {
+            newest = record
+        }
+    }
+    if newest == nil {
+        return nil, NotFoundError
+    }
+    return newest, nil
+}
+
+// Put value under key on this node and the k closest nodes. The value is put again every republish time
+// for as long as this node holds it, and expires from the others after the eviction time otherwise.
+func (kademlia *Kademlia) Put(key *KademliaID, value []byte) error {
+    if err := kademlia.Net.Store.PutValue(*key, value, kademlia.RepublishValue); err != nil {
+        return err
+    }
+    kademlia.RepublishValue(key)
+    return nil
+}
+
+// Send the value we hold under key to the k closest nodes again
+func (kademlia *Kademlia) RepublishValue(key *KademliaID) {
+    value, err := kademlia.Net.Store.GetValue(*key)
+    if err != nil {
+        return
+    }
+    fmt.Printf("%v puts value %v\n", kademlia.Net.Routing.Me.Address, key.String())
+    for _, contact := range kademlia.LookupContact(key) {
+        kademlia.Net.SendPutValueMessage(key, value, &contact)
+    }
+}
+
+// Republish an entry kept on disk by an earlier run, in the way its kind is published
+func (kademlia *Kademlia) republishRestored(key *KademliaID) {
+    if _, err := kademlia.Net.Store.GetRecord(*key); err == nil {
+        kademlia.RepublishRecord(key)
+    } else if valueKey, err := kademlia.Net.Store.valueKeyOf(*key); err == nil {
+        kademlia.RepublishValue(valueKey)
+    } else {
+        kademlia.Republish(key)
+    }
+}
+
+// Get the value stored under key, from this node or the first of the k closest nodes which has it
+func (kademlia *Kademlia) Get(key *KademliaID) ([]byte, error) {
+    if value, err := kademlia.Net.Store.GetValue(*key); err == nil {
+        return value, nil
+    }
+    closestContacts := kademlia.LookupContact(key)
+    values := make(chan []byte, len(closestContacts))
+    for i := range closestContacts {
+        go func(receiver *Contact) {
+            values <- kademlia.Net.SendGetValueMessage(key, receiver)
+        }(&closestContacts[i])
+    }
+    for range closestContacts {
+        if value := <-values; value != nil {
+            return value, nil
+        }
+    }
+    return nil, NotFoundError
+}
@@ -1,22 +1,41 @@
 package kademlia
 
 import (
+    "bytes"
+    "net"
+    "rpc"
+    "context"
     "testing"
     "fmt"
     "io/ioutil"
     "time"
     "log"
+    "sync"
+    "sync/atomic"
+    "github.com/vmihailenco/msgpack"
 )
 
+// Create a node on fresh test ports and start it
+func newTestKademlia(config *Config) *Kademlia {
+    kademlia, err := NewKademlia("127.0.0.1", getTestPort(), getTestPort(), config)
+    if err != nil {
+        panic(err)
+    }
+    if err := kademlia.Start(context.Background()); err != nil {
+        panic(err)
+    }
+    return kademlia
+}
+
 // Makes a grid/mesh of nodes and adds contacts for each node to 8 of its neighbours (fewer at borders).
-func createKademliaMesh(width int, height int) []*Kademlia {
+func createKademliaMesh(width int, height int, config *Config) []*Kademlia {
     k := make([]*Kademlia, width*height)
     // Loop over columns
     for y := 0; y < height; y++ {
         // Fill the row
         for x := 0; x < width; x++ {
             i := y*width + x
-            k[i] = NewKademlia("127.0.0.1", getTestPort(), getTestPort())
+            k[i] = newTestKademlia(config)
             // Connect along x axis
             if x > 0 {
                 k[i-1].Net.Routing.AddContact(k[i].Net.Routing.Me, nil)
@@ -52,9 +71,10 @@ func createKademliaMesh(width int, height int) []*Kademlia {
 
 // Test looking up a contact with specific kademlia ID
 func TestLookupContact(t *testing.T) {
-    EvictionTime = 24 * time.Hour
-    RepublishTime = 24 * time.Hour
-    kademlias := createKademliaMesh(10, 5)
+    config := DefaultConfig()
+    config.EvictionTime = 24 * time.Hour
+    config.RepublishTime = 24 * time.Hour
+    kademlias := createKademliaMesh(10, 5, config)
     numNodes := len(kademlias)
     var cc = []chan []Contact{make(chan []Contact), make(chan []Contact),}
     // First node does not yet have last node as a contact. Find it.
@@ -83,14 +103,17 @@ func TestLookupContact(t *testing.T) {
 
 // Test republish
 func TestRepublish(t *testing.T) {
-    EvictionTime = 3 * time.Second
-    RepublishTime = 5 * time.Second
+    config := DefaultConfig()
+    config.EvictionTime = 3 * time.Second
+    config.RepublishTime = 5 * time.Second
+    // Keep test.bin a single block
+    config.BlockSize = 2 << 20
 
     data, _ := ioutil.ReadFile("test.bin")
     hash := NewKademliaIDFromBytes(data)
 
     // Create some network nodes
-    kademlias := createKademliaMesh(5, 5)
+    kademlias := createKademliaMesh(5, 5, config)
     owner := kademlias[0]
     // Store some data
     owner.Store(data)
@@ -152,12 +175,15 @@ func TestRepublish(t *testing.T) {
 
 // Test storing and finding data
 func TestLookupStoreData(t *testing.T) {
-    EvictionTime = 24 * time.Hour
-    RepublishTime = 24 * time.Hour
+    config := DefaultConfig()
+    config.EvictionTime = 24 * time.Hour
+    config.RepublishTime = 24 * time.Hour
+    // Keep test.bin a single block
+    config.BlockSize = 2 << 20
 
     data, _ := ioutil.ReadFile("test.bin")
     // Create some network nodes
-    kademlias := createKademliaMesh(5, 5)
+    kademlias := createKademliaMesh(5, 5, config)
     owner := kademlias[0]
     reader := kademlias[len(kademlias)-1]
     // Store some data
@@ -190,15 +216,614 @@ func TestLookupStoreData(t *testing.T) {
     }
 }
 
+// After unpublishing, no node should point at the former owner
+func TestUnpublish(t *testing.T) {
+    kademlias := createKademliaMesh(5, 5, nil)
+    owner := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+    data := []byte("Soon to be withdrawn")
+    hash, _ := owner.Store(data)
+    time.Sleep(time.Second * 2)
+    if candidates := *reader.LookupData(&hash); len(candidates) != 1 {
+        t.Fatalf("Expected one owner before unpublish, got %v", candidates)
+    }
+
+    if err := owner.Unpublish(&hash); err != nil {
+        t.Errorf("Unpublish failed: %v", err)
+    }
+    time.Sleep(time.Second)
+    if candidates := *reader.LookupData(&hash); len(candidates) != 0 {
+        t.Errorf("Expected no owners after unpublish, got %v", candidates)
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// A record put by one node resolves to its newest version on another
+func TestPutGetRecord(t *testing.T) {
+    kademlias := createKademliaMesh(5, 5, nil)
+    publisher := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+
+    if _, err := publisher.PutRecord([]byte("version 1")); err != nil {
+        t.Fatal("PutRecord failed:", err)
+    }
+    time.Sleep(time.Second)
+    record, err := publisher.PutRecord([]byte("version 2"))
+    if err != nil || record.Sequence != 2 {
+        t.Fatalf("Expected sequence 2, got %v (%v)", record, err)
+    }
+    time.Sleep(time.Second)
+
+    record, err = reader.GetRecord(publisher.RecordKey())
+    if err != nil || string(record.Value) != "version 2" {
+        t.Errorf("Expected version 2, got %v (%v)", record, err)
+    }
+    if _, err := reader.GetRecord(NewRandomKademliaID()); err != NotFoundError {
+        t.Errorf("Expected NotFoundError for an unknown key, got %v", err)
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// A value put by one node can be read by another, and values over the limit are refused
+func TestPutGet(t *testing.T) {
+    kademlias := createKademliaMesh(5, 5, nil)
+    writer := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+    key := KeyFromName("registry/service")
+
+    if err := writer.Put(key, []byte("10.0.0.1:8000")); err != nil {
+        t.Fatal("Put failed:", err)
+    }
+    time.Sleep(time.Second)
+    if value, err := reader.Get(key); err != nil || string(value) != "10.0.0.1:8000" {
+        t.Errorf("Expected the value, got %v (%v)", string(value), err)
+    }
+    if _, err := reader.Get(KeyFromName("registry/missing")); err != NotFoundError {
+        t.Errorf("Expected NotFoundError, got %v", err)
+    }
+    tooLarge := make([]byte, writer.Config.MaxValueSize+1)
+    if err := writer.Put(key, tooLarge); err != ValueTooLargeError {
+        t.Errorf("Expected ValueTooLargeError, got %v", err)
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// A message published by one node reaches a subscriber on another exactly once
+func TestPublishSubscribe(t *testing.T) {
+    kademlias := createKademliaMesh(5, 5, nil)
+    publisher := kademlias[0]
+    subscriber := kademlias[len(kademlias)-1]
+    topic := TopicFromName("datasets")
+
+    sub := subscriber.Subscribe(topic)
+    time.Sleep(time.Second)
+    if err := publisher.Publish(topic, []byte("new dataset")); err != nil {
+        t.Fatal(err)
+    }
+    if err := publisher.Publish(topic, make([]byte, publisher.Config.MaxValueSize+1)); err != MessageTooLargeError {
+        t.Errorf("Expected MessageTooLargeError, got %v", err)
+    }
+
+    select {
+    case message := <-sub.Messages:
+        if string(message.Payload) != "new dataset" || !message.Topic.Equals(topic) {
+            t.Errorf("Unexpected message %v", message)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("Message was not delivered")
+    }
+    select {
+    case message := <-sub.Messages:
+        t.Errorf("Message delivered twice: %v", message)
+    case <-time.After(time.Second):
+    }
+
+    subscriber.Unsubscribe(sub)
+    if _, open := <-sub.Messages; open {
+        t.Error("Messages channel still open after Unsubscribe")
+    }
+    // Both the application and a REST stream may unsubscribe
+    subscriber.Unsubscribe(sub)
+    for _, k := range kademlias {
+        k.Stop(context.Background())
+    }
+
+    // Nothing is left running for subscriptions after Stop
+    subscriber.Subscribe(topic)
+    stopped := make(chan bool)
+    go func() {
+        subscriber.running.Wait()
+        stopped <- true
+    }()
+    select {
+    case <-stopped:
+    case <-time.After(time.Second):
+        t.Error("Subscription after Stop is still running")
+    }
+}
+
+// Files published in one batch can be found in one batch
+func TestRepublishLookupDataMany(t *testing.T) {
+    kademlias := createKademliaMesh(5, 5, nil)
+    owner := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+    hashes := []KademliaID{}
+    for i := 0; i < 30; i++ {
+        data := []byte(fmt.Sprintf("block %v", i))
+        hash := NewKademliaIDFromBytes(data)
+        owner.Net.Store.Insert(*hash, false, data, owner.Republish)
+        hashes = append(hashes, *hash)
+    }
+    owner.RepublishMany(hashes)
+    time.Sleep(time.Second)
+
+    unknown := *NewRandomKademliaID()
+    found := reader.LookupDataMany(append(hashes, unknown))
+    if len(found) != len(hashes) {
+        t.Errorf("Expected owners for %v hashes, got %v", len(hashes), len(found))
+    }
+    for _, hash := range hashes {
+        if owners := found[hash]; len(owners) != 1 || !owners[0].ID.Equals(owner.Net.Routing.Me.ID) {
+            t.Errorf("Wrong owners for %v: %v", hash.String(), owners)
+        }
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// A transfer cut off halfway is resumed from another owner
+func TestDownloadResume(t *testing.T) {
+    config := DefaultConfig()
+    config.BlockSize = 2 << 20
+    kademlias := createKademliaMesh(3, 3, config)
+    owner := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+    data, _ := ioutil.ReadFile("test.bin")
+    hash, _ := owner.Store(data)
+    time.Sleep(time.Second)
+
+    // A flaky node which sends the first half of the file once, then disappears
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        connection, err := listener.Accept()
+        listener.Close()
+        if err != nil {
+            return
+        }
+        defer connection.Close()
+        frame, _ := readFrame(connection, 1<<20)
+        var request NetworkMessage
+        msgpack.Unmarshal(frame, &request)
+        size := int64(len(data))
+        header, _ := msgpack.Marshal(transferHeader{Size: size, Offset: 0, Length: size})
+        response, _ := msgpack.Marshal(NetworkMessage{MsgType: rpc.TRANSFER_DATA_MSG, RpcID: request.RpcID, Data: header})
+        writeFrame(connection, response)
+        connection.Write(data[:len(data)/2])
+    }()
+    flaky := NewContact(NewRandomKademliaID(), "127.0.0.1", listener.Addr().(*net.TCPAddr).Port, getTestPort())
+
+    downloaded := reader.Download(&hash, &flaky)
+    if !bytes.Equal(data, downloaded) {
+        t.Errorf("Resumed download has %v of %v bytes", len(downloaded), len(data))
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// Files larger than a block are split and read back through their manifest
+func TestStoreCatChunked(t *testing.T) {
+    config := DefaultConfig()
+    config.BlockSize = 32 << 10
+    kademlias := createKademliaMesh(5, 5, config)
+    owner := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+
+    data, _ := ioutil.ReadFile("test.bin")
+    root, _ := owner.Store(data)
+    if root.Equals(NewKademliaIDFromBytes(data)) {
+        t.Errorf("Large file was stored as a single block")
+    }
+    small := []byte("small file")
+    smallRoot, _ := owner.Store(small)
+    if !smallRoot.Equals(NewKademliaIDFromBytes(small)) {
+        t.Errorf("Small file root %v is not its content hash", smallRoot.String())
+    }
+    time.Sleep(time.Second)
+
+    read, err := reader.Cat(&root)
+    if err != nil || !bytes.Equal(data, read) {
+        t.Errorf("Cat returned %v of %v bytes: %v", len(read), len(data), err)
+    }
+    read, err = reader.Cat(&smallRoot)
+    if err != nil || !bytes.Equal(small, read) {
+        t.Errorf("Cat of small file returned %v: %v", string(read), err)
+    }
+    missing := NewRandomKademliaID()
+    if _, err := reader.Cat(missing); err != NotFoundError {
+        t.Errorf("Expected NotFoundError for missing file, got %v", err)
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// A fake provider serving blocks after delay, counting the blocks it served
+func serveBlocks(blocks map[KademliaID][]byte, delay time.Duration, served *int32) Contact {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        panic(err)
+    }
+    go func() {
+        for {
+            connection, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer connection.Close()
+                frame, _ := readFrame(connection, 1<<20)
+                var message NetworkMessage
+                var request transferRequest
+                msgpack.Unmarshal(frame, &message)
+                msgpack.Unmarshal(message.Data, &request)
+                block, ok := blocks[request.Hash]
+                if !ok {
+                    return
+                }
+                time.Sleep(delay)
+                size := int64(len(block))
+                header, _ := msgpack.Marshal(transferHeader{Size: size, Offset: 0, Length: size})
+                response, _ := msgpack.Marshal(NetworkMessage{MsgType: rpc.TRANSFER_DATA_MSG, RpcID: message.RpcID, Data: header})
+                atomic.AddInt32(served, 1)
+                writeFrame(connection, response)
+                connection.Write(block)
+            }()
+        }
+    }()
+    return NewContact(NewRandomKademliaID(), "127.0.0.1", listener.Addr().(*net.TCPAddr).Port, getTestPort())
+}
+
+// Blocks are spread over all providers, faster ones serve more and dead ones are skipped
+func TestDownloadBlocksParallel(t *testing.T) {
+    reader := newTestKademlia(nil)
+    blocks := make(map[KademliaID][]byte)
+    hashes := []KademliaID{}
+    for i := 0; i < 40; i++ {
+        block := []byte(fmt.Sprintf("block %v", i))
+        hash := NewKademliaIDFromBytes(block)
+        blocks[*hash] = block
+        hashes = append(hashes, *hash)
+    }
+    var fastServed, slowServed int32
+    fast := serveBlocks(blocks, 10*time.Millisecond, &fastServed)
+    slow := serveBlocks(blocks, 200*time.Millisecond, &slowServed)
+    dead := NewContact(NewRandomKademliaID(), "127.0.0.1", getTestPort(), getTestPort())
+    owners := make(map[KademliaID][]Contact)
+    for _, hash := range hashes {
+        owners[hash] = []Contact{dead, slow, fast}
+    }
+
+    downloaded, err := reader.downloadBlocks(hashes, owners)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, hash := range hashes {
+        if !bytes.Equal(blocks[hash], downloaded[hash]) {
+            t.Errorf("Block %v was not downloaded", hash.String())
+        }
+    }
+    fastCount, slowCount := atomic.LoadInt32(&fastServed), atomic.LoadInt32(&slowServed)
+    if slowCount == 0 || fastCount <= slowCount {
+        t.Errorf("Expected both providers to serve blocks, the faster one more, got %v fast and %v slow", fastCount, slowCount)
+    }
+    reader.Net.Close()
+}
+
+// Nothing larger than a block is downloaded into memory
+func TestDownloadTooLarge(t *testing.T) {
+    config := DefaultConfig()
+    config.BlockSize = 32 << 10
+    reader := newTestKademlia(config)
+    block := make([]byte, 100<<10)
+    hash := NewKademliaIDFromBytes(block)
+    var served int32
+    provider := serveBlocks(map[KademliaID][]byte{*hash: block}, 0, &served)
+
+    if downloaded := reader.Download(hash, &provider); len(downloaded) != 0 {
+        t.Errorf("Expected the download to be refused, got %v bytes", len(downloaded))
+    }
+    reader.Net.Close()
+}
+
+// Corrupt data is rejected, its sender penalised and the next owner tried
+func TestDownloadCorrupt(t *testing.T) {
+    config := DefaultConfig()
+    config.BlockSize = 2 << 20
+    kademlias := createKademliaMesh(3, 3, config)
+    owner := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+    data, _ := ioutil.ReadFile("test.txt")
+    hash, _ := owner.Store(data)
+    time.Sleep(time.Second)
+
+    var served int32
+    corrupt := append([]byte("not quite "), data...)
+    liar := serveBlocks(map[KademliaID][]byte{hash: corrupt}, 0, &served)
+
+    downloaded := reader.Download(&hash, &liar)
+    if !bytes.Equal(data, downloaded) {
+        t.Errorf("Expected the data from the honest owner, got %v bytes", len(downloaded))
+    }
+    if reader.Net.scores.score(liar.ID) >= 0 {
+        t.Errorf("Corrupt provider was not penalised")
+    }
+
+    // The parallel downloader rejects it as well, and a second offence gets it banned
+    other := NewKademliaIDFromBytes([]byte("other block"))
+    liar = serveBlocks(map[KademliaID][]byte{*other: corrupt}, 0, &served)
+    reader.Net.scores.reportCorrupt(&liar)
+    if _, err := reader.downloadBlocks([]KademliaID{*other}, map[KademliaID][]Contact{*other: {liar}}); err != NotFoundError {
+        t.Errorf("Expected NotFoundError for a block only a liar has, got %v", err)
+    }
+    if !reader.Net.scores.isBanned(liar.ID) {
+        t.Errorf("Provider was not banned after two corrupt transfers")
+    }
+    if _, err := reader.Net.Store.Lookup(*other); err == nil {
+        t.Errorf("Corrupt block entered the store")
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// Files with several providers are read back from all of them
+func TestCatMultipleProviders(t *testing.T) {
+    config := DefaultConfig()
+    config.BlockSize = 32 << 10
+    kademlias := createKademliaMesh(5, 5, config)
+    reader := kademlias[len(kademlias)-1]
+
+    data, _ := ioutil.ReadFile("test.bin")
+    root, _ := kademlias[0].Store(data)
+    kademlias[4].Store(data)
+    time.Sleep(time.Second)
+
+    read, err := reader.Cat(&root)
+    if err != nil || !bytes.Equal(data, read) {
+        t.Errorf("Cat returned %v of %v bytes: %v", len(read), len(data), err)
+    }
+    // The reader keeps the blocks and provides them from now on
+    if _, err := reader.Net.Store.Providers(root); err != IsDataError {
+        t.Errorf("Reader did not keep the downloaded root")
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// Erasure coded files are spread over the network and survive the loss of ParityShards nodes
+func TestStoreErasure(t *testing.T) {
+    config := DefaultConfig()
+    config.BlockSize = 32 << 10
+    // Lookups wait for the lost nodes
+    config.ConnectionTimeout = time.Second
+    kademlias := createKademliaMesh(5, 5, config)
+    owner := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+
+    data, _ := ioutil.ReadFile("test.bin")
+    root, err := owner.StoreErasure(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    block, _ := owner.readLocal(&root)
+    m := parseErasureManifest(block)
+    if m == nil || len(m.Stripes) != len(data)/(config.DataShards*config.BlockSize) {
+        t.Fatalf("Unexpected manifest %v", m)
+    }
+    time.Sleep(time.Second)
+
+    // Every shard of a stripe is on another node
+    holders := make(map[*Kademlia]bool)
+    for _, stripe := range m.Stripes {
+        count := 0
+        for _, k := range kademlias {
+            for i := range stripe.Shards {
+                if _, err := k.readLocal(&stripe.Shards[i]); err == nil {
+                    holders[k] = true
+                    count++
+                }
+            }
+        }
+        if count != config.DataShards+config.ParityShards {
+            t.Errorf("Expected %v shards on different nodes, found %v", config.DataShards+config.ParityShards, count)
+        }
+    }
+
+    // Lose ParityShards of the nodes holding shards
+    lost := 0
+    for _, k := range kademlias[1 : len(kademlias)-1] {
+        if holders[k] && lost < config.ParityShards {
+            k.Net.Close()
+            lost++
+        }
+    }
+    read, err := reader.Cat(&root)
+    if err != nil || !bytes.Equal(data, read) {
+        t.Errorf("Cat returned %v of %v bytes: %v", len(read), len(data), err)
+    }
+    // A file with the bytes of the manifest is read back as it is
+    stored, _ := reader.Store(block)
+    if read, err := reader.Cat(&stored); err != nil || !bytes.Equal(read, block) {
+        t.Errorf("Cat of an erasure manifest lookalike returned %v bytes: %v", len(read), err)
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// A full manifest must fit in a block, whatever the block size
+func TestManifestFitsBlock(t *testing.T) {
+    for _, blockSize := range []int{32 << 10, 256 << 10, 1 << 20} {
+        m := manifest{Size: 1 << 40, Links: make([]KademliaID, maxLinks(blockSize))}
+        if encoded := encodeBlock(manifestBlock, m); len(encoded) > blockSize {
+            t.Errorf("manifest of %v links takes %v bytes, more than a block of %v", len(m.Links), len(encoded), blockSize)
+        }
+    }
+}
+
+// A file which looks like a manifest is read back as it is, not as the file the manifest lists
+func TestCatManifestLookalike(t *testing.T) {
+    k := newTestKademlia(nil)
+    defer k.Net.Close()
+    other, _ := k.Store([]byte("other file"))
+    data := encodeBlock(manifestBlock, manifest{Size: 10, Links: []KademliaID{other}})
+    root, err := k.Store(data)
+    if err != nil {
+        t.Fatalf("Store failed: %v", err)
+    }
+    if read, err := k.Cat(&root); err != nil || !bytes.Equal(read, data) {
+        t.Errorf("Cat of a manifest lookalike returned %q: %v", read, err)
+    }
+}
+
+// Manifests served by other nodes may lie about the size of the file
+func TestCatManifestSize(t *testing.T) {
+    k := newTestKademlia(nil)
+    defer k.Net.Close()
+    block, _ := k.storeBlock([]byte("block"))
+    for _, size := range []int64{-5, 1 << 50} {
+        root, _ := k.storeBlock(encodeBlock(manifestBlock, manifest{Size: size, Links: []KademliaID{block}}))
+        if _, err := k.Cat(&root); err != CorruptFileError {
+            t.Errorf("expected CorruptFileError for size %v, got %v", size, err)
+        }
+        shards := []KademliaID{block, block, block}
+        root, _ = k.storeBlock(encodeBlock(erasureBlock, erasureManifest{Size: size, DataShards: 2, ParityShards: 1,
+            Stripes: []erasureStripe{{Size: 5, Shards: shards}}}))
+        if _, err := k.Cat(&root); err != CorruptFileError {
+            t.Errorf("expected CorruptFileError for erasure coded size %v, got %v", size, err)
+        }
+    }
+}
+
+// Hashes sharing a lookup get the closest nodes of its target, which are in the same subtree as their own
+func TestGroupByClosest(t *testing.T) {
+    config := DefaultConfig()
+    config.ReplicationFactor = 4
+    kademlias := createKademliaMesh(5, 5, config)
+    k := kademlias[0]
+    hashes := []KademliaID{}
+    for i := 0; i < 40; i++ {
+        hashes = append(hashes, *NewRandomKademliaID())
+    }
+    batched := make(map[KademliaID][]Contact)
+    for _, group := range k.groupByClosest(hashes) {
+        for _, hash := range group.keys {
+            batched[hash] = append(batched[hash], group.contact)
+        }
+    }
+    // Highest bit of the distance from hash to the farthest of contacts
+    spread := func(hash *KademliaID, contacts []Contact) int {
+        radius := -1
+        for _, contact := range contacts {
+            if bit := highestBit(contact.ID.CalcDistance(hash)); bit > radius {
+                radius = bit
+            }
+        }
+        return radius
+    }
+    differ := 0
+    for i := range hashes {
+        closest := k.LookupContact(&hashes[i])
+        if len(batched[hashes[i]]) != len(closest) {
+            t.Errorf("%v grouped under %v nodes, a lookup finds %v", hashes[i].String(), len(batched[hashes[i]]), len(closest))
+        }
+        if spread(&hashes[i], closest) > spread(&hashes[i], batched[hashes[i]]) {
+            t.Errorf("closest nodes of %v are outside the subtree of the batched ones", hashes[i].String())
+        }
+        for _, contact := range closest {
+            if !containsContact(batched[hashes[i]], contact.ID) {
+                differ++
+                break
+            }
+        }
+    }
+    t.Logf("%v of %v hashes were grouped under other nodes than their own closest", differ, len(hashes))
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
+// A lookup should leave a cached copy of the owners at the closest node which missed
+func TestLookupDataCaches(t *testing.T) {
+    config := DefaultConfig()
+    config.ReplicationFactor = 5
+    data := []byte("Popular content")
+    hash := NewKademliaIDFromBytes(data)
+    kademlias := createKademliaMesh(5, 5, config)
+    owner := kademlias[0]
+    owner.Store(data)
+    time.Sleep(time.Second * 2)
+
+    // The reader must not hold the record itself, or the lookup never leaves it
+    var reader *Kademlia
+    for _, k := range kademlias[1:] {
+        if _, err := k.Net.Store.Lookup(*hash); err != nil {
+            reader = k
+            break
+        }
+    }
+    // Make the closest node the reader knows of miss, as if it joined after the data was published
+    var closest *Kademlia
+    nearest := reader.LookupContact(hash)[0]
+    for _, k := range kademlias {
+        if k.Net.Routing.Me.ID.Equals(nearest.ID) {
+            closest = k
+        }
+    }
+    closest.Net.Store.mutex.Lock()
+    delete(closest.Net.Store.mapping, *hash)
+    closest.Net.Store.mutex.Unlock()
+
+    candidates := *reader.LookupData(hash)
+    time.Sleep(time.Second)
+
+    if len(candidates) != 1 || !candidates[0].ID.Equals(owner.Net.Routing.Me.ID) {
+        log.Printf("Invalid contact list %v\n", candidates)
+        t.Fail()
+    }
+    value, err := closest.Net.Store.Lookup(*hash)
+    var cached []Contact
+    if err != nil || msgpack.Unmarshal(value, &cached) != nil || len(cached) != 1 || !cached[0].ID.Equals(owner.Net.Routing.Me.ID) {
+        log.Println("Owners were not cached at the closest node")
+        t.Fail()
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
+
 // Test storing data on multiple nodes and finding it from another
 func TestLookupStoreDataMultiple(t *testing.T) {
-    EvictionTime = 24 * time.Hour
-    RepublishTime = 24 * time.Hour
+    config := DefaultConfig()
+    config.EvictionTime = 24 * time.Hour
+    config.RepublishTime = 24 * time.Hour
     // Load a text file to store on network
     data, _ := ioutil.ReadFile("test.txt")
     hash := NewKademliaIDFromBytes(data)
     // Create some network nodes
-    kademlias := createKademliaMesh(10, 10)
+    kademlias := createKademliaMesh(10, 10, config)
     owner1 := kademlias[0]
     owner2 := kademlias[1]
     requester := kademlias[len(kademlias)-1]
@@ -240,3 +865,61 @@ func TestLookupStoreDataMultiple(t *testing.T) {
         k.Net.Close()
     }
 }
+
+// Start on port 0, talk to another node, then stop and make sure everything was released
+func TestStartStop(t *testing.T) {
+    config := DefaultConfig()
+    config.ConnectionTimeout = time.Second
+    config.BootstrapAttempts = 1
+    k, _ := NewKademlia("127.0.0.1", 0, 0, config)
+    if err := k.Start(context.Background()); err != nil {
+        t.Fatal("start failed:", err)
+    }
+    me := k.Net.Routing.Me.Address
+    if me.TcpPort == 0 || me.UdpPort == 0 {
+        t.Error("bound ports were not reported:", me)
+    }
+    if err := k.Start(context.Background()); err != AlreadyStartedError {
+        t.Error("expected AlreadyStartedError, got", err)
+    }
+
+    // A second node on the same ports must get an error, not kill the process
+    busy, _ := NewKademlia("127.0.0.1", me.TcpPort, me.UdpPort, config)
+    if err := busy.Start(context.Background()); err == nil {
+        t.Error("binding a busy port succeeded")
+    }
+
+    other := newTestKademlia(config)
+    if !other.Net.SendPingMessage(&k.Net.Routing.Me) {
+        t.Error("started node did not answer ping")
+    }
+
+    // Stop while a background bootstrap is waiting
+    k.Bootstrap([]Address{{IP: "127.0.0.1", TcpPort: getTestPort(), UdpPort: getTestPort()}})
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := k.Stop(ctx); err != nil {
+        t.Error("stop failed:", err)
+    }
+    if other.Net.SendPingMessage(&k.Net.Routing.Me) {
+        t.Error("stopped node still answers ping")
+    }
+    if err := k.Start(context.Background()); err != StoppedError {
+        t.Error("expected StoppedError, got", err)
+    }
+
+    // The ports are free again
+    again, _ := NewKademlia("127.0.0.1", me.TcpPort, me.UdpPort, config)
+    if err := again.Start(context.Background()); err != nil {
+        t.Error("ports were not released:", err)
+    }
+    var wg sync.WaitGroup
+    for _, node := range []*Kademlia{again, other, busy} {
+        wg.Add(1)
+        go func(node *Kademlia) {
+            node.Stop(context.Background())
+            wg.Done()
+        }(node)
+    }
+    wg.Wait()
+}
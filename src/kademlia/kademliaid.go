@@ -4,14 +4,15 @@ import (
     "time"
     "encoding/hex"
     "math/rand"
-    "crypto/sha1"
+    "crypto/sha256"
 )
 
 func init() {
     rand.Seed(time.Now().UTC().UnixNano())
 }
 
-const IDLength = 20
+// IDs are 256 bits, the size of a SHA-256 digest
+const IDLength = 32
 
 type KademliaID [IDLength]byte
 
@@ -28,21 +29,17 @@ func NewKademliaIDRandom() *KademliaID {
 func NewKademliaID(data string) *KademliaID {
     decoded, _ := hex.DecodeString(data)
 
+    // Shorter IDs, like SHA-1 addresses, are padded with zeros
     newKademliaID := KademliaID{}
-    for i := 0; i < IDLength; i++ {
-        newKademliaID[i] = decoded[i]
-    }
+    copy(newKademliaID[:], decoded)
 
     return &newKademliaID
 }
 
 func NewKademliaIDFromBytes(data []byte) *KademliaID {
     result := KademliaID{}
-    hash := sha1.Sum(data)
-    for i := IDLength - 1; i >= 0; i-- {
-        // SHA1 sum is always 160 bits, IDLength might not be?
-        result[i] = hash[i]
-    }
+    hash := sha256.Sum256(data)
+    copy(result[:], hash[:])
     return &result
 }
 
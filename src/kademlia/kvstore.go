@@ -1,10 +1,15 @@
 package kademlia
 
 import (
+    "bytes"
+    "io"
+    "io/ioutil"
     "time"
     "errors"
+    "sort"
     "sync"
     "fmt"
+    "log"
 )
 
 // Error states
@@ -12,17 +17,42 @@ var NotInitializedError = errors.New("KVS not initialized")
 var DuplicateError = errors.New("value is already in map")
 var NotFoundError = errors.New("value was not found in map")
 
-// Globals
-var EvictionTime = 24 * time.Hour
-var RepublishTime = 24 * time.Hour
-
+// What the store keeps in memory of each entry, its bytes are kept by the backend
 type kvData struct {
     id            KademliaID
-    data          []byte
+    // Bytes held by the backend
+    length        int
     evictionTime  time.Time
     pinned        bool
     republishTime time.Time
     republishFunc func(id *KademliaID)
+    // Set for provider records, which hold who has the data instead of the data itself
+    providers []*provider
+    // Set for signed records, the backend then holds the marshaled record
+    record *Record
+    // Set for values put under a key of the application's choice
+    value bool
+    // Set for files kept compressed, see Config.CompressStore
+    compressed bool
+    // Bytes counted against the capacity, and when the entry was stored and last read, see capacity.go
+    charged  int
+    storedAt time.Time
+    lastRead time.Time
+}
+
+// The data of a file as it was stored. Call without the store lock, decompressing may take a while.
+func fileContent(data []byte, compressed bool) ([]byte, error) {
+    if !compressed {
+        return data, nil
+    }
+    return decompress(data)
+}
+
+// An entry may be queued more than once if its eviction time was moved, so the queue remembers when each
+// was due at the time it was scheduled
+type evictionEntry struct {
+    data *kvData
+    at   time.Time
 }
 
 // For REST/debug only
@@ -33,29 +63,230 @@ type KVPair struct {
 
 type KVStore struct {
     evictionTimer  *time.Timer
-    evictionQueue  []*kvData
+    evictionQueue  []evictionEntry
     republishTimer *time.Timer
     republishQueue []*kvData
+    // If set, files due for republishing together are handed over in one call
+    republishMany  func([]KademliaID)
     mapping        map[KademliaID]*kvData
+    // Bytes held, at most Config.Capacity
+    used           int
+    // ID of the node, for FarthestFirstPolicy
+    self           KademliaID
+    // Holds the entries, see backend.go
+    backend        Backend
+    // Republishes entries restored from the backend, see SetRestoredRepublish
+    restoredRepublish func(*KademliaID)
+    // Entries of files being stored, which are not evicted to make room, see protect
+    protected      map[KademliaID]int
+    // Entries restored from the backend waiting for restoredRepublish to be queued for republishing
+    restored       []*kvData
+    // Keys whose bytes are being written without holding the mutex, written is signalled when one is done
+    writing        map[KademliaID]bool
+    written        *sync.Cond
     mutex          *sync.Mutex
+    config         *Config
+    // Closed by Close to stop the eviction and republish threads
+    stop    chan bool
+    closed  bool
+    running *sync.WaitGroup
+}
+
+// A store keeping its entries in the backend chosen by config. Returns the error of the backend if it
+// cannot be opened, a store meant to survive restarts is not silently kept in memory instead.
+func NewKVStore(config *Config) (*KVStore, error) {
+    config, err := checkConfig(config)
+    if err != nil {
+        return nil, err
+    }
+    backend, err := newBackend(config)
+    if err != nil {
+        return nil, err
+    }
+    return NewKVStoreWithBackend(config, backend)
 }
 
-func NewKVStore() *KVStore {
+// A store keeping its entries in backend. Entries already in it are restored, returns the error of the
+// backend if they cannot be read.
+func NewKVStoreWithBackend(config *Config, backend Backend) (*KVStore, error) {
+    config, err := checkConfig(config)
+    if err != nil {
+        return nil, err
+    }
     kvStore := new(KVStore)
+    kvStore.config = config
+    kvStore.backend = backend
     kvStore.mutex = &sync.Mutex{}
     kvStore.mapping = make(map[KademliaID]*kvData)
+    kvStore.protected = make(map[KademliaID]int)
+    kvStore.writing = make(map[KademliaID]bool)
+    kvStore.written = sync.NewCond(kvStore.mutex)
+    kvStore.stop = make(chan bool)
+    kvStore.running = &sync.WaitGroup{}
 
     kvStore.republishQueue = []*kvData{}
     kvStore.republishTimer = time.NewTimer(0)
     <-kvStore.republishTimer.C
-    go kvStore.republishThread()
-
-    kvStore.evictionQueue = []*kvData{}
+    kvStore.evictionQueue = []evictionEntry{}
     kvStore.evictionTimer = time.NewTimer(0)
     <-kvStore.evictionTimer.C
+    if err := kvStore.restore(); err != nil {
+        kvStore.evictionTimer.Stop()
+        return nil, err
+    }
+
+    kvStore.running.Add(2)
+    go kvStore.republishThread()
     go kvStore.evictionThread()
+    return kvStore, nil
+}
+
+// Load the entries the backend kept from an earlier run and queue their eviction again. Their republishing
+// is queued by SetRestoredRepublish.
+func (kvStore *KVStore) restore() error {
+    loaded := []*kvData{}
+    err := kvStore.backend.Iterate(func(entry *Entry) bool {
+        if entry.Record && entry.Data == nil {
+            // Records are read from their bytes, which Iterate may leave out
+            if full, err := kvStore.backend.Get(entry.Key); err == nil {
+                entry = full
+            }
+        }
+        if data, err := entry.kvData(kvStore.republishRestored); err == nil {
+            loaded = append(loaded, data)
+        } else {
+            log.Printf("skipping unreadable store entry %v: %v\n", entry.Key.String(), err)
+        }
+        return true
+    })
+    if err != nil {
+        return err
+    }
+    if len(loaded) == 0 {
+        return nil
+    }
+    // The republish queue is kept in order of republish time
+    sort.Slice(loaded, func(i, j int) bool { return loaded[i].republishTime.Before(loaded[j].republishTime) })
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    now := time.Now()
+    for _, data := range loaded {
+        if data.providers != nil {
+            data.providers = data.liveProviders(now)
+        }
+        if !data.pinned && data.evictionTime.Before(now) || data.providers != nil && len(data.providers) == 0 {
+            // Expired while we were down
+            kvStore.unsave(data.id)
+            continue
+        }
+        kvStore.mapping[data.id] = data
+        kvStore.charge(data)
+        kvStore.scheduleEviction(data)
+        if data.republishFunc != nil {
+            kvStore.restored = append(kvStore.restored, data)
+        }
+    }
+    fmt.Println("Restored", len(kvStore.mapping), "entries")
+    return nil
+}
+
+// Have entries restored from the backend republished with republish, their own republish functions did not survive
+// the restart. They are queued by the republish times they had before.
+func (kvStore *KVStore) SetRestoredRepublish(republish func(*KademliaID)) {
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    kvStore.restoredRepublish = republish
+    if len(kvStore.restored) == 0 {
+        return
+    }
+    // Keep the queue in order of republish time, entries stored since the start go after the restored ones
+    kvStore.republishQueue = append(kvStore.restored, kvStore.republishQueue...)
+    kvStore.restored = nil
+    kvStore.republishTimer.Reset(kvStore.republishQueue[0].republishTime.Sub(time.Now()))
+    fmt.Println("Republishing", len(kvStore.republishQueue), "entries, the first in",
+        kvStore.republishQueue[0].republishTime.Sub(time.Now()).String())
+}
 
-    return kvStore
+func (kvStore *KVStore) republishRestored(id *KademliaID) {
+    kvStore.mutex.Lock()
+    republish := kvStore.restoredRepublish
+    kvStore.mutex.Unlock()
+    if republish != nil {
+        republish(id)
+    }
+}
+
+// Write what changed about an entry to the backend, its bytes are left alone. Entries being replaced are
+// not written, the entry replacing them is. Must hold the mutex.
+func (kvStore *KVStore) save(data *kvData) {
+    if kvStore.writing[data.id] {
+        return
+    }
+    if err := kvStore.backend.Update(newEntry(data, nil)); err != nil {
+        log.Printf("cannot save %v: %v\n", data.id.String(), err)
+    }
+}
+
+// Must hold the mutex
+func (kvStore *KVStore) unsave(id KademliaID) {
+    if kvStore.writing[id] {
+        // Replaced by the entry being written
+        return
+    }
+    if err := kvStore.backend.Delete(id); err != nil {
+        log.Printf("cannot remove %v: %v\n", id.String(), err)
+    }
+}
+
+// Wait until nothing is being written under key. Must hold the mutex, which is released while waiting.
+func (kvStore *KVStore) waitWrites(key KademliaID) {
+    for kvStore.writing[key] {
+        kvStore.written.Wait()
+    }
+}
+
+// Call f with the entry under hash if check lets it be read. f is called without holding the mutex so that
+// large files do not hold up the rest of the store, and called again if the entry was replaced meanwhile.
+// Counts as a read.
+func (kvStore *KVStore) access(hash KademliaID, check func(*kvData) error, f func(*kvData) error) error {
+    for {
+        kvStore.mutex.Lock()
+        kvStore.waitWrites(hash)
+        data, ok := kvStore.mapping[hash]
+        if !ok {
+            kvStore.mutex.Unlock()
+            return NotFoundError
+        }
+        if err := check(data); err != nil {
+            kvStore.mutex.Unlock()
+            return err
+        }
+        data.lastRead = time.Now()
+        kvStore.mutex.Unlock()
+
+        err := f(data)
+        kvStore.mutex.Lock()
+        unchanged := kvStore.mapping[hash] == data && !kvStore.writing[hash]
+        kvStore.mutex.Unlock()
+        if unchanged {
+            return err
+        }
+    }
+}
+
+// The bytes of the entry under hash, and whether they are compressed, if check lets the entry be read
+func (kvStore *KVStore) read(hash KademliaID, check func(*kvData) error) ([]byte, bool, error) {
+    var blob []byte
+    compressed := false
+    err := kvStore.access(hash, check, func(data *kvData) error {
+        entry, err := kvStore.backend.Get(hash)
+        if err != nil {
+            return err
+        }
+        blob, compressed = entry.Data, data.compressed
+        return nil
+    })
+    return blob, compressed, err
 }
 
 func (kvStore *KVStore) scheduleRepublish(data *kvData) {
@@ -74,19 +305,57 @@ func (kvStore *KVStore) scheduleRepublish(data *kvData) {
 }
 
 func (kvStore *KVStore) republishThread() {
+    defer kvStore.running.Done()
     for {
-        <-kvStore.republishTimer.C
-        if len(kvStore.republishQueue) > 0 {
-            toRepublish := kvStore.republishQueue[0]
+        select {
+        case <-kvStore.republishTimer.C:
+        case <-kvStore.stop:
+            kvStore.republishTimer.Stop()
+            return
+        }
+        // Take every entry which is due at once, so that files can be republished in batches
+        kvStore.mutex.Lock()
+        now := time.Now()
+        due := []*kvData{}
+        for len(kvStore.republishQueue) > 0 && !kvStore.republishQueue[0].republishTime.After(now) {
+            due = append(due, kvStore.republishQueue[0])
             kvStore.republishQueue = kvStore.republishQueue[1:]
-            if _, err := kvStore.Lookup(toRepublish.id); err == nil && toRepublish.republishFunc != nil {
-                // Store contains this entry, republish it and add last in queue
+        }
+        // Entries removed or replaced since they were queued, and those without a republish function, are
+        // skipped. Looking them up would count as a read.
+        current := []*kvData{}
+        for _, toRepublish := range due {
+            if stored, ok := kvStore.mapping[toRepublish.id]; ok && stored == toRepublish && toRepublish.republishFunc != nil {
+                current = append(current, toRepublish)
+            }
+        }
+        due = current
+        republishMany := kvStore.republishMany
+        kvStore.mutex.Unlock()
+
+        batch := []KademliaID{}
+        republished := []*kvData{}
+        for _, toRepublish := range due {
+            if republishMany != nil && toRepublish.isFile() {
+                batch = append(batch, toRepublish.id)
+            } else {
                 fmt.Println("Republishing", toRepublish.id.String())
                 toRepublish.republishFunc(&toRepublish.id)
-                toRepublish.republishTime = time.Now().Add(RepublishTime)
-                kvStore.republishQueue = append(kvStore.republishQueue, toRepublish)
-            } else {
-                // This entry was removed from store before republish timeout, or has no republish function
+            }
+            republished = append(republished, toRepublish)
+        }
+        if len(batch) > 0 {
+            fmt.Println("Republishing", len(batch), "files")
+            republishMany(batch)
+        }
+
+        // Republished entries go last in queue
+        kvStore.mutex.Lock()
+        for _, toRepublish := range republished {
+            toRepublish.republishTime = time.Now().Add(kvStore.config.RepublishTime)
+            kvStore.republishQueue = append(kvStore.republishQueue, toRepublish)
+            if current, ok := kvStore.mapping[toRepublish.id]; ok && current == toRepublish {
+                kvStore.save(toRepublish)
             }
         }
         if len(kvStore.republishQueue) > 0 {
@@ -97,71 +366,229 @@ func (kvStore *KVStore) republishThread() {
             fmt.Println("Next republish scheduled in", newDuration)
             kvStore.republishTimer.Reset(newDuration)
         }
+        kvStore.mutex.Unlock()
     }
+}
 
+// Files held by this node, as opposed to provider records, signed records and values
+func (data *kvData) isFile() bool {
+    return data.providers == nil && data.record == nil && !data.value
+}
+
+// Have files which are due at the same time republished with a single call, instead of one call each
+func (kvStore *KVStore) SetRepublishMany(republishMany func([]KademliaID)) {
+    kvStore.mutex.Lock()
+    kvStore.republishMany = republishMany
+    kvStore.mutex.Unlock()
+}
+
+// Announce files right away through the hook set by SetRepublishMany, for data the network layer stored
+// on its own
+func (kvStore *KVStore) announce(hashes []KademliaID) {
+    kvStore.mutex.Lock()
+    republishMany := kvStore.republishMany
+    kvStore.mutex.Unlock()
+    if republishMany != nil {
+        republishMany(hashes)
+    }
 }
 
 func (kvStore *KVStore) scheduleEviction(data *kvData) {
-    kvStore.evictionQueue = append(kvStore.evictionQueue, data)
+    // Entries can have different lifetimes, so keep the queue sorted by eviction time
+    queue := kvStore.evictionQueue
+    i := sort.Search(len(queue), func(i int) bool { return queue[i].at.After(data.evictionTime) })
+    queue = append(queue, evictionEntry{})
+    copy(queue[i+1:], queue[i:])
+    queue[i] = evictionEntry{data: data, at: data.evictionTime}
+    kvStore.evictionQueue = queue
     newDuration := data.evictionTime.Sub(time.Now())
-    // If the eviction thread was idle before, restart it
-    if len(kvStore.evictionQueue) == 1 {
+    // If the eviction thread was idle before, or this entry is due first, restart it
+    if i == 0 {
+        kvStore.evictionTimer.Stop()
         kvStore.evictionTimer.Reset(newDuration)
     }
     fmt.Println("Evicting", data.id.String(), "in", newDuration.String(), ", queue size", len(kvStore.evictionQueue))
 }
 
 func (kvStore *KVStore) evictionThread() {
+    defer kvStore.running.Done()
     for {
-        <-kvStore.evictionTimer.C
+        select {
+        case <-kvStore.evictionTimer.C:
+        case <-kvStore.stop:
+            kvStore.evictionTimer.Stop()
+            return
+        }
         fmt.Println("Eviction timeout...")
         kvStore.mutex.Lock()
-        if len(kvStore.evictionQueue) > 0 {
-            toEvict := kvStore.evictionQueue[0]
+        now := time.Now()
+        for len(kvStore.evictionQueue) > 0 && !kvStore.evictionQueue[0].at.After(now) {
+            toEvict := kvStore.evictionQueue[0].data
             kvStore.evictionQueue = kvStore.evictionQueue[1:]
+            if current, ok := kvStore.mapping[toEvict.id]; !ok || current != toEvict || toEvict.evictionTime.After(now) {
+                // Replaced, removed or rescheduled since this entry was queued
+                continue
+            }
             if !toEvict.pinned {
                 // Remove from store
-                delete(kvStore.mapping, toEvict.id)
+                kvStore.drop(toEvict)
                 fmt.Println("Evicted unpinned", toEvict.id.String())
             } else {
                 fmt.Println("Ignoring pinned", toEvict.id.String())
             }
-        } else {
-            fmt.Println("Eviction queue empty...")
         }
         if len(kvStore.evictionQueue) > 0 {
-            newDuration := kvStore.evictionQueue[0].evictionTime.Sub(time.Now())
+            newDuration := kvStore.evictionQueue[0].at.Sub(time.Now())
             if newDuration < 0 {
                 newDuration = 0
             }
             fmt.Println("Next eviction scheduled in", newDuration)
             kvStore.evictionTimer.Reset(newDuration)
+        } else {
+            fmt.Println("Eviction queue empty...")
         }
         kvStore.mutex.Unlock()
     }
 }
 
+// Stop the eviction and republish threads and wait for them to return. Stored values stay readable.
+func (kvStore *KVStore) Close() {
+    kvStore.mutex.Lock()
+    if kvStore.closed {
+        kvStore.mutex.Unlock()
+        return
+    }
+    kvStore.closed = true
+    close(kvStore.stop)
+    kvStore.mutex.Unlock()
+    kvStore.running.Wait()
+}
+
 func (kvStore *KVStore) Insert(hash KademliaID, pinned bool, data []byte,
     republishFunc func(*KademliaID)) (outData kvData, err error) {
+    return kvStore.InsertExpiring(hash, pinned, data, republishFunc, kvStore.config.EvictionTime)
+}
+
+// Insert a value which is evicted after expiry instead of the configured eviction time. When the store
+// is full, unpinned entries are evicted by the eviction policy to make room, returns StoreFullError if
+// they are not enough.
+func (kvStore *KVStore) InsertExpiring(hash KademliaID, pinned bool, data []byte,
+    republishFunc func(*KademliaID), expiry time.Duration) (outData kvData, err error) {
+    compressed := false
+    if kvStore.config.CompressStore {
+        // Data which does not get smaller is kept as it is
+        if packed, err := compress(data); err == nil && len(packed) < len(data) {
+            data = packed
+            compressed = true
+        }
+    }
     kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
     if kvStore.mapping == nil {
-        err = NotInitializedError
-    } else {
-        outData = kvData{id: hash, data: data, pinned: pinned, evictionTime: time.Now().Add(EvictionTime),
-            republishTime: time.Now().Add(RepublishTime), republishFunc: republishFunc}
-        kvStore.mapping[hash] = &outData
-        kvStore.scheduleEviction(&outData)
-        kvStore.scheduleRepublish(&outData)
+        return outData, NotInitializedError
+    }
+    kvStore.waitWrites(hash)
+    if current, ok := kvStore.mapping[hash]; ok && (current.value || current.record != nil) {
+        // Content only replaces content, and provider records for it
+        return outData, DuplicateError
+    }
+    stored := &kvData{id: hash, pinned: pinned, evictionTime: time.Now().Add(expiry),
+        republishTime: time.Now().Add(kvStore.config.RepublishTime), republishFunc: republishFunc, compressed: compressed}
+    if err = kvStore.reserve(stored, len(data)); err != nil {
+        return
     }
+    // Files may be large, their bytes are written without holding up the rest of the store
+    kvStore.writing[hash] = true
     kvStore.mutex.Unlock()
-    return
+    err = kvStore.backend.Put(newEntry(stored, data))
+    kvStore.mutex.Lock()
+    delete(kvStore.writing, hash)
+    kvStore.written.Broadcast()
+    if err != nil {
+        kvStore.release(stored)
+        return
+    }
+    kvStore.install(stored)
+    kvStore.scheduleEviction(stored)
+    kvStore.scheduleRepublish(stored)
+    return *stored, nil
 }
 
-// Lookup data from table
+// Lookup data from table. Provider records are returned as a marshaled list of their live contacts.
 func (kvStore *KVStore) Lookup(hash KademliaID) (output []byte, err error) {
     kvStore.mutex.Lock()
-    if val, ok := kvStore.mapping[hash]; ok {
-        output = val.data
+    if val, ok := kvStore.mapping[hash]; ok && val.providers != nil {
+        defer kvStore.mutex.Unlock()
+        return val.marshalProviders(time.Now())
+    }
+    kvStore.mutex.Unlock()
+    output, compressed, err := kvStore.read(hash, func(val *kvData) error {
+        if val.providers != nil {
+            // Removed and provided meanwhile, the data is not here
+            return NotFoundError
+        }
+        return nil
+    })
+    if err == nil {
+        output, err = fileContent(output, compressed)
+    }
+    return
+}
+
+// Lets an in-memory file be handed out like one on disk
+type memoryFile struct {
+    *bytes.Reader
+}
+
+func (file memoryFile) Close() error {
+    return nil
+}
+
+// Open a file for streaming, together with its size. The file is read from the backend as it is streamed,
+// unless it is compressed, it is then decompressed into memory first. Provider records, signed records and
+// values are not files.
+func (kvStore *KVStore) Open(hash KademliaID) (io.ReadSeekCloser, int64, error) {
+    var file io.ReadSeekCloser
+    var size int64
+    compressed := false
+    err := kvStore.access(hash, func(val *kvData) error {
+        if !val.isFile() {
+            return NotFoundError
+        }
+        return nil
+    }, func(val *kvData) error {
+        // Opened before the file was replaced
+        if file != nil {
+            file.Close()
+        }
+        var err error
+        file, err = kvStore.backend.Open(hash)
+        size, compressed = int64(val.length), val.compressed
+        return err
+    })
+    if err != nil {
+        return nil, 0, err
+    }
+    if !compressed {
+        return file, size, nil
+    }
+    defer file.Close()
+    data, err := ioutil.ReadAll(file)
+    if err == nil {
+        data, err = fileContent(data, true)
+    }
+    if err != nil {
+        return nil, 0, err
+    }
+    return memoryFile{bytes.NewReader(data)}, int64(len(data)), nil
+}
+
+// Remove data we hold, pinned or not. Provider records are left alone, they are removed by their providers.
+func (kvStore *KVStore) Remove(hash KademliaID) (err error) {
+    kvStore.mutex.Lock()
+    if val, ok := kvStore.mapping[hash]; ok && val.providers == nil {
+        kvStore.drop(val)
+        fmt.Println(hash.String(), "was removed")
     } else {
         err = NotFoundError
     }
@@ -174,6 +601,7 @@ func (kvStore *KVStore) Pin(hash KademliaID) (err error) {
     if val, ok := kvStore.mapping[hash]; ok {
         val.pinned = true
         kvStore.mapping[hash] = val
+        kvStore.save(val)
         fmt.Println(hash.String(), "was pinned")
     } else {
         err = NotFoundError
@@ -186,9 +614,10 @@ func (kvStore *KVStore) Unpin(hash KademliaID) (err error) {
     kvStore.mutex.Lock()
     if val, ok := kvStore.mapping[hash]; ok {
         val.pinned = false
-        val.evictionTime = time.Now().Add(EvictionTime)
+        val.evictionTime = time.Now().Add(kvStore.config.EvictionTime)
         kvStore.scheduleEviction(val)
         kvStore.mapping[hash] = val
+        kvStore.save(val)
         fmt.Println(hash.String(), "was unpinned")
     } else {
         err = NotFoundError
@@ -5,10 +5,12 @@ import (
     "fmt"
     "time"
     "log"
+    "bytes"
+    "io/ioutil"
 )
 
 func TestKVSInsertLookup(t *testing.T) {
-    kvStore := NewKVStore()
+    kvStore, _ := NewKVStore(nil)
     data := []byte("Test data")
     id := NewKademliaIDFromBytes(data)
     pinned := false
@@ -30,7 +32,7 @@ func TestKVSInsertLookup(t *testing.T) {
 }
 
 func TestKVSNotFoundError(t *testing.T) {
-    kvStore := NewKVStore()
+    kvStore, _ := NewKVStore(nil)
     data := []byte("Test data")
     id := NewKademliaIDFromBytes(data)
     // Lookup without inserting first
@@ -44,16 +46,17 @@ func TestKVSNotFoundError(t *testing.T) {
 
 func TestKVSEvictionPin(t *testing.T) {
     // Store some non pinned data
-    kvStore := NewKVStore()
+    // Set a short eviction time for testing
+    config := DefaultConfig()
+    config.EvictionTime = 3 * time.Second
+    config.RepublishTime = 24 * time.Hour
+
+    kvStore, _ := NewKVStore(config)
     data1 := []byte("Test data1")
     data2 := []byte("Test data2")
     id1 := NewKademliaIDFromBytes(data1)
     id2 := NewKademliaIDFromBytes(data2)
 
-    // Set a short eviction time for testing
-    EvictionTime = 3 * time.Second
-    RepublishTime = 24 * time.Hour
-
     // Add some data
     fmt.Printf("Inserted %v\n", id1.String())
     kvStore.Insert(*id1, false, data1, nil)
@@ -94,16 +97,17 @@ func TestKVSEvictionPin(t *testing.T) {
 
 func TestKVSEvictionNoPin(t *testing.T) {
     // Store some non pinned data
-    kvStore := NewKVStore()
+    // Set a short eviction time for testing
+    config := DefaultConfig()
+    config.EvictionTime = 3 * time.Second
+    config.RepublishTime = 24 * time.Hour
+
+    kvStore, _ := NewKVStore(config)
     data1 := []byte("Test data1")
     data2 := []byte("Test data2")
     id1 := NewKademliaIDFromBytes(data1)
     id2 := NewKademliaIDFromBytes(data2)
 
-    // Set a short eviction time for testing
-    EvictionTime = 3 * time.Second
-    RepublishTime = 24 * time.Hour
-
     // Add some data
     fmt.Printf("Inserted %v\n", id1.String())
     kvStore.Insert(*id1, false, data1, nil)
@@ -143,7 +147,7 @@ func TestKVSEvictionNoPin(t *testing.T) {
 }
 
 func TestKVSPinUnpin(t *testing.T) {
-    kvStore := NewKVStore()
+    kvStore, _ := NewKVStore(nil)
 
     data := []byte("Test data")
     id := NewKademliaIDFromBytes(data)
@@ -173,3 +177,96 @@ func TestKVSPinUnpin(t *testing.T) {
     }
 
 }
+
+// A short lived value inserted after a long lived one must still be evicted first
+func TestKVSInsertExpiring(t *testing.T) {
+    kvStore, _ := NewKVStore(nil)
+    data1 := []byte("Long lived")
+    data2 := []byte("Short lived")
+    id1 := NewKademliaIDFromBytes(data1)
+    id2 := NewKademliaIDFromBytes(data2)
+
+    kvStore.InsertExpiring(*id1, false, data1, nil, 3*time.Second)
+    kvStore.InsertExpiring(*id2, false, data2, nil, time.Second)
+
+    time.Sleep(2 * time.Second)
+    if _, err := kvStore.Lookup(*id2); err == nil {
+        t.Fail()
+        log.Println("Short lived ID2 was not removed")
+    }
+    if _, err := kvStore.Lookup(*id1); err != nil {
+        t.Fail()
+        log.Println("Long lived ID1 was removed too early")
+    }
+    time.Sleep(2 * time.Second)
+    if _, err := kvStore.Lookup(*id1); err == nil {
+        t.Fail()
+        log.Println("Long lived ID1 was not removed")
+    }
+    kvStore.Close()
+}
+
+// Values replace each other, but never content or provider records under the same key, nor the other way round
+func TestKVSPutValue(t *testing.T) {
+    kvStore, _ := NewKVStore(nil)
+    key := KeyFromName("name")
+    kvStore.PutValue(*key, []byte("first"), nil)
+    kvStore.PutValue(*key, []byte("second"), nil)
+    if value, err := kvStore.GetValue(*key); err != nil || string(value) != "second" {
+        t.Errorf("expected the second value, got %v (%v)", string(value), err)
+    }
+
+    data := []byte("content")
+    hash := NewKademliaIDFromBytes(data)
+    kvStore.Insert(*hash, false, data, nil)
+    if _, err := kvStore.GetValue(*hash); err != NotFoundError {
+        t.Errorf("expected NotFoundError, got %v", err)
+    }
+    if err := kvStore.PutValue(*hash, []byte("value"), nil); err != nil {
+        t.Errorf("expected the value to be put, got %v", err)
+    }
+    if found, err := kvStore.Lookup(*hash); err != nil || string(found) != "content" {
+        t.Errorf("expected the content to stay, got %v (%v)", string(found), err)
+    }
+    provided := NewKademliaIDFromBytes([]byte("provided"))
+    kvStore.PutValue(*provided, []byte("value"), nil)
+    if err := kvStore.AddProvider(*provided, NewContact(NewRandomKademliaID(), "localhost", 8000, 8001), time.Minute); err != nil {
+        t.Errorf("expected the provider to be added, got %v", err)
+    }
+
+    // Content is not stored over values
+    if _, err := kvStore.Insert(*valueKey(key), false, []byte("content"), nil); err != DuplicateError {
+        t.Errorf("expected DuplicateError, got %v", err)
+    }
+    if value, err := kvStore.GetValue(*key); err != nil || string(value) != "second" {
+        t.Errorf("expected the value to stay, got %v (%v)", string(value), err)
+    }
+    kvStore.Close()
+}
+
+func TestKVSCompressStore(t *testing.T) {
+    config := DefaultConfig()
+    config.CompressStore = true
+    kvStore, _ := NewKVStore(config)
+    compressible := bytes.Repeat([]byte("compressible "), 1000)
+    random := []byte(NewRandomKademliaID().String())
+    for _, data := range [][]byte{compressible, random} {
+        id := NewKademliaIDFromBytes(data)
+        stored, _ := kvStore.Insert(*id, false, data, nil)
+        if stored.compressed != (len(data) == len(compressible)) {
+            t.Errorf("Expected only compressible data to be compressed")
+        }
+        if found, err := kvStore.Lookup(*id); err != nil || !bytes.Equal(data, found) {
+            t.Errorf("Lookup returned %v bytes instead of %v: %v", len(found), len(data), err)
+        }
+        file, size, err := kvStore.Open(*id)
+        if err != nil || size != int64(len(data)) {
+            t.Fatalf("Open returned size %v instead of %v: %v", size, len(data), err)
+        }
+        found, _ := ioutil.ReadAll(file)
+        if !bytes.Equal(data, found) {
+            t.Errorf("Open returned other data than stored")
+        }
+    }
+    kvStore.Close()
+}
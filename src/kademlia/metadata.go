@@ -0,0 +1,71 @@
+package kademlia
+
+import (
+    "errors"
+    "mime"
+    "net/http"
+    "path/filepath"
+    "time"
+)
+
+// Error states
+var NoMetadataError = errors.New("no metadata stored under hash")
+
+// Kind of metadata blocks, see blockMarker
+const metadataBlock = 3
+
+// What is known about a stored file besides its content
+type Metadata struct {
+    // Original file name, without directories
+    Name     string
+    Size     int64
+    MimeType string
+    ModTime  time.Time
+    // Hash of the content, as returned by Store, StoreCDC or StoreErasure
+    Content KademliaID
+}
+
+// The metadata in block, or nil if it is not a metadata block
+func parseMetadata(block []byte) *Metadata {
+    var m Metadata
+    if !decodeBlock(block, metadataBlock, &m) {
+        return nil
+    }
+    return &m
+}
+
+// The MIME type of a file, from its name if the extension is known, else from its first bytes
+func DetectMimeType(name string, data []byte) string {
+    if mimeType := mime.TypeByExtension(filepath.Ext(name)); mimeType != "" {
+        return mimeType
+    }
+    return http.DetectContentType(data)
+}
+
+// Store metadata for content already stored. Returns the hash of the metadata, which Cat reads like the
+// content itself and Stat describes.
+func (kademlia *Kademlia) StoreMetadata(meta Metadata) (KademliaID, error) {
+    meta.Name = filepath.Base(meta.Name)
+    if !validName(meta.Name) {
+        return KademliaID{}, InvalidNameError
+    }
+    hash, err := kademlia.storeBlock(encodeBlock(metadataBlock, meta))
+    if err != nil {
+        return KademliaID{}, err
+    }
+    kademlia.Republish(&hash)
+    return hash, nil
+}
+
+// The metadata stored under hash
+func (kademlia *Kademlia) Stat(hash *KademliaID) (*Metadata, error) {
+    block, _, err := kademlia.fetchRoot(hash)
+    if err != nil {
+        return nil, err
+    }
+    meta := parseMetadata(block)
+    if meta == nil {
+        return nil, NoMetadataError
+    }
+    return meta, nil
+}
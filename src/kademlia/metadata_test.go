@@ -0,0 +1,52 @@
+package kademlia
+
+import (
+    "testing"
+    "time"
+)
+
+func TestMetadata(t *testing.T) {
+    kademlias := createKademliaMesh(3, 3, nil)
+    owner := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+
+    data := []byte("<html><body>page</body></html>")
+    content, _ := owner.Store(data)
+    modTime := time.Unix(1500000000, 0)
+    hash, err := owner.StoreMetadata(Metadata{Name: "dir/page.html", Size: int64(len(data)),
+        MimeType: DetectMimeType("page.html", data), ModTime: modTime, Content: content})
+    if err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(time.Second)
+
+    meta, err := reader.Stat(&hash)
+    if err != nil || meta.Name != "page.html" || meta.Size != int64(len(data)) || !meta.ModTime.Equal(modTime) ||
+        meta.MimeType != "text/html; charset=utf-8" || !meta.Content.Equals(&content) {
+        t.Errorf("Unexpected metadata %v: %v", meta, err)
+    }
+    if read, err := reader.Cat(&hash); err != nil || string(read) != string(data) {
+        t.Errorf("Cat through metadata returned %v: %v", string(read), err)
+    }
+    if read, meta, err := reader.CatWithMetadata(&hash); err != nil || string(read) != string(data) || meta == nil || meta.Name != "page.html" {
+        t.Errorf("CatWithMetadata returned %v, %v: %v", string(read), meta, err)
+    }
+    if _, err := reader.Stat(&content); err != NoMetadataError {
+        t.Errorf("Expected NoMetadataError, got %v", err)
+    }
+    if read, meta, err := reader.CatWithMetadata(&content); err != nil || string(read) != string(data) || meta != nil {
+        t.Errorf("CatWithMetadata of plain file returned %v, %v: %v", string(read), meta, err)
+    }
+    // A file with the bytes of metadata is still a plain file
+    lookalike := encodeBlock(metadataBlock, Metadata{Name: "page.html", Size: int64(len(data)), Content: content})
+    stored, _ := owner.Store(lookalike)
+    if read, meta, err := owner.CatWithMetadata(&stored); err != nil || string(read) != string(lookalike) || meta != nil {
+        t.Errorf("CatWithMetadata of a metadata lookalike returned %q, %v: %v", read, meta, err)
+    }
+    if mimeType := DetectMimeType("noextension", []byte("%PDF-1.4")); mimeType != "application/pdf" {
+        t.Errorf("Expected the type to be sniffed, got %v", mimeType)
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
@@ -0,0 +1,129 @@
+package kademlia
+
+import (
+    "crypto/sha1"
+    "encoding/hex"
+    "errors"
+    "log"
+)
+
+// Error states
+var InvalidAddressError = errors.New("invalid content address")
+
+// Content addresses are multihashes: a byte naming the hash function, a byte with the length of the
+// digest, then the digest. New content is addressed by SHA-256, whose digest is the whole KademliaID.
+// SHA-1 addresses from before the switch are still understood, see legacy below.
+const (
+    sha1Code   = 0x11
+    sha256Code = 0x12
+)
+
+// Length of a SHA-1 digest. A legacy ID is the digest followed by zeros, which keeps legacy keys spread
+// over the ID space like any other key.
+const legacyLength = sha1.Size
+
+// The legacy ID of data, the 160 bit SHA-1 address it had before SHA-256
+func NewLegacyKademliaID(data []byte) *KademliaID {
+    result := KademliaID{}
+    sum := sha1.Sum(data)
+    copy(result[:], sum[:])
+    return &result
+}
+
+// Whether the ID is a SHA-1 address rather than a SHA-256 one
+func (kademliaID *KademliaID) IsLegacy() bool {
+    for _, b := range kademliaID[legacyLength:] {
+        if b != 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// Whether data is the content addressed by the ID. Only SHA-256 is trusted, legacy IDs never match,
+// they are only read through catLegacy.
+func (kademliaID *KademliaID) Matches(data []byte) bool {
+    return !kademliaID.IsLegacy() && NewKademliaIDFromBytes(data).Equals(kademliaID)
+}
+
+// Whether data is the content a legacy ID addresses
+func (kademliaID *KademliaID) matchesLegacy(data []byte) bool {
+    return kademliaID.IsLegacy() && NewLegacyKademliaID(data).Equals(kademliaID)
+}
+
+// The ID as a multihash
+func (kademliaID *KademliaID) Multihash() []byte {
+    if kademliaID.IsLegacy() {
+        return append([]byte{sha1Code, legacyLength}, kademliaID[:legacyLength]...)
+    }
+    return append([]byte{sha256Code, IDLength}, kademliaID[:]...)
+}
+
+// The ID as a hex encoded multihash, the form addresses are given to users in
+func (kademliaID *KademliaID) Address() string {
+    return hex.EncodeToString(kademliaID.Multihash())
+}
+
+// The ID of a multihash
+func ParseMultihash(multihash []byte) (*KademliaID, error) {
+    result := KademliaID{}
+    switch {
+    case len(multihash) == 2+IDLength && multihash[0] == sha256Code && multihash[1] == IDLength:
+        copy(result[:], multihash[2:])
+    case len(multihash) == 2+legacyLength && multihash[0] == sha1Code && multihash[1] == legacyLength:
+        copy(result[:], multihash[2:])
+    default:
+        return nil, InvalidAddressError
+    }
+    return &result, nil
+}
+
+// The ID of an address given by a user: a hex encoded multihash, a bare hex ID as printed by String,
+// or a bare hex SHA-1 address from before multihashes
+func ParseAddress(address string) (*KademliaID, error) {
+    decoded, err := hex.DecodeString(address)
+    if err != nil {
+        return nil, InvalidAddressError
+    }
+    result := KademliaID{}
+    switch len(decoded) {
+    case IDLength, legacyLength:
+        copy(result[:], decoded)
+        return &result, nil
+    }
+    return ParseMultihash(decoded)
+}
+
+// Put the root of data under its legacy address, so files can still be read by the SHA-1 address they
+// would have had. Anybody can put a value, so the alias is only trusted once the content it leads to
+// matches the legacy address.
+func (kademlia *Kademlia) publishLegacyAddress(data []byte, root *KademliaID) {
+    if !kademlia.Config.LegacyAddresses {
+        return
+    }
+    legacy := NewLegacyKademliaID(data)
+    if err := kademlia.Put(legacy, root.Multihash()); err != nil {
+        log.Printf("%v cannot publish legacy address %v: %v\n", kademlia.Net.Routing.Me.Address, legacy.Address(), err)
+    }
+}
+
+// Read a file by its legacy address, through the alias published when it was stored
+func (kademlia *Kademlia) catLegacy(legacy *KademliaID) ([]byte, error) {
+    alias, err := kademlia.Get(legacy)
+    if err != nil {
+        return nil, err
+    }
+    root, err := ParseMultihash(alias)
+    if err != nil || root.IsLegacy() {
+        return nil, CorruptFileError
+    }
+    data, err := kademlia.Cat(root)
+    if err != nil {
+        return nil, err
+    }
+    if !legacy.matchesLegacy(data) {
+        log.Printf("%v legacy address %v leads to other content\n", kademlia.Net.Routing.Me.Address, legacy.Address())
+        return nil, CorruptFileError
+    }
+    return data, nil
+}
@@ -0,0 +1,78 @@
+package kademlia
+
+import (
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/hex"
+    "testing"
+    "time"
+)
+
+func TestMultihash(t *testing.T) {
+    data := []byte("some content")
+    id := NewKademliaIDFromBytes(data)
+    sum := sha256.Sum256(data)
+    if hex.EncodeToString(sum[:]) != id.String() || id.IsLegacy() || !id.Matches(data) {
+        t.Errorf("Expected the SHA-256 of the data, got %v", id.String())
+    }
+    if address := id.Address(); address != "1220"+id.String() {
+        t.Errorf("Unexpected address %v", address)
+    }
+
+    legacy := NewLegacyKademliaID(data)
+    legacySum := sha1.Sum(data)
+    if !legacy.IsLegacy() || !legacy.matchesLegacy(data) || legacy.matchesLegacy([]byte("other content")) || legacy.Matches(data) {
+        t.Errorf("Unexpected legacy ID %v", legacy.String())
+    }
+    if address := legacy.Address(); address != "1114"+hex.EncodeToString(legacySum[:]) {
+        t.Errorf("Unexpected legacy address %v", address)
+    }
+
+    for _, address := range []string{id.Address(), id.String()} {
+        if parsed, err := ParseAddress(address); err != nil || !parsed.Equals(id) {
+            t.Errorf("%v parsed as %v: %v", address, parsed, err)
+        }
+    }
+    for _, address := range []string{legacy.Address(), hex.EncodeToString(legacySum[:])} {
+        if parsed, err := ParseAddress(address); err != nil || !parsed.Equals(legacy) {
+            t.Errorf("%v parsed as %v: %v", address, parsed, err)
+        }
+    }
+    for _, address := range []string{"", "zz", "1220abcd", "1320" + id.String()} {
+        if _, err := ParseAddress(address); err != InvalidAddressError {
+            t.Errorf("Expected %v to be refused, got %v", address, err)
+        }
+    }
+}
+
+func TestCatLegacyAddress(t *testing.T) {
+    kademlias := createKademliaMesh(3, 3, nil)
+    owner := kademlias[0]
+    reader := kademlias[len(kademlias)-1]
+
+    data := []byte("content which used to be addressed by SHA-1")
+    owner.Store(data)
+    time.Sleep(time.Second)
+
+    if read, err := reader.Cat(NewLegacyKademliaID(data)); err != nil || string(read) != string(data) {
+        t.Errorf("Cat by legacy address returned %v: %v", string(read), err)
+    }
+
+    // An alias leading to other content is refused
+    forged := NewLegacyKademliaID([]byte("forged"))
+    other, _ := owner.Store([]byte("other content"))
+    owner.Put(forged, other.Multihash())
+    if _, err := reader.Cat(forged); err != CorruptFileError {
+        t.Errorf("Expected CorruptFileError, got %v", err)
+    }
+
+    // Content is never fetched by its SHA-1 sum directly, only through a verified alias
+    legacy := NewLegacyKademliaID(data)
+    owner.Net.Store.Insert(*legacy, false, data, nil)
+    if read := reader.Download(legacy, &owner.Net.Routing.Me); len(read) != 0 {
+        t.Errorf("Expected the download of a legacy ID to be refused, got %v", string(read))
+    }
+    for _, k := range kademlias {
+        k.Net.Close()
+    }
+}
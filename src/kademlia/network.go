@@ -2,7 +2,9 @@ package kademlia
 
 import (
     "errors"
+    "io"
     "net"
+    "sync"
     "time"
     "fmt"
     "log"
@@ -16,9 +18,8 @@ const (
     UDP
 )
 
-var ConnectionTimeout = time.Second * 5
-var ConnectionRetryDelay = time.Second
-var ReceiveBufferSize = 1 << 20 // One MB
+// Error states
+var AlreadyListeningError = errors.New("network is already listening")
 
 // Msgpack package requires public variables
 type NetworkMessage struct {
@@ -31,11 +32,27 @@ type NetworkMessage struct {
 type Network struct {
     // If not nil, Listen will channel messages here after processing them
     listenChannel chan NetworkMessage
-    listening     chan bool
+    // Sockets bound by Listen
+    tcpListener net.Listener
+    udpListener net.PacketConn
+    listening   bool
+    // Closed by Close to stop the listener goroutines
+    stop chan bool
+    // Listener goroutines and open TCP connections
+    running *sync.WaitGroup
+    mutex   *sync.Mutex
     // Kademlia routing table
     Routing *RoutingTable
     // <Key, Value> Store
     Store *KVStore
+    // Settings shared with the rest of the node
+    config *Config
+    // Topic subscriptions, see pubsub.go
+    pubSub *pubSub
+    // Trust in the data sent by other nodes, see scoring.go
+    scores *peerScores
+    // Limits and throughput of transfers, see bandwidth.go
+    bandwidth *bandwidth
 }
 
 func (msg *NetworkMessage) String() string {
@@ -53,18 +70,29 @@ func min(a, b int) int {
     return b
 }
 
-// Create a new network and start listening to incoming TCP connections and UDP packets
-func NewNetwork(ip string, tcpPort int, udpPort int) *Network {
+// Create a new network, call Listen to start receiving TCP connections and UDP packets
+func NewNetwork(ip string, tcpPort int, udpPort int, config *Config) (*Network, error) {
+    config, err := checkConfig(config)
+    if err != nil {
+        return nil, err
+    }
     network := new(Network)
+    network.config = config
     // Random ID on network start
-    network.Routing = NewRoutingTable(NewContact(NewKademliaIDRandom(), ip, tcpPort, udpPort))
+    if network.Routing, err = NewRoutingTable(NewContact(NewKademliaIDRandom(), ip, tcpPort, udpPort), config); err != nil {
+        return nil, err
+    }
     // Key value Store
-    network.Store = NewKVStore()
-    // Start listening to UDP socket
-    network.listening = make(chan bool)
-    go network.Listen()
-    <-network.listening
-    return network
+    if network.Store, err = NewKVStore(config); err != nil {
+        return nil, err
+    }
+    network.Store.self = *network.Routing.Me.ID
+    network.pubSub = newPubSub()
+    network.scores = newPeerScores(network.config.BanTime)
+    network.bandwidth = newBandwidth(network.config.bandwidthLimits())
+    network.running = &sync.WaitGroup{}
+    network.mutex = &sync.Mutex{}
+    return network, nil
 }
 
 // Someone sent a ping message, respond to it
@@ -83,7 +111,7 @@ func (network *Network) receiveFindContactMessage(connection net.PacketConn, rem
         log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
         return
     }
-    closestContacts := network.Routing.FindClosestContacts(&findTarget, ReplicationFactor)
+    closestContacts := network.Routing.FindClosestContacts(&findTarget, network.config.ReplicationFactor)
     // Marshal the closest contacts and send them in the response
     closestContactsMsg, err := msgpack.Marshal(closestContacts)
     if err != nil {
@@ -96,32 +124,153 @@ func (network *Network) receiveFindContactMessage(connection net.PacketConn, rem
 
 // Someone wants us to Store a kademlia ID (file hash) along with their contact information in our <key,value> Store
 func (network *Network) receiveStoreDataMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
-    // Store a non-marshalled kademlia id as key (file hash), and marshalled contacts as value (file owners)
+    // The key is a non-marshalled kademlia id (file hash), the sender becomes one of its providers
     var key KademliaID
     err := msgpack.Unmarshal(message.Data, &key)
     if err != nil {
         log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
         return
     }
-    var owners []Contact
-    // Check if we have it
-    if value, err := network.Store.Lookup(key); err == nil {
-        if err := msgpack.Unmarshal(value, &owners); err != nil {
-            // The content of this <key,value> is not a contact list, but a file. Do nothing.
+    err = network.Store.AddProvider(key, message.Origin, network.config.EvictionTime)
+    if err == IsDataError {
+        // The content of this <key,value> is a file, not a provider record. Do nothing.
+        return
+    } else if err == StoreFullError {
+        fmt.Printf("%v is full, refuses provider %v for %v\n", network.Routing.Me.Address, message.Origin.String(), key.String())
+        return
+    } else if err != nil {
+        log.Printf("%v failed to store provider from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    fmt.Printf("%v stored hash key %v from %v\n", network.Routing.Me.Address, key.String(), message.Origin.String())
+}
+
+// The sender no longer provides the data for a key, forget it
+func (network *Network) receiveUnpublishMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var key KademliaID
+    err := msgpack.Unmarshal(message.Data, &key)
+    if err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    if err := network.Store.RemoveProvider(key, message.Origin.ID); err != nil {
+        fmt.Printf("%v has no provider %v for hash %v\n", network.Routing.Me.Address, message.Origin.String(), key.String())
+        return
+    }
+    fmt.Printf("%v removed provider %v for hash %v\n", network.Routing.Me.Address, message.Origin.String(), key.String())
+}
+
+// Someone publishes a signed record, keep it if the signature holds and it is newer than ours
+func (network *Network) receivePutRecordMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    record, err := unmarshalRecord(message.Data)
+    if err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    if err := network.Store.PutRecord(record, nil); err != nil {
+        log.Printf("%v rejected %v from %v: %v\n", network.Routing.Me.Address, record.String(), remote_addr, err)
+        return
+    }
+    fmt.Printf("%v stored %v from %v\n", network.Routing.Me.Address, record.String(), message.Origin.String())
+}
+
+// Someone wants the record stored under a key, reply with an empty message if we have none
+func (network *Network) receiveGetRecordMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var key KademliaID
+    err := msgpack.Unmarshal(message.Data, &key)
+    if err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    msg := NetworkMessage{MsgType: rpc.GET_RECORD_MSG, Origin: network.Routing.Me, RpcID: message.RpcID}
+    if record, err := network.Store.GetRecord(key); err == nil {
+        if msg.Data, err = msgpack.Marshal(record); err != nil {
+            log.Printf("%v failed to marshal %v: %v\n", network.Routing.Me.Address, record.String(), err)
             return
         }
-    } else {
-        owners = []Contact{}
     }
-    owners = append(owners, message.Origin)
-    fmt.Printf("%v has contacts %v for hash %vh\n", network.Routing.Me.Address, owners, key.String())
-    marshaledOwners, err := msgpack.Marshal(owners)
+    go network.SendMessageToUdpConnection(&msg, remote_addr, connection)
+}
+
+// Someone puts a value under a key for us to keep
+func (network *Network) receivePutValueMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var put valueMessage
+    err := msgpack.Unmarshal(message.Data, &put)
     if err != nil {
-        log.Printf("%v failed to marshal value from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
         return
     }
-    network.Store.Insert(key, false, marshaledOwners, nil)
-    fmt.Printf("%v stored hash key %v from %v\n", network.Routing.Me.Address, key.String(), message.Origin.String())
+    if err := network.Store.PutValue(put.Key, put.Value, nil); err != nil {
+        log.Printf("%v rejected value %v from %v: %v\n", network.Routing.Me.Address, put.Key.String(), remote_addr, err)
+        return
+    }
+    fmt.Printf("%v stored value %v from %v\n", network.Routing.Me.Address, put.Key.String(), message.Origin.String())
+}
+
+// Someone wants the value stored under a key, reply with an empty message if we have none
+func (network *Network) receiveGetValueMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var key KademliaID
+    err := msgpack.Unmarshal(message.Data, &key)
+    if err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    msg := NetworkMessage{MsgType: rpc.GET_VALUE_MSG, Origin: network.Routing.Me, RpcID: message.RpcID}
+    if value, err := network.Store.GetValue(key); err == nil {
+        // Wrapped, so that an empty value differs from no value
+        if msg.Data, err = marshalValueMessage(&key, value); err != nil {
+            log.Printf("%v failed to marshal value %v: %v\n", network.Routing.Me.Address, key.String(), err)
+            return
+        }
+    }
+    go network.SendMessageToUdpConnection(&msg, remote_addr, connection)
+}
+
+// Payload of CACHE_DATA_MSG: a key and the contacts known to have its data
+type cacheMessage struct {
+    Key    KademliaID
+    Owners []Contact
+}
+
+// Cached values expire faster the further we are from the key. The lifetime is halved for every contact
+// we know of which is closer to the key than we are.
+func (network *Network) cacheExpiry(key *KademliaID) time.Duration {
+    myDistance := network.Routing.Me.ID.CalcDistance(key)
+    closer := 0
+    for _, contact := range network.Routing.FindClosestContacts(key, network.config.ReplicationFactor) {
+        if contact.distance.Less(myDistance) {
+            closer++
+        }
+    }
+    return network.config.EvictionTime >> uint(closer)
+}
+
+// Someone found a value during a lookup which we did not have, and asks us to cache it
+func (network *Network) receiveCacheDataMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var cached cacheMessage
+    err := msgpack.Unmarshal(message.Data, &cached)
+    if err != nil || len(cached.Owners) == 0 {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    if _, err := network.Store.Lookup(cached.Key); err == nil {
+        // We have the data, or a provider record which lives longer than a cached one
+        return
+    }
+    expiry := network.cacheExpiry(&cached.Key)
+    for _, owner := range cached.Owners {
+        network.Store.AddProvider(cached.Key, owner, expiry)
+    }
+    fmt.Printf("%v cached hash key %v for %v\n", network.Routing.Me.Address, cached.Key.String(), expiry)
+}
+
+// The live providers of hash, or ourselves if we hold the file
+func (network *Network) findOwners(hash KademliaID) ([]Contact, error) {
+    owners, err := network.Store.Providers(hash)
+    if err == IsDataError {
+        return []Contact{network.Routing.Me}, nil
+    }
+    return owners, err
 }
 
 // Someone wants to query our <key,value> Store for a file hash and know which contacts it can be downloaded from
@@ -133,55 +282,89 @@ func (network *Network) receiveFindDataMessage(connection net.PacketConn, remote
         log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
         return
     }
-    // Check if we have it
-    value, err := network.Store.Lookup(hash)
+    // Reply with the owners, or an empty message if we know none
+    msg := NetworkMessage{MsgType: rpc.FIND_DATA_MSG, Origin: network.Routing.Me, RpcID: message.RpcID}
+    owners, err := network.findOwners(hash)
     if err != nil {
-        // Key not in Store, reply with empty message
         fmt.Printf("%v cannot find <key,value> for key=%v\n", network.Routing.Me.Address, hash.String())
-        msg := NetworkMessage{MsgType: rpc.FIND_DATA_MSG, Origin: network.Routing.Me, RpcID: message.RpcID}
         go network.SendMessageToUdpConnection(&msg, remote_addr, connection)
         return
     }
-    // <Key,Value> exists
-    var owners []Contact
-    err = msgpack.Unmarshal(value, &owners)
-    if err != nil {
-        owners = []Contact{network.Routing.Me}
-    }
-    // <Key,Value> exists, and value is the contacts of file owners
     fmt.Printf("%v sends to %v <key,value> pair <%v,%v>\n", network.Routing.Me.Address, remote_addr, hash.String(), owners)
-    msg := NetworkMessage{MsgType: rpc.FIND_DATA_MSG, Origin: network.Routing.Me, RpcID: message.RpcID, Data: value}
+    if msg.Data, err = msgpack.Marshal(owners); err != nil {
+        log.Printf("%v failed to marshal value for %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
     go network.SendMessageToUdpConnection(&msg, remote_addr, connection)
-
 }
 
 // Someone wants to download stored files from us
 func (network *Network) receiveTransferDataMessage(connection net.Conn, message *NetworkMessage) {
-    var hash KademliaID
-    err := msgpack.Unmarshal(message.Data, &hash)
+    var request transferRequest
+    err := msgpack.Unmarshal(message.Data, &request)
+    if err != nil || request.Offset < 0 || request.Length < 0 {
+        log.Printf("%v invalid transfer request from %v: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), err)
+        return
+    }
+    file, size, err := network.Store.Open(request.Hash)
     if err != nil {
-        log.Printf("%v invalid hash from %v: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), err)
+        // Closing without a header tells the peer we do not have it
+        log.Printf("%v cannot find data for %v: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), request.Hash.String())
         return
     }
-    data, err := network.Store.Lookup(hash)
+    defer file.Close()
+    // Clamp the range to the file, a range starting at the end is empty
+    offset := request.Offset
+    if offset > size {
+        offset = size
+    }
+    length := size - offset
+    if request.Length > 0 && request.Length < length {
+        length = request.Length
+    }
+    if _, err := file.Seek(offset, io.SeekStart); err != nil {
+        log.Printf("%v cannot seek in %v: %v\n", network.Routing.Me.Address, request.Hash.String(), err)
+        return
+    }
+    codec := ""
+    if network.config.CompressTransfers {
+        codec = chooseCodec(request.Codecs)
+    }
+    header, err := msgpack.Marshal(transferHeader{Size: size, Offset: offset, Length: length, Codec: codec})
     if err != nil {
-        log.Printf("%v cannot find data for %v: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), hash.String())
+        log.Printf("%v failed to marshal transfer header: %v\n", network.Routing.Me.Address, err)
         return
     }
-    response := NetworkMessage{MsgType: rpc.TRANSFER_DATA_MSG, Origin: network.Routing.Me, RpcID: message.RpcID, Data: data}
+    response := NetworkMessage{MsgType: rpc.TRANSFER_DATA_MSG, Origin: network.Routing.Me, RpcID: message.RpcID, Data: header}
     marshaledResponse, err := msgpack.Marshal(response)
     if err != nil {
         log.Printf("%v invalid hash from %v: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), err)
         return
     }
-    fmt.Printf("%v responds to %v: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), response.String())
-    connection.Write(marshaledResponse)
+    fmt.Printf("%v streams %v bytes from %v to %v\n", network.Routing.Me.Address, length, offset, connection.RemoteAddr().String())
+    connection.SetWriteDeadline(time.Now().Add(network.config.ConnectionTimeout))
+    if err := writeFrame(connection, marshaledResponse); err != nil {
+        log.Printf("%v failed to send to %v: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), err)
+        return
+    }
+    writer, flush, err := compressWriter(connection, codec, network.config.ConnectionTimeout)
+    if err != nil {
+        log.Printf("%v cannot compress with %v: %v\n", network.Routing.Me.Address, codec, err)
+        return
+    }
+    if err := streamTo(connection, writer, file, length, network.config.ConnectionTimeout); err != nil {
+        log.Printf("%v transfer to %v failed: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), err)
+    } else if err := flush(); err != nil {
+        log.Printf("%v transfer to %v failed: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), err)
+    }
 }
 
 // Someone initiated a TCP connection, check if they want to download data from us
 func (network *Network) receiveTCP(connection net.Conn) {
-    buffer := make([]byte, ReceiveBufferSize)
-    _, err := connection.Read(buffer)
+    defer connection.Close()
+    // Do not let a silent peer keep the connection, and Close waiting, forever
+    connection.SetReadDeadline(time.Now().Add(network.config.ConnectionTimeout))
+    buffer, err := readFrame(connection, network.config.ReceiveBufferSize)
     if err != nil {
         log.Printf("%v unreadable TCP message from %v: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), err)
         return
@@ -195,20 +378,28 @@ func (network *Network) receiveTCP(connection net.Conn) {
     // Store the contact that just messaged the node
     network.Routing.AddContact(message.Origin, network.SendPingMessage)
     fmt.Printf("%v received from %v: %v \n", network.Routing.Me.Address, connection.RemoteAddr().String(), message.String())
+    // The first frame is only known to be from the peer once it is read, so it is accounted for afterwards
+    peer := peerName(connection.RemoteAddr())
+    network.bandwidth.wait(peer, false, len(buffer))
+    connection = network.bandwidth.limit(connection, peer, network.config.ConnectionTimeout)
     switch {
     case message.MsgType == rpc.TRANSFER_DATA_MSG:
         network.receiveTransferDataMessage(connection, &message)
+    case message.MsgType == rpc.PUSH_DATA_MSG:
+        network.receivePushDataMessage(connection, &message)
     default:
         log.Printf("%v received unknown message from %v: %v\n", network.Routing.Me.Address, connection.RemoteAddr().String(), message)
     }
-    connection.Close()
 }
 
 // Someone sent us a UDP packet, check if it is an RPC message and handle it in that case
 func (network *Network) receiveUDP(connection net.PacketConn) {
-    buf := make([]byte, ReceiveBufferSize)
+    buf := make([]byte, network.config.ReceiveBufferSize)
     _, remoteAddress, err := connection.ReadFrom(buf)
     if err != nil {
+        if network.closing() {
+            return
+        }
         fmt.Printf("%v UDP read failed from %v: %v\n", network.Routing.Me.Address, remoteAddress, err)
         return
     }
@@ -230,6 +421,30 @@ func (network *Network) receiveUDP(connection net.PacketConn) {
         network.receiveStoreDataMessage(connection, remoteAddress, &message)
     case message.MsgType == rpc.FIND_DATA_MSG:
         network.receiveFindDataMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.CACHE_DATA_MSG:
+        network.receiveCacheDataMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.UNPUBLISH_MSG:
+        network.receiveUnpublishMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.PUT_RECORD_MSG:
+        network.receivePutRecordMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.GET_RECORD_MSG:
+        network.receiveGetRecordMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.PUT_VALUE_MSG:
+        network.receivePutValueMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.GET_VALUE_MSG:
+        network.receiveGetValueMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.SUBSCRIBE_MSG:
+        network.receiveSubscribeMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.UNSUBSCRIBE_MSG:
+        network.receiveUnsubscribeMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.PUBLISH_MSG:
+        network.receivePublishMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.DELIVER_MSG:
+        network.receiveDeliverMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.STORE_DATA_BATCH_MSG:
+        network.receiveStoreBatchMessage(connection, remoteAddress, &message)
+    case message.MsgType == rpc.FIND_DATA_BATCH_MSG:
+        network.receiveFindDataBatchMessage(connection, remoteAddress, &message)
     default:
         log.Printf("%v received unknown message from %v: %v\n", network.Routing.Me.Address, remoteAddress, message)
     }
@@ -238,70 +453,89 @@ func (network *Network) receiveUDP(connection net.PacketConn) {
     }
 }
 
+// Stop listening, then wait for the listener goroutines and open TCP connections to finish
 func (network *Network) Close() {
-    network.listening <- false
-    <-network.listening
+    network.mutex.Lock()
+    defer network.mutex.Unlock()
+    if !network.listening {
+        return
+    }
+    close(network.stop)
+    // Closing the sockets unblocks Accept and ReadFrom
+    network.tcpListener.Close()
+    network.udpListener.Close()
+    network.running.Wait()
+    network.listening = false
     fmt.Printf("%v stopped listening to incoming network messages\n", network.Routing.Me.Address)
 }
 
-// Listen for incoming TCP and UDP connections
-func (network *Network) Listen() {
+// True once Close has been called
+func (network *Network) closing() bool {
+    select {
+    case <-network.stop:
+        return true
+    default:
+        return false
+    }
+}
+
+// Bind the TCP and UDP sockets and handle incoming connections in the background. Port 0 binds to any free
+// port, the ports actually bound are written back to Routing.Me.
+func (network *Network) Listen() error {
+    network.mutex.Lock()
+    defer network.mutex.Unlock()
+    if network.listening {
+        return AlreadyListeningError
+    }
     tcpAddress := network.Routing.Me.Address.IP + ":" + strconv.Itoa(network.Routing.Me.Address.TcpPort)
     udpAddress := network.Routing.Me.Address.IP + ":" + strconv.Itoa(network.Routing.Me.Address.UdpPort)
-    tcpChannel := make(chan bool)
-    udpChannel := make(chan bool)
 
-    // TCP connections
     tcpListen, err := net.Listen("tcp", tcpAddress)
     if err != nil {
-        log.Fatal(err)
+        return err
     }
-    defer tcpListen.Close()
-    go func(channel chan bool) {
+    udpListen, err := net.ListenPacket("udp", udpAddress)
+    if err != nil {
+        tcpListen.Close()
+        return err
+    }
+    network.Routing.Me.Address.TcpPort = tcpListen.Addr().(*net.TCPAddr).Port
+    network.Routing.Me.Address.UdpPort = udpListen.LocalAddr().(*net.UDPAddr).Port
+    network.tcpListener = tcpListen
+    network.udpListener = udpListen
+    network.stop = make(chan bool)
+    network.listening = true
+
+    // TCP connections
+    network.running.Add(1)
+    go func() {
+        defer network.running.Done()
         for {
             connection, err := tcpListen.Accept()
             if err != nil {
-                fmt.Printf("%v TCP read failed: %v\n", network.Routing.Me.Address, err)
+                if !network.closing() {
+                    fmt.Printf("%v TCP read failed: %v\n", network.Routing.Me.Address, err)
+                }
                 return
             }
-            channel <- true
-            go network.receiveTCP(connection)
+            network.running.Add(1)
+            go func() {
+                defer network.running.Done()
+                network.receiveTCP(connection)
+            }()
         }
-    }(tcpChannel)
+    }()
 
     // UDP packets listen
-    udpListen, err := net.ListenPacket("udp", udpAddress)
-    if err != nil {
-        log.Fatal(err)
-    }
-    defer udpListen.Close()
-    go func(channel chan bool) {
-        for {
-            channel <- true
+    network.running.Add(1)
+    go func() {
+        defer network.running.Done()
+        for !network.closing() {
             // Cannot call this in a go routine since UDP has no blocking accept
             network.receiveUDP(udpListen)
         }
-    }(udpChannel)
-
-    // Listen has been called for both UDP and TCP
-    network.listening <- true
-    // Infinite loop listening to TCP and UDP sockets
-    stop := false
-    for {
-        select {
-        case <-tcpChannel:
-            // TCP message received
-        case <-udpChannel:
-            // UDP message received
-        case <-network.listening:
-            // Stop listening
-            stop = true
-        }
-        if stop {
-            break
-        }
-    }
-    network.listening <- false
+    }()
+    return nil
 }
 
 // Send a message over an established UDP connection
@@ -340,7 +574,14 @@ func (network *Network) SendMessage(protocol int, message *NetworkMessage, conta
     }
     fmt.Printf("%v sends to %v: %v\n", network.Routing.Me.Address, contact.Address, message.String())
     msg, err := msgpack.Marshal(message)
-    connection.Write(msg)
+    if protocol == UDP {
+        connection.Write(msg)
+    } else {
+        // Transfers are throttled, other messages go over UDP
+        connection = network.bandwidth.limit(connection, peerName(connection.RemoteAddr()), network.config.ConnectionTimeout)
+        // TCP is a stream, the receiver needs to know where the message ends
+        writeFrame(connection, msg)
+    }
     return connection, nil
 }
 
@@ -351,38 +592,30 @@ func (network *Network) SendReceiveMessage(protocol int, message *NetworkMessage
         return nil
     }
     defer connection.Close()
-    timer := time.NewTimer(ConnectionTimeout)
+    timer := time.NewTimer(network.config.ConnectionTimeout)
     channel := make(chan *NetworkMessage)
     go func(m chan *NetworkMessage) {
         for {
-            buf := make([]byte, ReceiveBufferSize)
+            buf := make([]byte, network.config.ReceiveBufferSize)
             for {
                 n := 0
                 if protocol == UDP {
                     // For UDP connections, just read one datagram (should be an RPC)
                     n, err = connection.Read(buf)
                     if err != nil {
-                        timeout := time.NewTimer(ConnectionRetryDelay)
+                        timeout := time.NewTimer(network.config.ConnectionRetryDelay)
                         <-timeout.C
                         continue
                     }
                 } else {
-                    // For TCP file transfers, we can keep reading until there is no more left
-                    for {
-                        newBuf := make([]byte, ReceiveBufferSize)
-                        newN, err := connection.Read(newBuf)
-                        if newN <= 0 {
-                            break
-                        }
-                        timer.Reset(ConnectionTimeout)
-                        if err != nil {
-                            timeout := time.NewTimer(ConnectionRetryDelay)
-                            <-timeout.C
-                            continue
-                        }
-                        buf = append(buf[:n], newBuf[:newN]...)
-                        n = n + newN
+                    // For TCP, read exactly one frame
+                    buf, err = readFrame(connection, network.config.ReceiveBufferSize)
+                    if err != nil {
+                        log.Printf("%v unreadable TCP message from %v: %v\n", network.Routing.Me.Address, contact.Address, err)
+                        m <- nil
+                        return
                     }
+                    n = len(buf)
                 }
                 timer.Stop()
                 // Unmarshal the message and return it
@@ -430,13 +663,14 @@ func (network *Network) SendPingMessage(contact *Contact) bool {
 }
 
 // Send a Find Node message over UDP. Blocks until response or timeout.
-// Returns closest known contacts to target ID. For bootstrapping purposes, also the ID of the receiver.
-func (network *Network) SendFindContactAndIdMessage(findTarget *KademliaID, receiver *Contact) ([]Contact, KademliaID) {
+// Returns closest known contacts to target ID. For bootstrapping purposes, also the contact of the receiver,
+// which is nil if the receiver did not respond.
+func (network *Network) SendFindContactAndOriginMessage(findTarget *KademliaID, receiver *Contact) ([]Contact, *Contact) {
     // Marshal the contact and Store it in Data byte array later
     findTargetMsg, err := msgpack.Marshal(*findTarget)
     if err != nil {
         log.Printf("%v could not marshal contact: %v\n", network.Routing.Me, err)
-        return []Contact{}, KademliaID{}
+        return []Contact{}, nil
     }
     // Unique id for this RPC
     rpcID := *NewKademliaIDRandom()
@@ -455,16 +689,16 @@ func (network *Network) SendFindContactAndIdMessage(findTarget *KademliaID, rece
         if err != nil {
             log.Printf("%v could not unmarshal contact array: %v\n", network.Routing.Me, err)
         }
-        return newContacts, *response.Origin.ID
+        return newContacts, &response.Origin
     } else if response != nil {
         log.Printf("%v received unknown message %v: %v \n", network.Routing.Me.Address, response.Origin.Address, response.String())
     }
-    return []Contact{}, KademliaID{}
+    return []Contact{}, nil
 }
 
 // Send a Find Node message over UDP. Blocks until response or timeout.
 func (network *Network) SendFindContactMessage(findTarget *KademliaID, receiver *Contact) ([]Contact) {
-    contacts, _ := network.SendFindContactAndIdMessage(findTarget, receiver)
+    contacts, _ := network.SendFindContactAndOriginMessage(findTarget, receiver)
     return contacts
 }
 
@@ -508,31 +742,193 @@ func (network *Network) SendStoreMessage(hash *KademliaID, receiver *Contact) {
     network.SendMessage(UDP, &message, receiver)
 }
 
-// Request a file transfer from message receiver
-func (network *Network) SendDownloadMessage(hash *KademliaID, receiver *Contact) []byte {
+// Tell another node to remove us from the providers of hash
+func (network *Network) SendUnpublishMessage(hash *KademliaID, receiver *Contact) {
     hashMsg, err := msgpack.Marshal(hash)
     if err != nil {
         log.Printf("%v could not marshal kademlia ID %v\n", network.Routing.Me, hash)
+        return
+    }
+    message := NetworkMessage{MsgType: rpc.UNPUBLISH_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: hashMsg}
+    if connection, err := network.SendMessage(UDP, &message, receiver); err == nil {
+        connection.Close()
+    }
+}
+
+// Have another node store a signed record
+func (network *Network) SendPutRecordMessage(record *Record, receiver *Contact) {
+    recordMsg, err := msgpack.Marshal(record)
+    if err != nil {
+        log.Printf("%v could not marshal %v\n", network.Routing.Me, record.String())
+        return
+    }
+    message := NetworkMessage{MsgType: rpc.PUT_RECORD_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: recordMsg}
+    if connection, err := network.SendMessage(UDP, &message, receiver); err == nil {
+        connection.Close()
+    }
+}
+
+// Ask another node for the record stored under key. Returns nil if it has none, or one with a bad signature.
+func (network *Network) SendGetRecordMessage(key *KademliaID, receiver *Contact) *Record {
+    keyMsg, err := msgpack.Marshal(key)
+    if err != nil {
+        log.Printf("%v could not marshal kademlia ID %v\n", network.Routing.Me, key)
+        return nil
+    }
+    message := NetworkMessage{MsgType: rpc.GET_RECORD_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: keyMsg}
+    // Blocks until response
+    response := network.SendReceiveMessage(UDP, &message, receiver)
+    if response == nil || response.MsgType != rpc.GET_RECORD_MSG || len(response.Data) == 0 {
+        return nil
+    }
+    record, err := unmarshalRecord(response.Data)
+    if err != nil || !record.Key().Equals(key) || record.Verify() != nil {
+        log.Printf("%v received invalid record from %v\n", network.Routing.Me.Address, response.Origin.Address)
+        return nil
+    }
+    return record
+}
+
+// Have another node store a value under key
+func (network *Network) SendPutValueMessage(key *KademliaID, value []byte, receiver *Contact) {
+    valueMsg, err := marshalValueMessage(key, value)
+    if err != nil {
+        log.Printf("%v could not marshal value %v\n", network.Routing.Me, key)
+        return
+    }
+    message := NetworkMessage{MsgType: rpc.PUT_VALUE_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: valueMsg}
+    if connection, err := network.SendMessage(UDP, &message, receiver); err == nil {
+        connection.Close()
+    }
+}
+
+// Ask another node for the value stored under key. Returns nil if it has none.
+func (network *Network) SendGetValueMessage(key *KademliaID, receiver *Contact) []byte {
+    keyMsg, err := msgpack.Marshal(key)
+    if err != nil {
+        log.Printf("%v could not marshal kademlia ID %v\n", network.Routing.Me, key)
+        return nil
+    }
+    message := NetworkMessage{MsgType: rpc.GET_VALUE_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: keyMsg}
+    // Blocks until response
+    response := network.SendReceiveMessage(UDP, &message, receiver)
+    if response == nil || response.MsgType != rpc.GET_VALUE_MSG || len(response.Data) == 0 {
+        return nil
+    }
+    var got valueMessage
+    if err := msgpack.Unmarshal(response.Data, &got); err != nil || !got.Key.Equals(key) {
+        log.Printf("%v received invalid value from %v\n", network.Routing.Me.Address, response.Origin.Address)
+        return nil
+    }
+    if got.Value == nil {
+        return []byte{}
+    }
+    return got.Value
+}
+
+// Tell another node to cache <hash,owners> after it missed during a lookup
+func (network *Network) SendCacheMessage(hash *KademliaID, owners []Contact, receiver *Contact) {
+    cacheMsg, err := msgpack.Marshal(cacheMessage{Key: *hash, Owners: owners})
+    if err != nil {
+        log.Printf("%v could not marshal cache message %v\n", network.Routing.Me, hash)
+        return
+    }
+    message := NetworkMessage{MsgType: rpc.CACHE_DATA_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: cacheMsg}
+    if connection, err := network.SendMessage(UDP, &message, receiver); err == nil {
+        connection.Close()
+    }
+}
+
+// Request a file transfer from message receiver. The file is streamed from the connection as it is read,
+// reading it to the end fails with ChecksumError if it does not match the hash. Files are stored in blocks,
+// TransferTooLargeError is returned for anything larger than a block.
+func (network *Network) SendDownloadMessage(hash *KademliaID, receiver *Contact) (io.ReadCloser, error) {
+    reader, header, err := network.sendTransferRequest(hash, receiver, 0, 0)
+    if err != nil {
+        return nil, err
+    }
+    if header.Offset != 0 || header.Length != header.Size {
+        reader.Close()
+        return nil, MalformedTransferError
+    }
+    if header.Size > int64(network.config.BlockSize) {
+        log.Printf("%v refuses %v bytes for %v from %v\n", network.Routing.Me.Address, header.Size, hash.String(), receiver.Address)
+        reader.Close()
+        return nil, TransferTooLargeError
+    }
+    reader.expected = hash
+    return reader, nil
+}
+
+// Request length bytes of a file, starting at offset, or everything after offset if length is 0.
+// Returns the range and the size of the whole file. Ranges are not checked against the hash, that is
+// up to the caller once all ranges are put together.
+func (network *Network) SendDownloadRangeMessage(hash *KademliaID, receiver *Contact, offset int64, length int64) (io.ReadCloser, int64, error) {
+    reader, header, err := network.sendTransferRequest(hash, receiver, offset, length)
+    if err != nil {
+        return nil, 0, err
+    }
+    return reader, header.Size, nil
+}
+
+func (network *Network) sendTransferRequest(hash *KademliaID, receiver *Contact, offset int64, length int64) (*downloadReader, *transferHeader, error) {
+    request := transferRequest{Hash: *hash, Offset: offset, Length: length}
+    if network.config.CompressTransfers {
+        request.Codecs = transferCodecs
+    }
+    requestMsg, err := msgpack.Marshal(request)
+    if err != nil {
+        log.Printf("%v could not marshal kademlia ID %v\n", network.Routing.Me, hash)
+        return nil, nil, err
     }
-    message := NetworkMessage{MsgType: rpc.TRANSFER_DATA_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: hashMsg}
+    message := NetworkMessage{MsgType: rpc.TRANSFER_DATA_MSG, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: requestMsg}
     fmt.Printf("%s message from %v: %v\n", network.Routing.Me.String(), message.Origin.String(), message.String())
 
     // Downloading may fail if graph was cut
-    defer func() {
-        if r := recover(); r != nil {
-            log.Println("Failed to download due to", r)
-        }
-    }()
-    response := network.SendReceiveMessage(TCP, &message, receiver)
-    fmt.Printf("%s downloaded from %v: %v\n", network.Routing.Me.String(), response.Origin.String(), response.String())
-    if response != nil && response.MsgType == rpc.TRANSFER_DATA_MSG && response.RpcID.Equals(&message.RpcID) {
-        // Check that the downloaded file actually matches what was requested
-        if !NewKademliaIDFromBytes(response.Data).Equals(hash) {
-            panic("content checksum failure")
-        } else {
-            fmt.Println("Checksum passed.")
-            return response.Data
-        }
+    connection, err := network.SendMessage(TCP, &message, receiver)
+    if err != nil {
+        return nil, nil, err
+    }
+    connection.SetReadDeadline(time.Now().Add(network.config.ConnectionTimeout))
+    frame, err := readFrame(connection, network.config.ReceiveBufferSize)
+    if err == io.EOF {
+        // Closed without a header, the receiver does not have the file
+        connection.Close()
+        return nil, nil, NotFoundError
+    } else if err != nil {
+        connection.Close()
+        return nil, nil, err
+    }
+    var response NetworkMessage
+    var header transferHeader
+    if err := msgpack.Unmarshal(frame, &response); err != nil || response.MsgType != rpc.TRANSFER_DATA_MSG ||
+        !response.RpcID.Equals(&message.RpcID) || msgpack.Unmarshal(response.Data, &header) != nil ||
+        header.Size < 0 || header.Length < 0 || header.Offset+header.Length > header.Size {
+        log.Printf("%v malformed transfer header from %v\n", network.Routing.Me.Address, receiver.Address)
+        connection.Close()
+        return nil, nil, MalformedTransferError
+    }
+    // The sender clamps the range to the file, anything else would end up in the wrong place of a resumed download
+    expectedOffset := offset
+    if expectedOffset > header.Size {
+        expectedOffset = header.Size
+    }
+    expectedLength := header.Size - expectedOffset
+    if length > 0 && length < expectedLength {
+        expectedLength = length
+    }
+    if header.Offset != expectedOffset || header.Length != expectedLength {
+        log.Printf("%v got bytes %v+%v instead of %v+%v from %v\n", network.Routing.Me.Address, header.Offset, header.Length,
+            expectedOffset, expectedLength, receiver.Address)
+        connection.Close()
+        return nil, nil, MalformedTransferError
+    }
+    fmt.Printf("%s downloads %v bytes from %v\n", network.Routing.Me.String(), header.Length, response.Origin.String())
+    reader, err := newDownloadReader(connection, header.Codec, header.Length, nil, network.config.ConnectionTimeout)
+    if err != nil {
+        log.Printf("%v cannot read %v transfer from %v: %v\n", network.Routing.Me.Address, header.Codec, receiver.Address, err)
+        connection.Close()
+        return nil, nil, err
     }
-    return []byte{}
+    return reader, &header, nil
 }
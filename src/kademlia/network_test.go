@@ -1,12 +1,15 @@
 package kademlia
 
 import (
+    "bytes"
     "testing"
     "fmt"
     "rpc"
     "github.com/vmihailenco/msgpack"
     "io/ioutil"
     "encoding/hex"
+    "strings"
+    "time"
 )
 
 var testPort int = 7000
@@ -16,15 +19,27 @@ func getTestPort() int {
     return testPort
 }
 
+// Create a network on fresh test ports and start listening
+func newTestNetwork(config *Config) *Network {
+    network, err := NewNetwork("127.0.0.1", getTestPort(), getTestPort(), config)
+    if err != nil {
+        panic(err)
+    }
+    if err := network.Listen(); err != nil {
+        panic(err)
+    }
+    return network
+}
+
 func ping(sender *Network, receiver *Contact, c chan bool) {
     c <- sender.SendPingMessage(receiver)
 }
 
 // Test UDP packet pinging between nodes
 func TestUDPing(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node3 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
+    node3 := newTestNetwork(nil)
     // Nodes are now listening to UDP connections
     ping21 := make(chan bool)
     go ping(node2, &node1.Routing.Me, ping21)
@@ -66,8 +81,8 @@ func TestUDPing(t *testing.T) {
 
 // Test sending a ping message between two nodes generates the correct response
 func TestSendReceiveMessage(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
     // This message must get the correct response
     msg := &NetworkMessage{MsgType: rpc.PING_MSG, Origin: node1.Routing.Me, RpcID: *NewKademliaIDRandom()}
     response := node1.SendReceiveMessage(UDP, msg, &node2.Routing.Me)
@@ -80,8 +95,8 @@ func TestSendReceiveMessage(t *testing.T) {
 
 // This UDP message should not generate a response from the other node, it should time out waiting for it.
 func TestSendReceiveMessageTimeoutUDP(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
     // This message should not get a response, so node1 should timeout when listening
     msg := &NetworkMessage{MsgType: rpc.PONG_MSG, Origin: node1.Routing.Me, RpcID: *NewKademliaIDRandom()}
     response := node1.SendReceiveMessage(UDP, msg, &node2.Routing.Me)
@@ -95,8 +110,8 @@ func TestSendReceiveMessageTimeoutUDP(t *testing.T) {
 
 // This TCP message should not generate a response from the other node, it should time out waiting for it.
 func TestSendReceiveMessageTimeoutTCP(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
     // This message should not get a response, so node1 should timeout when listening
     msg := &NetworkMessage{MsgType: rpc.PONG_MSG, Origin: node1.Routing.Me, RpcID: *NewKademliaIDRandom()}
     response := node1.SendReceiveMessage(TCP, msg, &node2.Routing.Me)
@@ -110,8 +125,8 @@ func TestSendReceiveMessageTimeoutTCP(t *testing.T) {
 
 // Test that the correct response is given when finding contacts on other nodes
 func TestSendFindContactMessage(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
     // Do not sort by ID when inputting contacts
     _, contact1 := node2.Routing.AddContact(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000001000000"), "127.0.0.1", getTestPort(), getTestPort()), nil)
     _, contact2 := node2.Routing.AddContact(NewContact(NewKademliaID("FFFFFFFF00000000000000000001000000000000"), "127.0.0.1", getTestPort(), getTestPort()), nil)
@@ -128,7 +143,7 @@ func TestSendFindContactMessage(t *testing.T) {
 
 // Test that UDP based SendReceiveMessage fails correctly on connection failure
 func TestUDPConnectionFail(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
     _, contact := node1.Routing.AddContact(NewContact(NewKademliaIDRandom(), "127.0.0.1", 999998, 999999), nil)
     // Connection will fail since port is invalid. - response should be nil
     msg := &NetworkMessage{MsgType: 0, Origin: node1.Routing.Me, RpcID: *NewKademliaIDRandom()}
@@ -141,8 +156,8 @@ func TestUDPConnectionFail(t *testing.T) {
 
 // Send Store message from one node to another, check if it was received and stored
 func TestSendStoreMessage(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
     node2.listenChannel = make(chan NetworkMessage)
     hash := NewRandomKademliaID()
     // Send Store message
@@ -163,16 +178,62 @@ func TestSendStoreMessage(t *testing.T) {
     node2.Close()
 }
 
+// Unpublishing removes the sender from the provider record, and only the sender
+func TestSendUnpublishMessage(t *testing.T) {
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
+    node2.listenChannel = make(chan NetworkMessage)
+    hash := NewRandomKademliaID()
+    other := NewContact(NewRandomKademliaID(), "127.0.0.1", 1000, 1001)
+    node2.Store.AddProvider(*hash, node1.Routing.Me, time.Minute)
+    node2.Store.AddProvider(*hash, other, time.Minute)
+    node1.SendUnpublishMessage(hash, &node2.Routing.Me)
+    <-node2.listenChannel
+    node2.listenChannel = nil
+    contacts := node1.SendFindDataMessage(hash, &node2.Routing.Me)
+    if len(contacts) != 1 || !contacts[0].ID.Equals(other.ID) {
+        t.Errorf("expected only the other provider, got %v", contacts)
+    }
+    node1.Close()
+    node2.Close()
+}
+
+// Store many hashes with one message, then find them with another
+func TestSendStoreFindBatchMessages(t *testing.T) {
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
+    node2.listenChannel = make(chan NetworkMessage)
+    hashes := []KademliaID{}
+    for i := 0; i < 50; i++ {
+        hashes = append(hashes, *NewRandomKademliaID())
+    }
+    node1.SendStoreBatchMessage(hashes, &node2.Routing.Me)
+    <-node2.listenChannel
+    node2.listenChannel = nil
+
+    unknown := *NewRandomKademliaID()
+    owners := node1.SendFindDataBatchMessage(append(hashes, unknown), &node2.Routing.Me)
+    if len(owners) != len(hashes) {
+        t.Errorf("expected owners for %v hashes, got %v", len(hashes), len(owners))
+    }
+    for _, hash := range hashes {
+        if contacts := owners[hash]; len(contacts) != 1 || !contacts[0].ID.Equals(node1.Routing.Me.ID) {
+            t.Errorf("wrong owners for %v: %v", hash.String(), contacts)
+        }
+    }
+    if _, ok := owners[unknown]; ok {
+        t.Error("got owners for an unknown hash")
+    }
+    node1.Close()
+    node2.Close()
+}
+
 // Put a file hash and file owner into kvStore of node2. See if node1 finds it.
 func TestSendFindDataMessage(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
     hash := NewRandomKademliaID()
-    marshaledContact, err := msgpack.Marshal([]Contact{node1.Routing.Me})
-    if err != nil {
-        t.Fail()
-    }
-    node2.Store.Insert(*hash, false, marshaledContact, nil)
+    node2.Store.AddProvider(*hash, node1.Routing.Me, time.Minute)
     contacts := node1.SendFindDataMessage(hash, &node2.Routing.Me)
     if contacts == nil || len(contacts) == 0 || !contacts[0].Equals(&node1.Routing.Me) {
         t.Fail()
@@ -183,8 +244,8 @@ func TestSendFindDataMessage(t *testing.T) {
 
 // Send Store message from one node to another, find if it was received and stored
 func TestSendStoreFindMessages(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
     node2.listenChannel = make(chan NetworkMessage)
     hash := NewRandomKademliaID()
     // Send Store message
@@ -207,17 +268,55 @@ func TestSendStoreFindMessages(t *testing.T) {
     node2.Close()
 }
 
+// A cache message stores the owners, and the lifetime shrinks for every contact closer to the key
+func TestSendCacheMessage(t *testing.T) {
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
+    node2.listenChannel = make(chan NetworkMessage)
+    hash := NewRandomKademliaID()
+    owner := NewContact(NewKademliaIDRandom(), "127.0.0.1", getTestPort(), getTestPort())
+
+    node1.SendCacheMessage(hash, []Contact{owner}, &node2.Routing.Me)
+    <-node2.listenChannel
+    node2.listenChannel = nil
+    contacts := node1.SendFindDataMessage(hash, &node2.Routing.Me)
+    if len(contacts) != 1 || !contacts[0].Equals(&owner) {
+        t.Fail()
+    }
+
+    // Add a contact right at the key, the lifetime must be halved
+    before := node2.cacheExpiry(hash)
+    node2.Routing.AddContact(NewContact(hash, "127.0.0.1", getTestPort(), getTestPort()), nil)
+    if expiry := node2.cacheExpiry(hash); expiry != before/2 {
+        fmt.Println("Expected half of", before, "got", expiry)
+        t.Fail()
+    }
+    node1.Close()
+    node2.Close()
+}
+
 // Download data by TCP from one node to another
 func TestTcpTransfer(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    // The whole file in one block
+    config := DefaultConfig()
+    config.BlockSize = 8 << 20
+    node1 := newTestNetwork(config)
+    node2 := newTestNetwork(config)
     data, _ := ioutil.ReadFile("test.bin")
     hash := NewKademliaIDFromBytes(data)
     // Store data in node 2, then transfer it to node 1
     node2.Store.Insert(*hash, false, data, nil)
     // Send TCP download request
-    downloadedData := node1.SendDownloadMessage(hash, &node2.Routing.Me)
+    file, err := node1.SendDownloadMessage(hash, &node2.Routing.Me)
+    if err != nil {
+        t.Fatal("download failed:", err)
+    }
+    downloadedData, err := ioutil.ReadAll(file)
+    file.Close()
     // Check if download worked
+    if err != nil {
+        t.Error("download failed:", err)
+    }
     if len(downloadedData) != len(data) {
         t.Fail()
     }
@@ -230,13 +329,149 @@ func TestTcpTransfer(t *testing.T) {
     node2.Close()
 }
 
+// Files larger than the receive buffer are streamed, missing or corrupt files are reported
+func TestTcpTransferStreaming(t *testing.T) {
+    config := DefaultConfig()
+    config.ReceiveBufferSize = 4096
+    config.MaxValueSize = 1024
+    config.BlockSize = 1 << 20
+    node1 := newTestNetwork(config)
+    node2 := newTestNetwork(config)
+    data := make([]byte, 200*config.ReceiveBufferSize)
+    for i := range data {
+        data[i] = byte(i * 7)
+    }
+    hash := NewKademliaIDFromBytes(data)
+    node2.Store.Insert(*hash, false, data, nil)
+
+    file, err := node1.SendDownloadMessage(hash, &node2.Routing.Me)
+    if err != nil {
+        t.Fatal("download failed:", err)
+    }
+    downloadedData, err := ioutil.ReadAll(file)
+    file.Close()
+    if err != nil || !bytes.Equal(data, downloadedData) {
+        t.Errorf("streamed %v of %v bytes: %v", len(downloadedData), len(data), err)
+    }
+
+    if _, err := node1.SendDownloadMessage(NewRandomKademliaID(), &node2.Routing.Me); err != NotFoundError {
+        t.Error("expected NotFoundError for a missing file, got", err)
+    }
+
+    corrupt := NewRandomKademliaID()
+    node2.Store.Insert(*corrupt, false, []byte("not what the hash says"), nil)
+    file, err = node1.SendDownloadMessage(corrupt, &node2.Routing.Me)
+    if err != nil {
+        t.Fatal("download failed:", err)
+    }
+    if _, err := ioutil.ReadAll(file); err != ChecksumError {
+        t.Error("expected ChecksumError for a corrupt file, got", err)
+    }
+    file.Close()
+    node1.Close()
+    node2.Close()
+}
+
+// Ranges are clamped to the file, and are not checked against its hash
+func TestTcpTransferRange(t *testing.T) {
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
+    data := []byte("0123456789")
+    hash := NewKademliaIDFromBytes(data)
+    node2.Store.Insert(*hash, false, data, nil)
+
+    ranges := []struct {
+        offset, length int64
+        expected       string
+    }{{2, 3, "234"}, {7, 0, "789"}, {8, 10, "89"}, {12, 0, ""}}
+    for _, r := range ranges {
+        file, size, err := node1.SendDownloadRangeMessage(hash, &node2.Routing.Me, r.offset, r.length)
+        if err != nil {
+            t.Fatal("range download failed:", err)
+        }
+        got, err := ioutil.ReadAll(file)
+        file.Close()
+        if err != nil || size != int64(len(data)) || string(got) != r.expected {
+            t.Errorf("range %v+%v: expected %q of %v bytes, got %q of %v (%v)", r.offset, r.length, r.expected, len(data), got, size, err)
+        }
+    }
+    node1.Close()
+    node2.Close()
+}
+
+// Answers to another range than the one asked for are refused
+func TestTcpTransferWrongRange(t *testing.T) {
+    node := newTestNetwork(nil)
+    data := []byte("0123456789")
+    hash := NewKademliaIDFromBytes(data)
+    var served int32
+    // Always sends the whole file
+    sender := serveBlocks(map[KademliaID][]byte{*hash: data}, 0, &served)
+
+    for _, r := range []struct{ offset, length int64 }{{3, 0}, {0, 4}} {
+        if _, _, err := node.SendDownloadRangeMessage(hash, &sender, r.offset, r.length); err != MalformedTransferError {
+            t.Errorf("range %v+%v: expected MalformedTransferError, got %v", r.offset, r.length, err)
+        }
+    }
+    if file, size, err := node.SendDownloadRangeMessage(hash, &sender, 0, 0); err != nil || size != int64(len(data)) {
+        t.Errorf("expected the whole file, got %v bytes: %v", size, err)
+    } else {
+        file.Close()
+    }
+    node.Close()
+}
+
+// Transfers are compressed when both sides allow it, the hash still covers the uncompressed bytes
+func TestTcpTransferCompressed(t *testing.T) {
+    plain := DefaultConfig()
+    plain.CompressTransfers = false
+    node1 := newTestNetwork(nil)
+    node2 := newTestNetwork(nil)
+    node3 := newTestNetwork(plain)
+    data := bytes.Repeat([]byte("timestamp,level,message\n"), 10000)
+    hash := NewKademliaIDFromBytes(data)
+    node2.Store.Insert(*hash, false, data, nil)
+    node3.Store.Insert(*hash, false, data, nil)
+
+    for _, sender := range []*Network{node2, node3} {
+        reader, header, err := node1.sendTransferRequest(hash, &sender.Routing.Me, 0, 0)
+        if err != nil {
+            t.Fatal("transfer failed:", err)
+        }
+        reader.expected = hash
+        got, err := ioutil.ReadAll(reader)
+        reader.Close()
+        if err != nil || !bytes.Equal(data, got) {
+            t.Errorf("expected %v bytes, got %v (%v)", len(data), len(got), err)
+        }
+        if expected := map[*Network]string{node2: gzipCodec, node3: ""}[sender]; header.Codec != expected {
+            t.Errorf("expected codec %q, got %q", expected, header.Codec)
+        }
+    }
+    node1.Close()
+    node2.Close()
+    node3.Close()
+}
+
+func TestFrames(t *testing.T) {
+    buffer := &bytes.Buffer{}
+    writeFrame(buffer, []byte("first"))
+    writeFrame(buffer, []byte("second frame"))
+    if frame, err := readFrame(buffer, 100); err != nil || string(frame) != "first" {
+        t.Errorf("expected the first frame, got %v (%v)", string(frame), err)
+    }
+    if _, err := readFrame(buffer, 5); err != FrameTooLargeError {
+        t.Error("expected FrameTooLargeError, got", err)
+    }
+}
+
 // If routing table bucket is full, ping the last contact, if it does not respond, add the contact.
 func TestNetworkAddContactSuccess(t *testing.T) {
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    //node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    id, _ := hex.DecodeString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF")
+    node1 := newTestNetwork(nil)
+    //node2 := newTestNetwork(nil)
+    id, _ := hex.DecodeString(strings.Repeat("FF", IDLength))
     var i int
-    for i = 0; i < ReplicationFactor+1; i++ {
+    for i = 0; i < node1.config.ReplicationFactor+1; i++ {
         // Decrease the new ID to one lower than previous
         newId := make([]byte, len(id))
         copy(newId, id)
@@ -256,18 +491,18 @@ func TestNetworkAddContactSuccess(t *testing.T) {
 // If routing table bucket is full, ping the last contact, if it does respond, do not add the contact.
 func TestNetworkAddContactFail(t *testing.T) {
     var networks []*Network
-    node1 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+    node1 := newTestNetwork(nil)
     networks = append(networks, node1);
-    //node2 := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
-    id, _ := hex.DecodeString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF")
+    //node2 := newTestNetwork(nil)
+    id, _ := hex.DecodeString(strings.Repeat("FF", IDLength))
     var i int
-    for i = 0; i < ReplicationFactor+1; i++ {
+    for i = 0; i < node1.config.ReplicationFactor+1; i++ {
         // Decrease the new ID to one lower than previous
         newId := make([]byte, len(id))
         copy(newId, id)
         newId[len(newId)-1] = id[len(id)-1] - byte(i)
         // Add contact with this ID
-        nodei := NewNetwork("127.0.0.1", getTestPort(), getTestPort())
+        nodei := newTestNetwork(nil)
         networks = append(networks, nodei);
         kademliaId := NewKademliaID(hex.EncodeToString(newId))
         nodei.Routing.mutex.Lock()
@@ -276,7 +511,7 @@ func TestNetworkAddContactFail(t *testing.T) {
         contactWasAdded, _ := node1.Routing.AddContact(nodei.Routing.Me, node1.SendPingMessage)
         // The last contact will be pinged to see if it is alive, since bucket is full.
         // Since the node will respond to ping, it will not be added
-        if i == ReplicationFactor && contactWasAdded {
+        if i == node1.config.ReplicationFactor && contactWasAdded {
             t.Fail()
         }
     }
@@ -284,3 +519,61 @@ func TestNetworkAddContactFail(t *testing.T) {
         network.Close()
     }
 }
+
+// Batch messages, and the answers to them, must fit the receive buffer
+func TestBatchSize(t *testing.T) {
+    config := DefaultConfig()
+    config.ReceiveBufferSize = 1024
+    config.MaxValueSize = 512
+    small := newTestNetwork(config)
+    defer small.Close()
+    keys := make([]KademliaID, small.storeBatchSize())
+    data, _ := msgpack.Marshal(keys)
+    message, _ := msgpack.Marshal(NetworkMessage{MsgType: rpc.STORE_DATA_BATCH_MSG, Origin: small.Routing.Me, RpcID: *NewRandomKademliaID(), Data: data})
+    if len(keys) < 2 || len(message) > config.ReceiveBufferSize {
+        t.Errorf("batch of %v keys takes %v bytes, the buffer holds %v", len(keys), len(message), config.ReceiveBufferSize)
+    }
+
+    config = DefaultConfig()
+    config.ReceiveBufferSize = 64 << 10
+    config.MaxValueSize = 1024
+    large := newTestNetwork(config)
+    defer large.Close()
+    found := make([]findDataEntry, large.findBatchSize())
+    for i := range found {
+        for j := 0; j < config.MaxProviders; j++ {
+            found[i].Owners = append(found[i].Owners, NewContact(NewRandomKademliaID(), "255.255.255.255", 65535, 65535))
+        }
+    }
+    data, _ = msgpack.Marshal(found)
+    message, _ = msgpack.Marshal(NetworkMessage{MsgType: rpc.FIND_DATA_BATCH_MSG, Origin: large.Routing.Me, RpcID: *NewRandomKademliaID(), Data: data})
+    if len(message) > config.ReceiveBufferSize {
+        t.Errorf("answer for %v keys takes %v bytes, the buffer holds %v", len(found), len(message), config.ReceiveBufferSize)
+    }
+
+    near := KademliaID{}
+    near[IDLength-1] = 1
+    far := KademliaID{0x80}
+    if highestBit(&KademliaID{}) != -1 || highestBit(&near) != 0 || highestBit(&far) != IDLength*8-1 {
+        t.Errorf("unexpected highest bits %v, %v, %v", highestBit(&KademliaID{}), highestBit(&near), highestBit(&far))
+    }
+}
+
+// Nothing larger than a block is downloaded, whatever size the sender announces
+func TestTcpTransferTooLarge(t *testing.T) {
+    small := DefaultConfig()
+    small.BlockSize = 32 << 10
+    large := DefaultConfig()
+    large.BlockSize = 1 << 20
+    node1 := newTestNetwork(small)
+    node2 := newTestNetwork(large)
+    data := make([]byte, 100<<10)
+    hash := NewKademliaIDFromBytes(data)
+    node2.Store.Insert(*hash, false, data, nil)
+
+    if _, err := node1.SendDownloadMessage(hash, &node2.Routing.Me); err != TransferTooLargeError {
+        t.Errorf("expected TransferTooLargeError, got %v", err)
+    }
+    node1.Close()
+    node2.Close()
+}
@@ -0,0 +1,261 @@
+package kademlia
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "log"
+    "sync"
+    "time"
+)
+
+// A part still in flight after this many times its expected transfer time is requested from another provider
+const slowPartFactor = 4
+
+// Expected transfer time of a part from a provider whose throughput has not been measured yet
+const unmeasuredPartTime = 2 * time.Second
+
+// How often idle providers check whether an in-flight part has become slow
+const idlePollInterval = 50 * time.Millisecond
+
+// Failures after which a provider is not asked for any more parts
+const maxProviderFailures = 3
+
+// One block being downloaded, and the providers it can be asked from
+type downloadPart struct {
+    hash   KademliaID
+    owners []Contact
+    data   []byte
+    done   bool
+    // Providers currently fetching the part, and when the first of them started
+    fetching map[KademliaID]bool
+    started  time.Time
+    deadline time.Time
+    // Providers which failed to deliver the part
+    failed map[KademliaID]bool
+}
+
+func (part *downloadPart) ownedBy(provider *Contact) bool {
+    for _, owner := range part.owners {
+        if owner.ID.Equals(provider.ID) {
+            return true
+        }
+    }
+    return false
+}
+
+// Whether provider could still be asked for the part, now or once it gets slow
+func (part *downloadPart) servableBy(provider *Contact) bool {
+    return !part.done && part.ownedBy(provider) && !part.failed[*provider.ID] && !part.fetching[*provider.ID]
+}
+
+// Blocks downloaded from several providers at once. Every provider has its own worker which takes the next
+// part it can serve as soon as it is done with the last one, so faster providers end up serving more parts.
+// Parts that fail are retried elsewhere, parts that are slow for the throughput measured so far are
+// requested a second time from an idle provider and whichever copy arrives first is kept.
+type parallelDownload struct {
+    kademlia *Kademlia
+    parts    []*downloadPart
+    // Measured bytes per second of each provider
+    throughput map[KademliaID]float64
+    failures   map[KademliaID]int
+    mutex      sync.Mutex
+}
+
+// Next part for provider, nil if there is none right now. The second value is false once the provider
+// cannot help with any of the remaining parts.
+func (download *parallelDownload) next(provider *Contact) (*downloadPart, bool) {
+    download.mutex.Lock()
+    defer download.mutex.Unlock()
+    if download.failures[*provider.ID] >= maxProviderFailures || download.kademlia.Net.scores.isBanned(provider.ID) {
+        return nil, false
+    }
+    useful := false
+    var slowest *downloadPart
+    for _, part := range download.parts {
+        if !part.servableBy(provider) {
+            continue
+        }
+        useful = true
+        if len(part.fetching) == 0 {
+            download.start(part, provider)
+            return part, true
+        }
+        if time.Now().After(part.deadline) && (slowest == nil || part.started.Before(slowest.started)) {
+            slowest = part
+        }
+    }
+    if slowest != nil {
+        fmt.Printf("%v requests slow block %v again from %v\n", download.kademlia.Net.Routing.Me.Address, slowest.hash.String(), provider.Address)
+        download.start(slowest, provider)
+    }
+    return slowest, useful
+}
+
+// Mark part as being fetched from provider. Called with the mutex held.
+func (download *parallelDownload) start(part *downloadPart, provider *Contact) {
+    now := time.Now()
+    if len(part.fetching) == 0 {
+        part.started = now
+    }
+    part.fetching[*provider.ID] = true
+    expected := unmeasuredPartTime
+    if rate := download.throughput[*provider.ID]; rate > 0 {
+        expected = time.Duration(float64(download.kademlia.Config.BlockSize) / rate * float64(time.Second))
+    }
+    part.deadline = now.Add(slowPartFactor * expected)
+}
+
+func (download *parallelDownload) finish(part *downloadPart, provider *Contact, data []byte, elapsed time.Duration, err error) {
+    download.mutex.Lock()
+    defer download.mutex.Unlock()
+    delete(part.fetching, *provider.ID)
+    if err == ChecksumError {
+        download.kademlia.Net.scores.reportCorrupt(provider)
+    } else if err == nil {
+        download.kademlia.Net.scores.reportGood(provider)
+    }
+    if err != nil {
+        log.Printf("%v could not fetch block %v from %v: %v\n", download.kademlia.Net.Routing.Me.Address, part.hash.String(), provider.Address, err)
+        part.failed[*provider.ID] = true
+        download.failures[*provider.ID]++
+        return
+    }
+    rate := float64(len(data)) / elapsed.Seconds()
+    if previous := download.throughput[*provider.ID]; previous > 0 {
+        rate = (previous + rate) / 2
+    }
+    download.throughput[*provider.ID] = rate
+    if !part.done {
+        part.done = true
+        part.data = data
+    }
+}
+
+func (download *parallelDownload) worker(provider Contact, wait *sync.WaitGroup) {
+    defer wait.Done()
+    for {
+        part, useful := download.next(&provider)
+        if !useful {
+            return
+        }
+        if part == nil {
+            time.Sleep(idlePollInterval)
+            continue
+        }
+        start := time.Now()
+        data, err := download.kademlia.fetchFrom(&part.hash, &provider)
+        download.finish(part, &provider, data, time.Since(start), err)
+    }
+}
+
+// Fetch one whole block from provider. Fails with ChecksumError if it does not match its hash, so corrupt
+// blocks never make it into the store.
+func (kademlia *Kademlia) fetchFrom(hash *KademliaID, provider *Contact) ([]byte, error) {
+    file, err := kademlia.Net.SendDownloadMessage(hash, provider)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    // Whatever the provider announces, a block is never larger than BlockSize
+    limit := int64(kademlia.Config.BlockSize)
+    data := &bytes.Buffer{}
+    if _, err := data.ReadFrom(io.LimitReader(file, limit+1)); err != nil {
+        return nil, err
+    }
+    if int64(data.Len()) > limit {
+        return nil, TransferTooLargeError
+    }
+    return data.Bytes(), nil
+}
+
+// Fetch many blocks in order, spreading them over all of their providers. Fails unless all of them arrive.
+func (kademlia *Kademlia) fetchBlocks(hashes []KademliaID, fallback []Contact) ([][]byte, error) {
+    found := kademlia.collectBlocks(hashes, fallback)
+    blocks := make([][]byte, len(hashes))
+    for i := range hashes {
+        block, ok := found[hashes[i]]
+        if !ok {
+            return nil, NotFoundError
+        }
+        blocks[i] = block
+    }
+    return blocks, nil
+}
+
+// Get as many of the blocks as possible. Blocks we hold are read locally, the others are looked up
+// together, with fallback as extra candidates for all of them.
+func (kademlia *Kademlia) collectBlocks(hashes []KademliaID, fallback []Contact) map[KademliaID][]byte {
+    blocks := make(map[KademliaID][]byte)
+    missing := []KademliaID{}
+    for i := range hashes {
+        if block, err := kademlia.readLocal(&hashes[i]); err == nil {
+            blocks[hashes[i]] = block
+        } else {
+            missing = append(missing, hashes[i])
+        }
+    }
+    if len(missing) == 0 {
+        return blocks
+    }
+    owners := kademlia.LookupDataMany(missing)
+    for _, hash := range missing {
+        owners[hash] = mergeContacts(owners[hash], fallback)
+    }
+    for hash, block := range kademlia.downloadAvailable(missing, owners) {
+        blocks[hash] = block
+    }
+    return blocks
+}
+
+// Download blocks from the given owners in parallel, failing unless all of them arrive
+func (kademlia *Kademlia) downloadBlocks(hashes []KademliaID, owners map[KademliaID][]Contact) (map[KademliaID][]byte, error) {
+    blocks := kademlia.downloadAvailable(hashes, owners)
+    for _, hash := range hashes {
+        if _, ok := blocks[hash]; !ok {
+            return nil, NotFoundError
+        }
+    }
+    return blocks, nil
+}
+
+// Download blocks from the given owners in parallel, returning those which could be found. Downloaded
+// blocks are kept and republished in the background, so we become one of their providers.
+func (kademlia *Kademlia) downloadAvailable(hashes []KademliaID, owners map[KademliaID][]Contact) map[KademliaID][]byte {
+    download := &parallelDownload{kademlia: kademlia, throughput: make(map[KademliaID]float64), failures: make(map[KademliaID]int)}
+    providers := []Contact{}
+    for _, hash := range hashes {
+        part := &downloadPart{hash: hash, fetching: make(map[KademliaID]bool), failed: make(map[KademliaID]bool)}
+        for _, owner := range owners[hash] {
+            if !owner.ID.Equals(kademlia.Net.Routing.Me.ID) && !kademlia.Net.scores.isBanned(owner.ID) {
+                part.owners = append(part.owners, owner)
+            }
+        }
+        providers = mergeContacts(providers, part.owners)
+        download.parts = append(download.parts, part)
+    }
+    fmt.Printf("%v downloads %v blocks from %v providers\n", kademlia.Net.Routing.Me.Address, len(hashes), len(providers))
+
+    wait := &sync.WaitGroup{}
+    for _, provider := range providers {
+        wait.Add(1)
+        go download.worker(provider, wait)
+    }
+    wait.Wait()
+
+    blocks := make(map[KademliaID][]byte)
+    stored := []KademliaID{}
+    for _, part := range download.parts {
+        if part.done {
+            blocks[part.hash] = part.data
+            if hash, err := kademlia.storeBlock(part.data); err == nil {
+                stored = append(stored, hash)
+            }
+        }
+    }
+    if len(stored) > 0 {
+        // Announcing takes a lookup per block, the caller should not have to wait for it
+        kademlia.background(func() { kademlia.RepublishMany(stored) })
+    }
+    return blocks
+}
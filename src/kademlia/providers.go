@@ -0,0 +1,169 @@
+package kademlia
+
+import (
+    "errors"
+    "fmt"
+    "time"
+    "github.com/vmihailenco/msgpack"
+)
+
+// Error states
+var IsDataError = errors.New("value is data, not a provider record")
+
+// One node announcing that it holds the data for a key
+type provider struct {
+    contact Contact
+    expires time.Time
+    // When the node last announced it, providers which stopped announcing go first when the record is full
+    refreshed time.Time
+}
+
+// Drop providers which have expired, keeps the order of the rest
+func (data *kvData) liveProviders(now time.Time) []*provider {
+    live := []*provider{}
+    for _, p := range data.providers {
+        if p.expires.After(now) {
+            live = append(live, p)
+        }
+    }
+    return live
+}
+
+// Contacts of the providers, as sent in FIND_DATA replies
+func providerContacts(providers []*provider) []Contact {
+    contacts := make([]Contact, len(providers))
+    for i, p := range providers {
+        contacts[i] = p.contact
+    }
+    return contacts
+}
+
+// Record that contact provides the data for hash during the next ttl. Providers are deduplicated by ID, so
+// a republish only refreshes the expiry. When the record is full, the provider refreshed longest ago makes room,
+// of those refreshed at the same time the one closest to expiring.
+func (kvStore *KVStore) AddProvider(hash KademliaID, contact Contact, ttl time.Duration) error {
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    if kvStore.mapping == nil {
+        return NotInitializedError
+    }
+    now := time.Now()
+    expires := now.Add(ttl)
+    record, ok := kvStore.mapping[hash]
+    if ok && record.providers == nil {
+        // We hold the data itself, which beats any provider
+        return IsDataError
+    }
+
+    var existing *provider
+    if ok {
+        for _, p := range record.providers {
+            if p.contact.ID.Equals(contact.ID) {
+                existing = p
+            }
+        }
+    }
+    if existing == nil {
+        // Room for one more provider
+        size := providerRecordSize
+        if ok {
+            size += record.size()
+        }
+        if err := kvStore.makeRoom(hash, size); err != nil {
+            return err
+        }
+    }
+    if !ok {
+        record = &kvData{id: hash, providers: []*provider{}, storedAt: now}
+        kvStore.mapping[hash] = record
+    }
+    record.lastRead = now
+
+    if existing != nil {
+        existing.contact = contact
+        existing.refreshed = now
+        if expires.After(existing.expires) {
+            existing.expires = expires
+        }
+    } else {
+        record.providers = record.liveProviders(now)
+        if len(record.providers) >= kvStore.config.MaxProviders {
+            stalest := 0
+            for i, p := range record.providers {
+                if stale := record.providers[stalest]; p.refreshed.Before(stale.refreshed) ||
+                    p.refreshed.Equal(stale.refreshed) && p.expires.Before(stale.expires) {
+                    stalest = i
+                }
+            }
+            fmt.Println("Provider record", hash.String(), "full, dropping", record.providers[stalest].contact.String())
+            record.providers = append(record.providers[:stalest], record.providers[stalest+1:]...)
+        }
+        record.providers = append(record.providers, &provider{contact: contact, expires: expires, refreshed: now})
+    }
+    kvStore.charge(record)
+
+    // The record lives as long as its longest living provider
+    if expires.After(record.evictionTime) {
+        record.evictionTime = expires
+        kvStore.scheduleEviction(record)
+    }
+    kvStore.save(record)
+    return nil
+}
+
+// Forget that id provides the data for hash. The record is removed with its last provider.
+func (kvStore *KVStore) RemoveProvider(hash KademliaID, id *KademliaID) error {
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    record, ok := kvStore.mapping[hash]
+    if !ok {
+        return NotFoundError
+    }
+    if record.providers == nil {
+        return IsDataError
+    }
+    for i, p := range record.providers {
+        if p.contact.ID.Equals(id) {
+            record.providers = append(record.providers[:i], record.providers[i+1:]...)
+            if len(record.providers) == 0 {
+                kvStore.drop(record)
+            } else {
+                kvStore.charge(record)
+                kvStore.save(record)
+            }
+            return nil
+        }
+    }
+    return NotFoundError
+}
+
+// Contacts of the live providers for hash
+func (kvStore *KVStore) Providers(hash KademliaID) ([]Contact, error) {
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    record, ok := kvStore.mapping[hash]
+    if !ok {
+        return nil, NotFoundError
+    }
+    if record.value || record.record != nil {
+        return nil, NotFoundError
+    } else if record.providers == nil {
+        return nil, IsDataError
+    }
+    record.providers = record.liveProviders(time.Now())
+    record.lastRead = time.Now()
+    kvStore.charge(record)
+    if len(record.providers) == 0 {
+        return nil, NotFoundError
+    }
+    return providerContacts(record.providers), nil
+}
+
+// Lookup returns provider records as a marshaled contact list, the same format FIND_DATA replies use
+func (record *kvData) marshalProviders(now time.Time) ([]byte, error) {
+    live := record.liveProviders(now)
+    if len(live) == 0 {
+        return nil, NotFoundError
+    }
+    return msgpack.Marshal(providerContacts(live))
+}
@@ -0,0 +1,109 @@
+package kademlia
+
+import (
+    "testing"
+    "time"
+)
+
+// Announcing the same provider twice keeps one entry
+func TestProvidersDeduplicate(t *testing.T) {
+    kvStore, _ := NewKVStore(nil)
+    hash := NewRandomKademliaID()
+    contact := NewContact(NewRandomKademliaID(), "127.0.0.1", 1000, 1001)
+    kvStore.AddProvider(*hash, contact, time.Minute)
+    kvStore.AddProvider(*hash, contact, time.Minute)
+    providers, err := kvStore.Providers(*hash)
+    if err != nil || len(providers) != 1 || !providers[0].ID.Equals(contact.ID) {
+        t.Errorf("expected one provider, got %v (%v)", providers, err)
+    }
+    kvStore.Close()
+}
+
+// A provider which is not refreshed expires, while the others stay
+func TestProvidersExpire(t *testing.T) {
+    kvStore, _ := NewKVStore(nil)
+    hash := NewRandomKademliaID()
+    short := NewContact(NewRandomKademliaID(), "127.0.0.1", 1000, 1001)
+    long := NewContact(NewRandomKademliaID(), "127.0.0.1", 1002, 1003)
+    kvStore.AddProvider(*hash, short, time.Second)
+    kvStore.AddProvider(*hash, long, 3*time.Second)
+
+    time.Sleep(2 * time.Second)
+    providers, err := kvStore.Providers(*hash)
+    if err != nil || len(providers) != 1 || !providers[0].ID.Equals(long.ID) {
+        t.Errorf("expected only the long lived provider, got %v (%v)", providers, err)
+    }
+    time.Sleep(2 * time.Second)
+    if _, err := kvStore.Providers(*hash); err != NotFoundError {
+        t.Errorf("expected the record to be gone, got %v", err)
+    }
+    kvStore.Close()
+}
+
+// A full record drops the provider refreshed longest ago, and of those refreshed together the one closest to expiring
+func TestProvidersCapped(t *testing.T) {
+    config := DefaultConfig()
+    config.MaxProviders = 2
+    kvStore, _ := NewKVStore(config)
+    hash := NewRandomKademliaID()
+    first := NewContact(NewRandomKademliaID(), "127.0.0.1", 1000, 1001)
+    second := NewContact(NewRandomKademliaID(), "127.0.0.1", 1002, 1003)
+    third := NewContact(NewRandomKademliaID(), "127.0.0.1", 1004, 1005)
+    kvStore.AddProvider(*hash, first, time.Hour)
+    time.Sleep(10 * time.Millisecond)
+    kvStore.AddProvider(*hash, second, time.Hour)
+    time.Sleep(10 * time.Millisecond)
+    // Announced again, the second provider is now the stalest even though it expires last
+    kvStore.AddProvider(*hash, first, time.Minute)
+    kvStore.AddProvider(*hash, third, time.Hour)
+    providers, _ := kvStore.Providers(*hash)
+    if len(providers) != 2 || !providers[0].ID.Equals(first.ID) || !providers[1].ID.Equals(third.ID) {
+        t.Errorf("expected the first and third provider, got %v", providers)
+    }
+
+    // Refreshed at the same time, the one closest to expiring goes
+    kvStore.mutex.Lock()
+    record := kvStore.mapping[*hash]
+    record.providers[1].refreshed = record.providers[0].refreshed
+    kvStore.mutex.Unlock()
+    kvStore.AddProvider(*hash, second, time.Hour)
+    providers, _ = kvStore.Providers(*hash)
+    if len(providers) != 2 || !providers[0].ID.Equals(third.ID) || !providers[1].ID.Equals(second.ID) {
+        t.Errorf("expected the third and second provider, got %v", providers)
+    }
+    kvStore.Close()
+}
+
+// Holding the data itself is never replaced by a provider record
+func TestProvidersOfData(t *testing.T) {
+    kvStore, _ := NewKVStore(nil)
+    data := []byte("Some data")
+    hash := NewKademliaIDFromBytes(data)
+    kvStore.Insert(*hash, false, data, nil)
+    contact := NewContact(NewRandomKademliaID(), "127.0.0.1", 1000, 1001)
+    if err := kvStore.AddProvider(*hash, contact, time.Minute); err != IsDataError {
+        t.Errorf("expected IsDataError, got %v", err)
+    }
+    if value, _ := kvStore.Lookup(*hash); string(value) != string(data) {
+        t.Errorf("data was replaced by %v", value)
+    }
+    kvStore.Close()
+}
+
+// Removing the last provider removes the record
+func TestRemoveProvider(t *testing.T) {
+    kvStore, _ := NewKVStore(nil)
+    hash := NewRandomKademliaID()
+    contact := NewContact(NewRandomKademliaID(), "127.0.0.1", 1000, 1001)
+    kvStore.AddProvider(*hash, contact, time.Minute)
+    if err := kvStore.RemoveProvider(*hash, NewRandomKademliaID()); err != NotFoundError {
+        t.Errorf("expected NotFoundError for an unknown provider, got %v", err)
+    }
+    if err := kvStore.RemoveProvider(*hash, contact.ID); err != nil {
+        t.Errorf("failed to remove provider: %v", err)
+    }
+    if _, err := kvStore.Lookup(*hash); err != NotFoundError {
+        t.Errorf("expected the record to be gone, got %v", err)
+    }
+    kvStore.Close()
+}
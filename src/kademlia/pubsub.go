@@ -0,0 +1,288 @@
+package kademlia
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "sync"
+    "time"
+    "github.com/vmihailenco/msgpack"
+    "rpc"
+)
+
+// Error states
+var MessageTooLargeError = errors.New("message is larger than the configured limit")
+
+// A message published to a topic. The ID lets subscribers drop the copies sent by each of the k topic nodes.
+type TopicMessage struct {
+    ID      KademliaID
+    Topic   KademliaID
+    Payload []byte
+}
+
+// Messages for one topic arrive on the channel until Unsubscribe is called
+type Subscription struct {
+    Topic    KademliaID
+    Messages chan TopicMessage
+    stop     chan bool
+    // Unsubscribing happens once, however often Unsubscribe is called
+    unsubscribed *sync.Once
+}
+
+// Topics are addressed by the hash of their name, like keys for values
+func TopicFromName(name string) *KademliaID {
+    return NewKademliaIDFromBytes([]byte("topic:" + name))
+}
+
+// Publish/subscribe state of a node: the subscribers it fans out to, since it is one of the k nodes closest
+// to their topic, and the subscriptions of its own applications
+type pubSub struct {
+    hosted map[KademliaID][]*provider
+    local  map[KademliaID][]*Subscription
+    // Message IDs delivered lately, with the time they were first seen
+    seen  map[KademliaID]time.Time
+    mutex *sync.Mutex
+}
+
+func newPubSub() *pubSub {
+    return &pubSub{
+        hosted: make(map[KademliaID][]*provider),
+        local:  make(map[KademliaID][]*Subscription),
+        seen:   make(map[KademliaID]time.Time),
+        mutex:  &sync.Mutex{},
+    }
+}
+
+// Add or refresh a subscriber for a topic we host
+func (ps *pubSub) addSubscriber(topic KademliaID, contact Contact, ttl time.Duration) {
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+    now := time.Now()
+    live := []*provider{}
+    for _, p := range ps.hosted[topic] {
+        if p.expires.After(now) && !p.contact.ID.Equals(contact.ID) {
+            live = append(live, p)
+        }
+    }
+    ps.hosted[topic] = append(live, &provider{contact: contact, expires: now.Add(ttl), refreshed: now})
+}
+
+func (ps *pubSub) removeSubscriber(topic KademliaID, id *KademliaID) {
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+    live := []*provider{}
+    for _, p := range ps.hosted[topic] {
+        if !p.contact.ID.Equals(id) {
+            live = append(live, p)
+        }
+    }
+    if len(live) == 0 {
+        delete(ps.hosted, topic)
+    } else {
+        ps.hosted[topic] = live
+    }
+}
+
+// Live subscribers of a hosted topic
+func (ps *pubSub) subscribers(topic KademliaID) []Contact {
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+    live := []*provider{}
+    for _, p := range ps.hosted[topic] {
+        if p.expires.After(time.Now()) {
+            live = append(live, p)
+        }
+    }
+    if len(live) == 0 {
+        delete(ps.hosted, topic)
+    } else {
+        ps.hosted[topic] = live
+    }
+    return providerContacts(live)
+}
+
+// Hand a message to the local subscriptions of its topic, unless it was delivered before.
+// Slow readers lose messages rather than block the network.
+func (ps *pubSub) deliver(message TopicMessage, remember time.Duration) {
+    ps.mutex.Lock()
+    defer ps.mutex.Unlock()
+    now := time.Now()
+    for id, at := range ps.seen {
+        if now.Sub(at) > remember {
+            delete(ps.seen, id)
+        }
+    }
+    if _, ok := ps.seen[message.ID]; ok {
+        return
+    }
+    ps.seen[message.ID] = now
+    for _, sub := range ps.local[message.Topic] {
+        select {
+        case sub.Messages <- message:
+        default:
+            log.Printf("subscription to %v is full, dropping message %v\n", message.Topic.String(), message.ID.String())
+        }
+    }
+}
+
+// Someone wants messages published to a topic we are close to
+func (network *Network) receiveSubscribeMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var topic KademliaID
+    if err := msgpack.Unmarshal(message.Data, &topic); err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    network.pubSub.addSubscriber(topic, message.Origin, network.config.SubscriptionTime)
+    fmt.Printf("%v subscribed %v to topic %v\n", network.Routing.Me.Address, message.Origin.String(), topic.String())
+}
+
+func (network *Network) receiveUnsubscribeMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var topic KademliaID
+    if err := msgpack.Unmarshal(message.Data, &topic); err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    network.pubSub.removeSubscriber(topic, message.Origin.ID)
+}
+
+// Someone publishes to a topic we are close to, fan the message out to its subscribers
+func (network *Network) receivePublishMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var published TopicMessage
+    if err := msgpack.Unmarshal(message.Data, &published); err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    if len(published.Payload) > network.config.MaxValueSize {
+        log.Printf("%v drops message of %v bytes from %v\n", network.Routing.Me.Address, len(published.Payload), remote_addr)
+        return
+    }
+    // We may be subscribed ourselves, nobody delivers to us but us
+    network.pubSub.deliver(published, network.config.SubscriptionTime)
+    subscribers := network.pubSub.subscribers(published.Topic)
+    fmt.Printf("%v fans out %v to %v subscribers\n", network.Routing.Me.Address, published.ID.String(), len(subscribers))
+    for i := range subscribers {
+        network.sendOneWay(rpc.DELIVER_MSG, message.Data, &subscribers[i])
+    }
+}
+
+// A message to a topic we subscribed to
+func (network *Network) receiveDeliverMessage(connection net.PacketConn, remote_addr net.Addr, message *NetworkMessage) {
+    var delivered TopicMessage
+    if err := msgpack.Unmarshal(message.Data, &delivered); err != nil {
+        log.Printf("%v malformed message from %v: %v\n", network.Routing.Me.Address, remote_addr, err)
+        return
+    }
+    network.pubSub.deliver(delivered, network.config.SubscriptionTime)
+}
+
+// Send a message which expects no answer, data is sent as is
+func (network *Network) sendOneWay(msgType int, data []byte, receiver *Contact) {
+    message := NetworkMessage{MsgType: msgType, Origin: network.Routing.Me, RpcID: *NewKademliaIDRandom(), Data: data}
+    if connection, err := network.SendMessage(UDP, &message, receiver); err == nil {
+        connection.Close()
+    }
+}
+
+// Ask receiver to send us the messages published to topic for the next subscription time
+func (network *Network) SendSubscribeMessage(topic *KademliaID, receiver *Contact) {
+    topicMsg, err := msgpack.Marshal(topic)
+    if err != nil {
+        log.Printf("%v could not marshal kademlia ID %v\n", network.Routing.Me, topic)
+        return
+    }
+    network.sendOneWay(rpc.SUBSCRIBE_MSG, topicMsg, receiver)
+}
+
+func (network *Network) SendUnsubscribeMessage(topic *KademliaID, receiver *Contact) {
+    topicMsg, err := msgpack.Marshal(topic)
+    if err != nil {
+        log.Printf("%v could not marshal kademlia ID %v\n", network.Routing.Me, topic)
+        return
+    }
+    network.sendOneWay(rpc.UNSUBSCRIBE_MSG, topicMsg, receiver)
+}
+
+// Have receiver fan a message out to the subscribers of its topic
+func (network *Network) SendPublishMessage(message *TopicMessage, receiver *Contact) {
+    publishMsg, err := msgpack.Marshal(message)
+    if err != nil {
+        log.Printf("%v could not marshal topic message %v\n", network.Routing.Me, message.ID.String())
+        return
+    }
+    network.sendOneWay(rpc.PUBLISH_MSG, publishMsg, receiver)
+}
+
+// Receive the messages published to topic. The subscription is registered on the k nodes closest to the topic,
+// and renewed there until Unsubscribe or Stop is called. Nothing is registered once the node is stopped.
+func (kademlia *Kademlia) Subscribe(topic *KademliaID) *Subscription {
+    sub := &Subscription{Topic: *topic, Messages: make(chan TopicMessage, 16), stop: make(chan bool), unsubscribed: &sync.Once{}}
+    ps := kademlia.Net.pubSub
+    ps.mutex.Lock()
+    ps.local[*topic] = append(ps.local[*topic], sub)
+    ps.mutex.Unlock()
+
+    kademlia.background(func() {
+        for {
+            fmt.Printf("%v subscribes to %v\n", kademlia.Net.Routing.Me.Address, topic.String())
+            for _, contact := range kademlia.LookupContact(topic) {
+                kademlia.Net.SendSubscribeMessage(topic, &contact)
+            }
+            // Renew well before the topic nodes forget us
+            select {
+            case <-time.After(kademlia.Config.SubscriptionTime / 2):
+            case <-sub.stop:
+                return
+            case <-kademlia.stop:
+                return
+            }
+        }
+    })
+    return sub
+}
+
+// Stop receiving messages for a subscription and close its channel. Calling it again does nothing.
+func (kademlia *Kademlia) Unsubscribe(sub *Subscription) {
+    sub.unsubscribed.Do(func() { kademlia.unsubscribe(sub) })
+}
+
+func (kademlia *Kademlia) unsubscribe(sub *Subscription) {
+    ps := kademlia.Net.pubSub
+    ps.mutex.Lock()
+    subs := []*Subscription{}
+    for _, other := range ps.local[sub.Topic] {
+        if other != sub {
+            subs = append(subs, other)
+        }
+    }
+    if len(subs) == 0 {
+        delete(ps.local, sub.Topic)
+    } else {
+        ps.local[sub.Topic] = subs
+    }
+    close(sub.stop)
+    close(sub.Messages)
+    ps.mutex.Unlock()
+
+    // Other subscriptions on this node keep the topic nodes sending
+    if len(subs) == 0 {
+        for _, contact := range kademlia.LookupContact(&sub.Topic) {
+            kademlia.Net.SendUnsubscribeMessage(&sub.Topic, &contact)
+        }
+    }
+}
+
+// Send payload to every subscriber of topic, through the k nodes closest to it. Payloads are limited to
+// MaxValueSize, like values.
+func (kademlia *Kademlia) Publish(topic *KademliaID, payload []byte) error {
+    if len(payload) > kademlia.Config.MaxValueSize {
+        return MessageTooLargeError
+    }
+    message := &TopicMessage{ID: *NewKademliaIDRandom(), Topic: *topic, Payload: payload}
+    fmt.Printf("%v publishes %v to topic %v\n", kademlia.Net.Routing.Me.Address, message.ID.String(), topic.String())
+    kademlia.Net.pubSub.deliver(*message, kademlia.Config.SubscriptionTime)
+    for _, contact := range kademlia.LookupContact(topic) {
+        kademlia.Net.SendPublishMessage(message, &contact)
+    }
+    return nil
+}
@@ -0,0 +1,124 @@
+package kademlia
+
+import (
+    "crypto/ed25519"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "time"
+    "github.com/vmihailenco/msgpack"
+)
+
+// Error states
+var InvalidSignatureError = errors.New("record signature does not match")
+var StaleRecordError = errors.New("record is older than the one stored")
+var NotARecordError = errors.New("value is not a signed record")
+
+// A mutable value published under the hash of a public key. Publishing a new value means signing it with
+// a higher sequence number, nodes only keep the highest one they have seen.
+type Record struct {
+    PublicKey []byte
+    Sequence  uint64
+    Value     []byte
+    Signature []byte
+}
+
+// Sign value as the sequence'th version of the record belonging to privateKey
+func NewRecord(privateKey ed25519.PrivateKey, sequence uint64, value []byte) *Record {
+    record := &Record{
+        PublicKey: privateKey.Public().(ed25519.PublicKey),
+        Sequence:  sequence,
+        Value:     value,
+    }
+    record.Signature = ed25519.Sign(privateKey, record.signedBytes())
+    return record
+}
+
+// The name of a record, stable across versions
+func RecordKey(publicKey ed25519.PublicKey) *KademliaID {
+    return NewKademliaIDFromBytes(publicKey)
+}
+
+func (record *Record) Key() *KademliaID {
+    return RecordKey(record.PublicKey)
+}
+
+// Everything but the signature, the sequence number is fixed size so fields cannot run into each other
+func (record *Record) signedBytes() []byte {
+    signed := make([]byte, 0, len(record.PublicKey)+8+len(record.Value))
+    signed = append(signed, record.PublicKey...)
+    signed = binary.BigEndian.AppendUint64(signed, record.Sequence)
+    return append(signed, record.Value...)
+}
+
+// Check that the record was signed by the owner of its public key
+func (record *Record) Verify() error {
+    if len(record.PublicKey) != ed25519.PublicKeySize ||
+        !ed25519.Verify(record.PublicKey, record.signedBytes(), record.Signature) {
+        return InvalidSignatureError
+    }
+    return nil
+}
+
+func (record *Record) String() string {
+    return fmt.Sprintf(`record(key=%v, seq=%v, value=%.20v)`, record.Key().String(), record.Sequence, string(record.Value))
+}
+
+func unmarshalRecord(data []byte) (*Record, error) {
+    var record Record
+    if err := msgpack.Unmarshal(data, &record); err != nil || record.PublicKey == nil {
+        return nil, NotARecordError
+    }
+    return &record, nil
+}
+
+// Store a record after checking its signature. A record is only replaced by one with a higher sequence number,
+// it is evicted unless its publisher puts it again within the eviction time.
+func (kvStore *KVStore) PutRecord(record *Record, republishFunc func(*KademliaID)) error {
+    if err := record.Verify(); err != nil {
+        return err
+    }
+    data, err := msgpack.Marshal(record)
+    if err != nil {
+        return err
+    }
+    key := *record.Key()
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    if kvStore.mapping == nil {
+        return NotInitializedError
+    }
+    kvStore.waitWrites(key)
+    if current, ok := kvStore.mapping[key]; ok {
+        if current.record == nil {
+            // Not a record, the key is taken by data or providers
+            return DuplicateError
+        }
+        if current.record.Sequence > record.Sequence {
+            return StaleRecordError
+        }
+    }
+    stored := &kvData{id: key, record: record, evictionTime: time.Now().Add(kvStore.config.EvictionTime),
+        republishTime: time.Now().Add(kvStore.config.RepublishTime), republishFunc: republishFunc}
+    if err := kvStore.put(stored, data); err != nil {
+        return err
+    }
+    kvStore.scheduleEviction(stored)
+    kvStore.scheduleRepublish(stored)
+    return nil
+}
+
+// The stored record with key, if any
+func (kvStore *KVStore) GetRecord(key KademliaID) (*Record, error) {
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    stored, ok := kvStore.mapping[key]
+    if !ok {
+        return nil, NotFoundError
+    }
+    if stored.record == nil {
+        return nil, NotARecordError
+    }
+    stored.lastRead = time.Now()
+    return stored.record, nil
+}
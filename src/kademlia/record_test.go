@@ -0,0 +1,51 @@
+package kademlia
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "testing"
+)
+
+func TestRecordVerify(t *testing.T) {
+    _, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+    record := NewRecord(privateKey, 1, []byte("first"))
+    if err := record.Verify(); err != nil {
+        t.Error("valid record rejected:", err)
+    }
+    record.Value = []byte("forged")
+    if err := record.Verify(); err != InvalidSignatureError {
+        t.Error("expected InvalidSignatureError for changed value, got", err)
+    }
+    record = NewRecord(privateKey, 1, []byte("first"))
+    record.Sequence = 2
+    if err := record.Verify(); err != InvalidSignatureError {
+        t.Error("expected InvalidSignatureError for changed sequence, got", err)
+    }
+}
+
+// Only newer sequence numbers replace a stored record
+func TestKVSPutRecord(t *testing.T) {
+    kvStore, _ := NewKVStore(nil)
+    _, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+    first := NewRecord(privateKey, 1, []byte("first"))
+    second := NewRecord(privateKey, 2, []byte("second"))
+
+    if err := kvStore.PutRecord(second, nil); err != nil {
+        t.Error("failed to store record:", err)
+    }
+    if err := kvStore.PutRecord(first, nil); err != StaleRecordError {
+        t.Error("expected StaleRecordError, got", err)
+    }
+    forged := NewRecord(privateKey, 3, []byte("third"))
+    forged.Value = []byte("forged")
+    if err := kvStore.PutRecord(forged, nil); err != InvalidSignatureError {
+        t.Error("expected InvalidSignatureError, got", err)
+    }
+    if record, err := kvStore.GetRecord(*first.Key()); err != nil || string(record.Value) != "second" {
+        t.Errorf("expected the second record, got %v (%v)", record, err)
+    }
+    if _, err := kvStore.Insert(*first.Key(), false, []byte("content"), nil); err != DuplicateError {
+        t.Errorf("expected content not to replace the record, got %v", err)
+    }
+    kvStore.Close()
+}
@@ -0,0 +1,190 @@
+package kademlia
+
+import (
+    "errors"
+)
+
+// Error states
+var InvalidShardsError = errors.New("invalid number of data or parity shards")
+var NotEnoughShardsError = errors.New("not enough shards left to rebuild the data")
+var SingularMatrixError = errors.New("matrix is not invertible")
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1, through log and exp tables
+var gfExp [510]byte
+var gfLog [256]int
+
+func init() {
+    x := 1
+    for i := 0; i < 255; i++ {
+        gfExp[i] = byte(x)
+        gfLog[x] = i
+        x <<= 1
+        if x&0x100 != 0 {
+            x ^= 0x11d
+        }
+    }
+    // Saves a modulo in gfMul
+    for i := 255; i < len(gfExp); i++ {
+        gfExp[i] = gfExp[i-255]
+    }
+}
+
+func gfMul(a byte, b byte) byte {
+    if a == 0 || b == 0 {
+        return 0
+    }
+    return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInverse(a byte) byte {
+    return gfExp[255-gfLog[a]]
+}
+
+func gfPow(a byte, n int) byte {
+    result := byte(1)
+    for i := 0; i < n; i++ {
+        result = gfMul(result, a)
+    }
+    return result
+}
+
+// Invert a square matrix with Gauss-Jordan elimination
+func invertMatrix(matrix [][]byte) ([][]byte, error) {
+    size := len(matrix)
+    // The matrix with the identity to its right, reduced until the left half is the identity
+    work := make([][]byte, size)
+    for i := range matrix {
+        work[i] = make([]byte, 2*size)
+        copy(work[i], matrix[i])
+        work[i][size+i] = 1
+    }
+    for col := 0; col < size; col++ {
+        pivot := col
+        for pivot < size && work[pivot][col] == 0 {
+            pivot++
+        }
+        if pivot == size {
+            return nil, SingularMatrixError
+        }
+        work[col], work[pivot] = work[pivot], work[col]
+        scale := gfInverse(work[col][col])
+        for j := range work[col] {
+            work[col][j] = gfMul(work[col][j], scale)
+        }
+        for row := 0; row < size; row++ {
+            if row == col || work[row][col] == 0 {
+                continue
+            }
+            factor := work[row][col]
+            for j := range work[row] {
+                work[row][j] ^= gfMul(factor, work[col][j])
+            }
+        }
+    }
+    inverse := make([][]byte, size)
+    for i := range work {
+        inverse[i] = work[i][size:]
+    }
+    return inverse, nil
+}
+
+func multiplyMatrix(a [][]byte, b [][]byte) [][]byte {
+    result := make([][]byte, len(a))
+    for i := range a {
+        result[i] = make([]byte, len(b[0]))
+        for j := range b[0] {
+            for k := range b {
+                result[i][j] ^= gfMul(a[i][k], b[k][j])
+            }
+        }
+    }
+    return result
+}
+
+// A systematic Reed-Solomon code: the data shards are kept as they are, and any dataShards of the
+// dataShards+parityShards shards are enough to get them back
+type reedSolomon struct {
+    dataShards   int
+    parityShards int
+    // One row per shard, the top dataShards rows are the identity
+    matrix [][]byte
+}
+
+func newReedSolomon(dataShards int, parityShards int) (*reedSolomon, error) {
+    total := dataShards + parityShards
+    if dataShards < 1 || parityShards < 1 || total > 256 {
+        return nil, InvalidShardsError
+    }
+    // Any dataShards rows of a Vandermonde matrix are independent, multiplying by the inverse of its top
+    // keeps that and turns the top into the identity
+    vandermonde := make([][]byte, total)
+    for row := range vandermonde {
+        vandermonde[row] = make([]byte, dataShards)
+        for col := range vandermonde[row] {
+            vandermonde[row][col] = gfPow(byte(row), col)
+        }
+    }
+    top, err := invertMatrix(vandermonde[:dataShards])
+    if err != nil {
+        return nil, err
+    }
+    return &reedSolomon{dataShards: dataShards, parityShards: parityShards, matrix: multiplyMatrix(vandermonde, top)}, nil
+}
+
+// Compute the parity shards from the data shards, which must all have the same size
+func (rs *reedSolomon) encode(data [][]byte) [][]byte {
+    parity := make([][]byte, rs.parityShards)
+    for i := range parity {
+        parity[i] = make([]byte, len(data[0]))
+        for j, shard := range data {
+            factor := rs.matrix[rs.dataShards+i][j]
+            for b := range shard {
+                parity[i][b] ^= gfMul(factor, shard[b])
+            }
+        }
+    }
+    return parity
+}
+
+// Rebuild the missing data shards in place. Missing shards are nil, parity shards follow the data shards.
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+    missing := false
+    for i := 0; i < rs.dataShards; i++ {
+        if shards[i] == nil {
+            missing = true
+        }
+    }
+    if !missing {
+        return nil
+    }
+    // The rows of the first dataShards shards we have
+    rows := [][]byte{}
+    present := [][]byte{}
+    for i := range shards {
+        if shards[i] != nil && len(present) < rs.dataShards {
+            rows = append(rows, rs.matrix[i])
+            present = append(present, shards[i])
+        }
+    }
+    if len(present) < rs.dataShards {
+        return NotEnoughShardsError
+    }
+    decode, err := invertMatrix(rows)
+    if err != nil {
+        return err
+    }
+    for i := 0; i < rs.dataShards; i++ {
+        if shards[i] != nil {
+            continue
+        }
+        shard := make([]byte, len(present[0]))
+        for j := range present {
+            factor := decode[i][j]
+            for b := range shard {
+                shard[b] ^= gfMul(factor, present[j][b])
+            }
+        }
+        shards[i] = shard
+    }
+    return nil
+}
@@ -0,0 +1,40 @@
+package kademlia
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+    if _, err := newReedSolomon(200, 57); err != InvalidShardsError {
+        t.Errorf("Expected InvalidShardsError, got %v", err)
+    }
+    rs, err := newReedSolomon(4, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data := [][]byte{[]byte("abcd"), []byte("efgh"), []byte("ijkl"), []byte("mnop")}
+    shards := append(append([][]byte{}, data...), rs.encode(data)...)
+
+    // Any two shards may go missing
+    for a := range shards {
+        for b := a + 1; b < len(shards); b++ {
+            damaged := append([][]byte{}, shards...)
+            damaged[a], damaged[b] = nil, nil
+            if err := rs.reconstruct(damaged); err != nil {
+                t.Fatalf("Could not rebuild without shards %v and %v: %v", a, b, err)
+            }
+            for i := range data {
+                if !bytes.Equal(data[i], damaged[i]) {
+                    t.Errorf("Shard %v rebuilt as %v without shards %v and %v", i, string(damaged[i]), a, b)
+                }
+            }
+        }
+    }
+
+    damaged := append([][]byte{}, shards...)
+    damaged[0], damaged[1], damaged[5] = nil, nil, nil
+    if err := rs.reconstruct(damaged); err != NotEnoughShardsError {
+        t.Errorf("Expected NotEnoughShardsError, got %v", err)
+    }
+}
@@ -15,17 +15,18 @@ func (routingTable *RoutingTable) GetBucket(index int) bucket {
     return b
 }
 
-func NewRoutingTable(me Contact) *RoutingTable {
-    if ReplicationFactor <= 0 {
-        panic("Replication factor invalid")
+func NewRoutingTable(me Contact, config *Config) (*RoutingTable, error) {
+    config, err := checkConfig(config)
+    if err != nil {
+        return nil, err
     }
     routingTable := &RoutingTable{}
     for i := 0; i < IDLength*8; i++ {
-        routingTable.buckets[i] = newBucket() // 160 new buckets
+        routingTable.buckets[i] = newBucket(config.ReplicationFactor) // 256 new buckets
     }
     routingTable.Me = me
     routingTable.mutex = &sync.Mutex{}
-    return routingTable
+    return routingTable, nil
 }
 
 func (routingTable *RoutingTable) AddContact(contact Contact, pingFunc func(*Contact) bool) (bool, *Contact) {
@@ -66,7 +67,7 @@ func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count
 
 func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
     distance := id.CalcDistance(routingTable.Me.ID)
-    for i := 0; i < IDLength; i++ { // IDLength is 20
+    for i := 0; i < IDLength; i++ { // IDLength is 32
         for j := 0; j < 8; j++ { // Each ID index is one byte
             if (distance[i]>>uint8(7-j))&0x1 != 0 {
                 return i*8 + j
@@ -76,3 +77,27 @@ func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
 
     return IDLength*8 - 1
 }
+
+// Total number of contacts in all buckets
+func (routingTable *RoutingTable) Len() int {
+    routingTable.mutex.Lock()
+    count := 0
+    for _, bucket := range routingTable.buckets {
+        count += bucket.Len()
+    }
+    routingTable.mutex.Unlock()
+    return count
+}
+
+// Number of buckets holding at least one contact
+func (routingTable *RoutingTable) FilledBuckets() int {
+    routingTable.mutex.Lock()
+    count := 0
+    for _, bucket := range routingTable.buckets {
+        if bucket.Len() > 0 {
+            count++
+        }
+    }
+    routingTable.mutex.Unlock()
+    return count
+}
@@ -10,15 +10,15 @@ func TestRoutingTableFindClosestContacts(t *testing.T) {
     const maxResults = 20
     const toFind = 0x232323
 
-    idToFind := NewKademliaID(fmt.Sprintf("%040x", toFind))
+    idToFind := NewKademliaID(fmt.Sprintf("%064x", toFind))
     var allcontacts [numContacts]Contact
 
     // Create a routing table with some contacts, also store all contacts for comparison
-    me := NewContact(NewKademliaID(fmt.Sprintf("%040x", 0)), "127.0.0.1", 0, 0)
+    me := NewContact(NewKademliaID(fmt.Sprintf("%064x", 0)), "127.0.0.1", 0, 0)
     allcontacts[0] = me
-    rt := NewRoutingTable(me)
+    rt, _ := NewRoutingTable(me, nil)
     for i := 1; i < numContacts; i++ {
-        contact := NewContact(NewKademliaID(fmt.Sprintf("%040x", i)), "127.0.0.1", 0, 0)
+        contact := NewContact(NewKademliaID(fmt.Sprintf("%064x", i)), "127.0.0.1", 0, 0)
         allcontacts[i] = contact
         rt.AddContact(contact, nil)
     }
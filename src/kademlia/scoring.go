@@ -0,0 +1,74 @@
+package kademlia
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// Score lost for each corrupt transfer, and gained back for each good one
+const corruptPenalty = 10
+const goodReward = 1
+
+// Peers at or below this score are banned for Config.BanTime, so two corrupt transfers in a row get a peer banned
+const banScore = -2 * corruptPenalty
+
+// How much we trust the data sent by other nodes. Every peer starts at 0, corrupt transfers lower its
+// score and good ones slowly raise it back, never above 0, so good behaviour cannot buy credit for later.
+type peerScores struct {
+    scores  map[KademliaID]int
+    banned  map[KademliaID]time.Time
+    banTime time.Duration
+    mutex   sync.Mutex
+}
+
+func newPeerScores(banTime time.Duration) *peerScores {
+    return &peerScores{scores: make(map[KademliaID]int), banned: make(map[KademliaID]time.Time), banTime: banTime}
+}
+
+// A peer sent data which did not match the hash it was asked for
+func (scores *peerScores) reportCorrupt(peer *Contact) {
+    scores.mutex.Lock()
+    defer scores.mutex.Unlock()
+    score := scores.scores[*peer.ID] - corruptPenalty
+    if score <= banScore {
+        log.Printf("banning %v for %v after sending corrupt data\n", peer.Address, scores.banTime)
+        scores.banned[*peer.ID] = time.Now().Add(scores.banTime)
+        // Starts over once the ban has run out
+        delete(scores.scores, *peer.ID)
+        return
+    }
+    scores.scores[*peer.ID] = score
+}
+
+// A peer sent data which matched its hash
+func (scores *peerScores) reportGood(peer *Contact) {
+    scores.mutex.Lock()
+    defer scores.mutex.Unlock()
+    if score, ok := scores.scores[*peer.ID]; ok {
+        if score+goodReward >= 0 {
+            delete(scores.scores, *peer.ID)
+        } else {
+            scores.scores[*peer.ID] = score + goodReward
+        }
+    }
+}
+
+// Whether data should not be downloaded from the peer
+func (scores *peerScores) isBanned(id *KademliaID) bool {
+    scores.mutex.Lock()
+    defer scores.mutex.Unlock()
+    until, ok := scores.banned[*id]
+    if ok && time.Now().After(until) {
+        delete(scores.banned, *id)
+        return false
+    }
+    return ok
+}
+
+// Current score of the peer, 0 for peers without any corrupt transfers
+func (scores *peerScores) score(id *KademliaID) int {
+    scores.mutex.Lock()
+    defer scores.mutex.Unlock()
+    return scores.scores[*id]
+}
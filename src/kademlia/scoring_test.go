@@ -0,0 +1,33 @@
+package kademlia
+
+import (
+    "testing"
+    "time"
+)
+
+func TestPeerScores(t *testing.T) {
+    scores := newPeerScores(100 * time.Millisecond)
+    peer := NewContact(NewRandomKademliaID(), "127.0.0.1", 1, 1)
+
+    scores.reportCorrupt(&peer)
+    if scores.score(peer.ID) != -corruptPenalty || scores.isBanned(peer.ID) {
+        t.Errorf("Expected score %v without a ban, got %v", -corruptPenalty, scores.score(peer.ID))
+    }
+    // Good transfers earn the score back, but never above 0
+    for i := 0; i < corruptPenalty+5; i++ {
+        scores.reportGood(&peer)
+    }
+    if scores.score(peer.ID) != 0 {
+        t.Errorf("Expected score 0 after good transfers, got %v", scores.score(peer.ID))
+    }
+
+    scores.reportCorrupt(&peer)
+    scores.reportCorrupt(&peer)
+    if !scores.isBanned(peer.ID) {
+        t.Errorf("Peer was not banned after two corrupt transfers")
+    }
+    time.Sleep(200 * time.Millisecond)
+    if scores.isBanned(peer.ID) || scores.score(peer.ID) != 0 {
+        t.Errorf("Ban did not run out")
+    }
+}
@@ -0,0 +1,103 @@
+package kademlia
+
+import (
+    "errors"
+    "time"
+    "github.com/vmihailenco/msgpack"
+)
+
+// Error states
+var ValueTooLargeError = errors.New("value is larger than the configured limit")
+var NotAValueError = errors.New("key does not hold a value")
+
+// Payload of PUT_VALUE_MSG
+type valueMessage struct {
+    Key   KademliaID
+    Value []byte
+}
+
+// Keys for values are chosen by the application, usually by hashing a name
+func KeyFromName(name string) *KademliaID {
+    return NewKademliaIDFromBytes([]byte(name))
+}
+
+// Where the store keeps the value put under key. Values get their own key space, derived like topics are,
+// so that nobody can put a value over content, provider records or signed records.
+func valueKey(key *KademliaID) *KademliaID {
+    return NewKademliaIDFromBytes(append([]byte("value:"), key[:]...))
+}
+
+// Store a value under a key of the caller's choice, replacing an older value. republishFunc is called with key.
+// The value is kept together with key, so that the key is known again when the value is restored.
+func (kvStore *KVStore) PutValue(key KademliaID, value []byte, republishFunc func(*KademliaID)) error {
+    if len(value) > kvStore.config.MaxValueSize {
+        return ValueTooLargeError
+    }
+    blob, err := marshalValueMessage(&key, value)
+    if err != nil {
+        return err
+    }
+    id := *valueKey(&key)
+    kvStore.mutex.Lock()
+    defer kvStore.mutex.Unlock()
+    if kvStore.mapping == nil {
+        return NotInitializedError
+    }
+    kvStore.waitWrites(id)
+    if current, ok := kvStore.mapping[id]; ok && !current.value {
+        return DuplicateError
+    }
+    stored := &kvData{id: id, value: true, evictionTime: time.Now().Add(kvStore.config.EvictionTime),
+        republishTime: time.Now().Add(kvStore.config.RepublishTime)}
+    if republishFunc != nil {
+        stored.republishFunc = func(*KademliaID) { republishFunc(&key) }
+    }
+    if err := kvStore.put(stored, blob); err != nil {
+        return err
+    }
+    kvStore.scheduleEviction(stored)
+    kvStore.scheduleRepublish(stored)
+    return nil
+}
+
+// The value stored under key, if any
+func (kvStore *KVStore) GetValue(key KademliaID) ([]byte, error) {
+    stored, err := kvStore.storedValue(*valueKey(&key))
+    if err != nil {
+        return nil, err
+    }
+    if !stored.Key.Equals(&key) {
+        return nil, NotFoundError
+    }
+    return stored.Value, nil
+}
+
+// The key of the value kept under id, which is where the store keeps it
+func (kvStore *KVStore) valueKeyOf(id KademliaID) (*KademliaID, error) {
+    stored, err := kvStore.storedValue(id)
+    if err != nil {
+        return nil, err
+    }
+    return &stored.Key, nil
+}
+
+func (kvStore *KVStore) storedValue(id KademliaID) (*valueMessage, error) {
+    blob, _, err := kvStore.read(id, func(stored *kvData) error {
+        if !stored.value {
+            return NotAValueError
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    var stored valueMessage
+    if err := msgpack.Unmarshal(blob, &stored); err != nil {
+        return nil, err
+    }
+    return &stored, nil
+}
+
+func marshalValueMessage(key *KademliaID, value []byte) ([]byte, error) {
+    return msgpack.Marshal(valueMessage{Key: *key, Value: value})
+}
@@ -0,0 +1,47 @@
+package rest
+
+import (
+    "net/http"
+    "kademlia"
+    "encoding/json"
+    "io/ioutil"
+)
+
+// Limits in force and throughput with each peer, as sent over REST
+type bandwidthReport struct {
+    Limits kademlia.BandwidthLimits
+    Peers  []kademlia.PeerThroughput
+}
+
+// GET responds with the transfer limits and the throughput with each peer as JSON. PUT changes the
+// limits to the JSON in the request body, limits left out of it keep their value.
+func bandwidthHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "PUT":
+        body, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            sendResponse(w, http.StatusInternalServerError, "500 - Couldn't read body")
+            return
+        }
+        defer r.Body.Close()
+        limits := k.Net.BandwidthLimits()
+        if err := json.Unmarshal(body, &limits); err != nil {
+            sendResponse(w, http.StatusBadRequest, "400 - Body is not a set of limits")
+            return
+        }
+        if err := k.Net.SetBandwidthLimits(limits); err != nil {
+            sendResponse(w, http.StatusBadRequest, "400 - "+err.Error())
+            return
+        }
+        sendResponse(w, http.StatusOK, "Limits were changed.")
+    case "GET":
+        report := bandwidthReport{Limits: k.Net.BandwidthLimits(), Peers: k.Net.Throughput()}
+        if to_return, err := json.Marshal(report); err != nil {
+            sendResponse(w, 500, "")
+        } else {
+            sendResponse(w, http.StatusOK, string(to_return))
+        }
+    default:
+        sendResponse(w, http.StatusBadRequest, "400 - Not a PUT or GET request")
+    }
+}
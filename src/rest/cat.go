@@ -3,9 +3,11 @@ package rest
 import (
     "net/http"
     "github.com/gorilla/mux"
-    "github.com/vmihailenco/msgpack"
     "fmt"
     "kademlia"
+    "strings"
+    "strconv"
+    "mime"
 )
 
 func catHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
@@ -19,40 +21,40 @@ func catHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
 
     fmt.Println(hash)
 
-    hashID := kademlia.NewKademliaID(hash)
-    var data []byte
-
-    contactsWithData := *k.LookupData(hashID)
-    fmt.Println("Contacts with data:", contactsWithData)
-
-    if len(contactsWithData) == 1 && contactsWithData[0].ID.Equals(k.Net.Routing.Me.ID) {
-        // The data is in our KVStore
-        data, _ = k.Net.Store.Lookup(*hashID)
-        var content []kademlia.Contact
-        if err := msgpack.Unmarshal(data, &content); err != nil {
-            fmt.Println("Your data found locally:", string(data))
-            sendResponse(w, http.StatusOK, string(data))
+    // A path below the hash is resolved through its directories first
+    id := parseHash(w, hash)
+    if id == nil {
+        return
+    }
+    if path := req["path"]; path != "" {
+        entry, err := k.ResolvePath(id, strings.Split(path, "/"))
+        if err == kademlia.NotFoundError || err == kademlia.NotADirectoryError {
+            sendResponse(w, http.StatusNotFound, fmt.Sprintf("%s/%s could not be found.", hash, path))
+            return
+        } else if err != nil {
+            sendResponse(w, http.StatusInternalServerError, fmt.Sprintf("%s/%s could't be resolved: %s.", hash, path, err))
             return
-        } else {
-            panic("self-referential content in KVStore")
         }
-    } else {
-        // The data is elsewhere
-        fmt.Println("Your data is in another castle")
-
-        // We got a list of contacts
-        for _, contact := range contactsWithData {
-            fmt.Println("Candidate:", contact)
-            downloadedData := k.Download(hashID, &contact)
+        id = &entry.Hash
+    }
 
-            if len(downloadedData) > 0 {
-                fmt.Println("Your data was downloaded remotely:", string(downloadedData))
-                sendResponse(w, http.StatusOK, string(downloadedData))
-                return
-            }
-        }
+    // Reassembles chunked files, and checks every block on the way. Files stored with metadata are sent
+    // with their name, type and size.
+    data, meta, err := k.CatWithMetadata(id)
+    if err == kademlia.IsADirectoryError {
+        sendResponse(w, http.StatusBadRequest, "400 - Is a directory, list it with /ls")
+    } else if err == kademlia.NotFoundError {
         fmt.Println("None of the contacts had the file.")
+        sendResponse(w, http.StatusNoContent, "")
+    } else if err != nil {
+        sendResponse(w, http.StatusInternalServerError, fmt.Sprintf("%s could't be read: %s.", hash, err))
+    } else {
+        if meta != nil {
+            w.Header().Set("Content-Type", meta.MimeType)
+            w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+            w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.Name}))
+            w.Header().Set("Last-Modified", meta.ModTime.UTC().Format(http.TimeFormat))
+        }
+        sendResponse(w, http.StatusOK, string(data))
     }
-
-    sendResponse(w, http.StatusNoContent, "")
 }
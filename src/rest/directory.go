@@ -0,0 +1,94 @@
+package rest
+
+import (
+    "net/http"
+    "github.com/gorilla/mux"
+    "fmt"
+    "kademlia"
+    "encoding/json"
+    "io/ioutil"
+)
+
+// A directory entry as sent and received over REST, with the hash as an address
+type dirEntry struct {
+    Name string
+    Hash string
+    Dir  bool
+    Size int64
+}
+
+// Store the JSON list of entries in the request body as a directory, respond with its hash
+func dirHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        sendResponse(w, http.StatusBadRequest, "400 - Not a POST request")
+        return
+    }
+
+    body, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+        sendResponse(w, http.StatusInternalServerError, "500 - Couldn't read body")
+        return
+    }
+    defer r.Body.Close()
+
+    var listing []dirEntry
+    if err := json.Unmarshal(body, &listing); err != nil {
+        sendResponse(w, http.StatusBadRequest, "400 - Body is not a list of entries")
+        return
+    }
+    entries := []kademlia.DirEntry{}
+    for _, entry := range listing {
+        hash, err := kademlia.ParseAddress(entry.Hash)
+        if err != nil {
+            sendResponse(w, http.StatusBadRequest, fmt.Sprintf("400 - Invalid hash for %s", entry.Name))
+            return
+        }
+        entries = append(entries, kademlia.DirEntry{Name: entry.Name, Hash: *hash, Dir: entry.Dir, Size: entry.Size})
+    }
+
+    hash, err := k.StoreDirectory(entries)
+    if err == kademlia.InvalidNameError || err == kademlia.DirectoryTooLargeError {
+        sendResponse(w, http.StatusBadRequest, "400 - "+err.Error())
+    } else if err == kademlia.StoreFullError {
+        sendResponse(w, http.StatusInsufficientStorage, "507 - "+err.Error())
+    } else if err != nil {
+        sendResponse(w, http.StatusInternalServerError, "500 - "+err.Error())
+    } else {
+        sendResponse(w, http.StatusOK, string(hash.Multihash()))
+    }
+}
+
+// Respond with the entries of a directory as JSON
+func lsHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
+    req := mux.Vars(r)
+    hash := req["hash"]
+    if r.Method != "GET" {
+        sendResponse(w, http.StatusBadRequest, "400 - Not a GET request")
+        return
+    }
+
+    id := parseHash(w, hash)
+    if id == nil {
+        return
+    }
+    entries, err := k.ListDirectory(id)
+    if err == kademlia.NotFoundError {
+        sendResponse(w, http.StatusNotFound, fmt.Sprintf("%s could not be found.", hash))
+        return
+    } else if err == kademlia.NotADirectoryError {
+        sendResponse(w, http.StatusBadRequest, fmt.Sprintf("%s is not a directory.", hash))
+        return
+    } else if err != nil {
+        sendResponse(w, http.StatusInternalServerError, fmt.Sprintf("%s could't be read: %s.", hash, err))
+        return
+    }
+    listing := []dirEntry{}
+    for _, entry := range entries {
+        listing = append(listing, dirEntry{Name: entry.Name, Hash: entry.Hash.Address(), Dir: entry.Dir, Size: entry.Size})
+    }
+    if to_return, err := json.Marshal(listing); err != nil {
+        sendResponse(w, 500, "")
+    } else {
+        sendResponse(w, http.StatusOK, string(to_return))
+    }
+}
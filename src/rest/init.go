@@ -9,12 +9,22 @@ import (
 
 func Initialize(k *kademlia.Kademlia, restPort int) {
     router := mux.NewRouter()
-    router.HandleFunc("/cat/{hash}", func(w http.ResponseWriter, r *http.Request) { catHandler(k, w, r) })     // cat.go
-    router.HandleFunc("/store", func(w http.ResponseWriter, r *http.Request) { storeHandler(k, w, r) })        // store.go
-    router.HandleFunc("/contacts", func(w http.ResponseWriter, r *http.Request) { contactsHandler(k, w, r) })  // store.go
-    router.HandleFunc("/dump", func(w http.ResponseWriter, r *http.Request) { dumpStoreHandler(k, w, r) })     // store.go
-    router.HandleFunc("/pin/{hash}", func(w http.ResponseWriter, r *http.Request) { pinHandler(k, w, r) })     // pin.go
-    router.HandleFunc("/unpin/{hash}", func(w http.ResponseWriter, r *http.Request) { unpinHandler(k, w, r) }) // unpin.go
-    http.ListenAndServe(":"+strconv.Itoa(restPort), router)                                                    // fix so take port from config file
+    router.HandleFunc("/cat/{hash}", func(w http.ResponseWriter, r *http.Request) { catHandler(k, w, r) })           // cat.go
+    router.HandleFunc("/cat/{hash}/{path:.*}", func(w http.ResponseWriter, r *http.Request) { catHandler(k, w, r) }) // cat.go
+    router.HandleFunc("/store", func(w http.ResponseWriter, r *http.Request) { storeHandler(k, w, r) })              // store.go
+    router.HandleFunc("/store/{hash}", func(w http.ResponseWriter, r *http.Request) { unpublishHandler(k, w, r) })   // unpublish.go
+    router.HandleFunc("/contacts", func(w http.ResponseWriter, r *http.Request) { contactsHandler(k, w, r) })        // store.go
+    router.HandleFunc("/dump", func(w http.ResponseWriter, r *http.Request) { dumpStoreHandler(k, w, r) })           // store.go
+    router.HandleFunc("/pin/{hash}", func(w http.ResponseWriter, r *http.Request) { pinHandler(k, w, r) })           // pin.go
+    router.HandleFunc("/unpin/{hash}", func(w http.ResponseWriter, r *http.Request) { unpinHandler(k, w, r) })       // unpin.go
+    router.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) { publishHandler(k, w, r) })          // record.go
+    router.HandleFunc("/resolve/{key}", func(w http.ResponseWriter, r *http.Request) { resolveHandler(k, w, r) })    // record.go
+    router.HandleFunc("/value/{name}", func(w http.ResponseWriter, r *http.Request) { valueHandler(k, w, r) })       // value.go
+    router.HandleFunc("/topic/{name}", func(w http.ResponseWriter, r *http.Request) { topicHandler(k, w, r) })       // topic.go
+    router.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) { dirHandler(k, w, r) })                  // directory.go
+    router.HandleFunc("/ls/{hash}", func(w http.ResponseWriter, r *http.Request) { lsHandler(k, w, r) })             // directory.go
+    router.HandleFunc("/stat/{hash}", func(w http.ResponseWriter, r *http.Request) { statHandler(k, w, r) })         // stat.go
+    router.HandleFunc("/bandwidth", func(w http.ResponseWriter, r *http.Request) { bandwidthHandler(k, w, r) })      // bandwidth.go
+    http.ListenAndServe(":"+strconv.Itoa(restPort), router)                                                          // fix so take port from config file
     // could use log.Fatal here, prints the error but then uses os.exit
 }
@@ -16,7 +16,10 @@ func pinHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    h := kademlia.NewKademliaID(hash)
+    h := parseHash(w, hash)
+    if h == nil {
+        return
+    }
     if err := k.Net.Store.Pin(*h); err == kademlia.NotFoundError {
         sendResponse(w, http.StatusNotFound, fmt.Sprintf("%s could not be found.", hash))
     } else if err != nil {
@@ -0,0 +1,51 @@
+package rest
+
+import (
+    "net/http"
+    "github.com/gorilla/mux"
+    "fmt"
+    "kademlia"
+    "io/ioutil"
+)
+
+// Publish the request body as the next version of the node's record, respond with the record key
+func publishHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        sendResponse(w, http.StatusBadRequest, "400 - Not a POST request")
+        return
+    }
+
+    value, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+        sendResponse(w, http.StatusInternalServerError, "500 - Couldn't read body")
+        return
+    }
+    defer r.Body.Close()
+
+    record, err := k.PutRecord(value)
+    if err != nil {
+        sendResponse(w, 500, fmt.Sprintf("Record could't be published: %s.", err))
+        return
+    }
+    key := record.Key()
+    sendResponse(w, http.StatusOK, string(key[:kademlia.IDLength]))
+}
+
+// Respond with the value of the newest record stored under a key
+func resolveHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
+    req := mux.Vars(r)
+    key := req["key"]
+    if r.Method != "GET" {
+        sendResponse(w, http.StatusBadRequest, "400 - Not a GET request")
+        return
+    }
+
+    record, err := k.GetRecord(kademlia.NewKademliaID(key))
+    if err == kademlia.NotFoundError {
+        sendResponse(w, http.StatusNotFound, fmt.Sprintf("%s could not be found.", key))
+    } else if err != nil {
+        sendResponse(w, 500, fmt.Sprintf("%s could't be resolved: %s.", key, err))
+    } else {
+        sendResponse(w, http.StatusOK, string(record.Value))
+    }
+}
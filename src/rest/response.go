@@ -2,6 +2,8 @@ package rest
 
 import (
     "net/http"
+    "fmt"
+    "kademlia"
 )
 
 /*
@@ -21,3 +23,14 @@ func sendResponse(w http.ResponseWriter, statusCode int, message string) {
     w.Write([]byte(message))
 
 }
+
+// The ID of a hash given in a URL: a multihash, a bare ID or a legacy SHA-1 address, all hex encoded.
+// Responds with 400 and returns nil when it is none of those.
+func parseHash(w http.ResponseWriter, hash string) *kademlia.KademliaID {
+    id, err := kademlia.ParseAddress(hash)
+    if err != nil {
+        sendResponse(w, http.StatusBadRequest, fmt.Sprintf("400 - %s is not a valid address", hash))
+        return nil
+    }
+    return id
+}
@@ -1,6 +1,9 @@
 package rest
 
 import (
+    "bytes"
+    "bufio"
+    "context"
     "os"
     "net/http"
     "log"
@@ -10,6 +13,10 @@ import (
     "fmt"
     "io/ioutil"
     "strconv"
+    "strings"
+    "encoding/hex"
+    "encoding/json"
+    "crypto/sha1"
 )
 
 var testPort int = 7000
@@ -19,8 +26,20 @@ func getTestPort() int {
     return testPort
 }
 
+// Create a node on fresh test ports and start it
+func newTestKademlia() *kademlia.Kademlia {
+    k, err := kademlia.NewKademlia("127.0.0.1", getTestPort(), getTestPort(), nil)
+    if err != nil {
+        panic(err)
+    }
+    if err := k.Start(context.Background()); err != nil {
+        panic(err)
+    }
+    return k
+}
+
 func TestRestBadRequest(t *testing.T) {
-    k := kademlia.NewKademlia("127.0.0.1", getTestPort(), getTestPort())
+    k := newTestKademlia()
     kRestPort := getTestPort()
     go Initialize(k, kRestPort)
     time.Sleep(time.Second)
@@ -87,7 +106,7 @@ func TestRestBadRequest(t *testing.T) {
 }
 
 func TestRestPinUnpin(t *testing.T) {
-    k := kademlia.NewKademlia("127.0.0.1", getTestPort(), getTestPort())
+    k := newTestKademlia()
     kRestPort := getTestPort()
     go Initialize(k, kRestPort)
     time.Sleep(time.Second)
@@ -144,8 +163,157 @@ func TestRestPinUnpin(t *testing.T) {
     k.Net.Close()
 }
 
+func TestRestUnpublish(t *testing.T) {
+    k := newTestKademlia()
+    kRestPort := getTestPort()
+    go Initialize(k, kRestPort)
+    time.Sleep(time.Second)
+
+    data := []byte("Content to withdraw")
+    id, _ := k.Store(data)
+    client := &http.Client{}
+
+    // The first DELETE removes the file, the second finds nothing
+    for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+        req, err := http.NewRequest("DELETE", "http://localhost:"+strconv.Itoa(kRestPort)+"/store/"+id.String(), nil)
+        if err != nil {
+            log.Fatal(err)
+        }
+        resp, err := client.Do(req)
+        if err != nil {
+            log.Fatal(err)
+            t.Fail()
+        }
+        if resp.StatusCode != expected {
+            fmt.Println("Unpublish returned", resp.StatusCode, "expected", expected)
+            t.Fail()
+        }
+        resp.Body.Close()
+    }
+    if _, err := k.Net.Store.Lookup(id); err == nil {
+        fmt.Println("Unpublished file is still stored")
+        t.Fail()
+    }
+    k.Net.Close()
+}
+
+func TestRestPublishResolve(t *testing.T) {
+    k := newTestKademlia()
+    kRestPort := getTestPort()
+    go Initialize(k, kRestPort)
+    time.Sleep(time.Second)
+
+    // Publish a value and read back the record key
+    resp, err := http.Post("http://localhost:"+strconv.Itoa(kRestPort)+"/publish", "text/plain", strings.NewReader("latest"))
+    if err != nil {
+        log.Fatal(err)
+        t.Fail()
+    }
+    key, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || len(key) != kademlia.IDLength {
+        fmt.Println("Publish returned", resp.StatusCode, key)
+        t.FailNow()
+    }
+
+    // Resolve the key back to the value
+    resp, err = http.Get("http://localhost:" + strconv.Itoa(kRestPort) + "/resolve/" + hex.EncodeToString(key))
+    if err != nil {
+        log.Fatal(err)
+        t.Fail()
+    }
+    value, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || string(value) != "latest" {
+        fmt.Println("Resolve returned", resp.StatusCode, string(value))
+        t.Fail()
+    }
+    k.Net.Close()
+}
+
+func TestRestPutGetValue(t *testing.T) {
+    k := newTestKademlia()
+    kRestPort := getTestPort()
+    go Initialize(k, kRestPort)
+    time.Sleep(time.Second)
+    url := "http://localhost:" + strconv.Itoa(kRestPort) + "/value/registry-entry"
+
+    // Nothing is stored yet
+    resp, err := http.Get(url)
+    if err != nil {
+        log.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusNotFound {
+        fmt.Println("Get of missing value returned", resp.StatusCode)
+        t.Fail()
+    }
+
+    req, _ := http.NewRequest("PUT", url, strings.NewReader("service at 10.0.0.1"))
+    resp, err = http.DefaultClient.Do(req)
+    if err != nil {
+        log.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        fmt.Println("Put returned", resp.StatusCode)
+        t.Fail()
+    }
+
+    resp, err = http.Get(url)
+    if err != nil {
+        log.Fatal(err)
+    }
+    value, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || string(value) != "service at 10.0.0.1" {
+        fmt.Println("Get returned", resp.StatusCode, string(value))
+        t.Fail()
+    }
+    k.Net.Close()
+}
+
+func TestRestTopic(t *testing.T) {
+    k := newTestKademlia()
+    kRestPort := getTestPort()
+    go Initialize(k, kRestPort)
+    time.Sleep(time.Second)
+    url := "http://localhost:" + strconv.Itoa(kRestPort) + "/topic/datasets"
+
+    // Subscribe first, the stream stays open while we publish
+    stream, err := http.Get(url)
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer stream.Body.Close()
+    lines := bufio.NewReader(stream.Body)
+
+    resp, err := http.Post(url, "text/plain", strings.NewReader("new dataset"))
+    if err != nil {
+        log.Fatal(err)
+    }
+    resp.Body.Close()
+
+    line, err := lines.ReadString('\n')
+    if err != nil || line != "new dataset\n" {
+        fmt.Println("Stream returned", line, err)
+        t.Fail()
+    }
+
+    resp, err = http.Post(url, "text/plain", strings.NewReader(strings.Repeat("x", k.Config.MaxValueSize+1)))
+    if err != nil {
+        log.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusRequestEntityTooLarge {
+        fmt.Println("Post of a too large message returned", resp.StatusCode)
+        t.Fail()
+    }
+    k.Net.Close()
+}
+
 func TestRestStoreCatLocal(t *testing.T) {
-    k := kademlia.NewKademlia("127.0.0.1", getTestPort(), getTestPort())
+    k := newTestKademlia()
     kRestPort := getTestPort()
     go Initialize(k, kRestPort)
     time.Sleep(time.Second)
@@ -204,16 +372,16 @@ func TestRestStoreCatLocal(t *testing.T) {
 
 func TestRestStoreCatRemote(t *testing.T) {
     // Create two Kademlias
-    k1 := kademlia.NewKademlia("127.0.0.1", getTestPort(), getTestPort())
+    k1 := newTestKademlia()
     k1RestPort := getTestPort()
     go Initialize(k1, k1RestPort)
-    k2 := kademlia.NewKademlia("127.0.0.1", getTestPort(), getTestPort())
+    k2 := newTestKademlia()
     k2RestPort := getTestPort()
     go Initialize(k2, k2RestPort)
 
     // Bootstrap one to the other
     time.Sleep(time.Second)
-    k2.Bootstrap("127.0.0.1", k1.Net.Routing.Me.Address.TcpPort, k1.Net.Routing.Me.Address.UdpPort)
+    k2.Bootstrap([]kademlia.Address{k1.Net.Routing.Me.Address})
 
     // Open a file to store
     fileReader, err := os.Open("test.txt")
@@ -264,8 +432,222 @@ func TestRestStoreCatRemote(t *testing.T) {
     k2.Net.Close()
 }
 
+func TestRestStoreErasure(t *testing.T) {
+    k1 := newTestKademlia()
+    k1RestPort := getTestPort()
+    go Initialize(k1, k1RestPort)
+    k2 := newTestKademlia()
+    k2RestPort := getTestPort()
+    go Initialize(k2, k2RestPort)
+    time.Sleep(time.Second)
+    k2.Bootstrap([]kademlia.Address{k1.Net.Routing.Me.Address})
+
+    bytesToStore, _ := ioutil.ReadFile("test.txt")
+    resp, err := http.Post("http://localhost:"+strconv.Itoa(k1RestPort)+"/store?erasure=true", "application/octet-stream", bytes.NewReader(bytesToStore))
+    if err != nil {
+        t.Fatal(err)
+    }
+    root, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || !isMultihash(root) {
+        t.Fatalf("Store returned %v: %v", resp.StatusCode, string(root))
+    }
+    time.Sleep(time.Second)
+
+    resp, err = http.Get("http://localhost:" + strconv.Itoa(k2RestPort) + "/cat/" + hex.EncodeToString(root))
+    if err != nil {
+        t.Fatal(err)
+    }
+    bytesFromCat, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if string(bytesFromCat) != string(bytesToStore) {
+        t.Errorf("Cat returned %v of %v bytes", len(bytesFromCat), len(bytesToStore))
+    }
+    k1.Net.Close()
+    k2.Net.Close()
+}
+
+func TestRestDirectory(t *testing.T) {
+    k := newTestKademlia()
+    kRestPort := getTestPort()
+    go Initialize(k, kRestPort)
+    time.Sleep(time.Second)
+    base := "http://localhost:" + strconv.Itoa(kRestPort)
+
+    file, _ := k.Store([]byte("file content"))
+    post := func(listing string) []byte {
+        resp, err := http.Post(base+"/dir", "application/json", strings.NewReader(listing))
+        if err != nil {
+            t.Fatal(err)
+        }
+        body, _ := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        return body
+    }
+    sub := post(`[{"Name": "file.txt", "Hash": "` + file.String() + `", "Size": 12}]`)
+    if !isMultihash(sub) {
+        t.Fatalf("Storing directory failed: %v", string(sub))
+    }
+    root := post(`[{"Name": "sub", "Hash": "` + hex.EncodeToString(sub) + `", "Dir": true}]`)
+    if bad := post(`[{"Name": "../x", "Hash": "` + file.String() + `"}]`); isMultihash(bad) {
+        t.Errorf("Invalid name was accepted")
+    }
+
+    resp, err := http.Get(base + "/ls/" + hex.EncodeToString(root))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var listing []dirEntry
+    body, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if err := json.Unmarshal(body, &listing); err != nil || len(listing) != 1 || listing[0].Name != "sub" || !listing[0].Dir {
+        t.Errorf("Unexpected listing %v: %v", string(body), err)
+    }
+
+    resp, err = http.Get(base + "/cat/" + hex.EncodeToString(root) + "/sub/file.txt")
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, _ = ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || string(body) != "file content" {
+        t.Errorf("Cat by path returned %v: %v", resp.StatusCode, string(body))
+    }
+    resp, _ = http.Get(base + "/cat/" + hex.EncodeToString(root) + "/sub/missing")
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusNotFound {
+        t.Errorf("Expected 404 for a missing path, got %v", resp.StatusCode)
+    }
+    k.Net.Close()
+}
+
+func TestRestMetadata(t *testing.T) {
+    k := newTestKademlia()
+    kRestPort := getTestPort()
+    go Initialize(k, kRestPort)
+    time.Sleep(time.Second)
+    base := "http://localhost:" + strconv.Itoa(kRestPort)
+
+    content := "a,b\n1,2\n"
+    resp, err := http.Post(base+"/store?name=table.csv&modtime=1500000000", "application/octet-stream", strings.NewReader(content))
+    if err != nil {
+        t.Fatal(err)
+    }
+    hash, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if !isMultihash(hash) {
+        t.Fatalf("Store returned %v", string(hash))
+    }
+
+    resp, err = http.Get(base + "/cat/" + hex.EncodeToString(hash))
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if string(body) != content || resp.Header.Get("Content-Type") != "text/csv; charset=utf-8" ||
+        resp.Header.Get("Content-Length") != strconv.Itoa(len(content)) ||
+        resp.Header.Get("Content-Disposition") != "attachment; filename=table.csv" {
+        t.Errorf("Unexpected response %v with headers %v", string(body), resp.Header)
+    }
+
+    resp, err = http.Get(base + "/stat/" + hex.EncodeToString(hash))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var stat fileStat
+    body, _ = ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if err := json.Unmarshal(body, &stat); err != nil || stat.Name != "table.csv" || stat.ModTime.Unix() != 1500000000 {
+        t.Errorf("Unexpected stat %v: %v", string(body), err)
+    }
+    k.Net.Close()
+}
+
+// Whether a response is the multihash of a stored file
+func isMultihash(body []byte) bool {
+    _, err := kademlia.ParseMultihash(body)
+    return err == nil
+}
+
+func TestRestLegacyAddress(t *testing.T) {
+    k := newTestKademlia()
+    kRestPort := getTestPort()
+    go Initialize(k, kRestPort)
+    time.Sleep(time.Second)
+    base := "http://localhost:" + strconv.Itoa(kRestPort)
+
+    content := []byte("stored before the move to SHA-256")
+    resp, err := http.Post(base+"/store", "application/octet-stream", bytes.NewReader(content))
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+
+    // The bare hex SHA-1 address the file used to have
+    sum := sha1.Sum(content)
+    resp, err = http.Get(base + "/cat/" + hex.EncodeToString(sum[:]))
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || string(body) != string(content) {
+        t.Errorf("Legacy address returned %v: %v", resp.StatusCode, string(body))
+    }
+
+    resp, err = http.Get(base + "/cat/not-an-address")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("Invalid address returned %v", resp.StatusCode)
+    }
+    k.Net.Close()
+}
+
+func TestRestBandwidth(t *testing.T) {
+    k := newTestKademlia()
+    kRestPort := getTestPort()
+    go Initialize(k, kRestPort)
+    time.Sleep(time.Second)
+    base := "http://localhost:" + strconv.Itoa(kRestPort)
+
+    put := func(limits string) int {
+        req, _ := http.NewRequest("PUT", base+"/bandwidth", strings.NewReader(limits))
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        return resp.StatusCode
+    }
+    if status := put(`{"Upload": 1048576, "PeerDownload": 65536}`); status != http.StatusOK {
+        t.Errorf("Setting limits returned %v", status)
+    }
+    if status := put(`{"Download": 10}`); status != http.StatusBadRequest {
+        t.Errorf("Invalid limit returned %v", status)
+    }
+    // Limits left out keep their value
+    put(`{"Upload": 2097152}`)
+
+    resp, err := http.Get(base + "/bandwidth")
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    var report bandwidthReport
+    expected := kademlia.BandwidthLimits{Upload: 2 << 20, PeerDownload: 64 << 10}
+    if err := json.Unmarshal(body, &report); err != nil || report.Limits != expected {
+        t.Errorf("Unexpected report %v: %v", string(body), err)
+    }
+    k.Net.Close()
+}
+
 func TestRestDump(t *testing.T) {
-    k := kademlia.NewKademlia("127.0.0.1", getTestPort(), getTestPort())
+    k := newTestKademlia()
     kRestPort := getTestPort()
     go Initialize(k, kRestPort)
     time.Sleep(time.Second)
@@ -0,0 +1,48 @@
+package rest
+
+import (
+    "net/http"
+    "github.com/gorilla/mux"
+    "fmt"
+    "kademlia"
+    "encoding/json"
+    "time"
+)
+
+// Metadata as sent over REST, with the hash as an address
+type fileStat struct {
+    Name     string
+    Size     int64
+    MimeType string
+    ModTime  time.Time
+    Content  string
+}
+
+// Respond with the metadata stored under a hash as JSON
+func statHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
+    req := mux.Vars(r)
+    hash := req["hash"]
+    if r.Method != "GET" {
+        sendResponse(w, http.StatusBadRequest, "400 - Not a GET request")
+        return
+    }
+
+    id := parseHash(w, hash)
+    if id == nil {
+        return
+    }
+    meta, err := k.Stat(id)
+    if err == kademlia.NotFoundError || err == kademlia.NoMetadataError {
+        sendResponse(w, http.StatusNotFound, fmt.Sprintf("%s has no metadata.", hash))
+        return
+    } else if err != nil {
+        sendResponse(w, http.StatusInternalServerError, fmt.Sprintf("%s could't be read: %s.", hash, err))
+        return
+    }
+    stat := fileStat{Name: meta.Name, Size: meta.Size, MimeType: meta.MimeType, ModTime: meta.ModTime, Content: meta.Content.Address()}
+    if to_return, err := json.Marshal(stat); err != nil {
+        sendResponse(w, 500, "")
+    } else {
+        sendResponse(w, http.StatusOK, string(to_return))
+    }
+}
@@ -5,9 +5,11 @@ import (
     "kademlia"
     "io/ioutil"
     "log"
+    "strconv"
+    "time"
 )
 
-// Store data to KVStore and calculate the hash with SHA-1
+// Store data to KVStore and answer with its address, the SHA-256 multihash of the root
 func storeHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
     // Not a POST
     if r.Method != "POST" {
@@ -24,8 +26,44 @@ func storeHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request)
     }
     defer r.Body.Close()
 
-    // Store data
-    hash := k.Store(data)
-    // Respond with hash
-    sendResponse(w, http.StatusOK, string(hash[:kademlia.IDLength]))
+    // Store data, erasure coded or cut into blocks by content if asked to
+    hash := kademlia.KademliaID{}
+    erasure, chunking := r.URL.Query().Get("erasure") != "", r.URL.Query().Get("chunking")
+    if chunking != "" && chunking != "fixed" && chunking != "cdc" || erasure && chunking != "" {
+        sendResponse(w, http.StatusBadRequest, "400 - Unknown chunking, or chunking combined with erasure")
+        return
+    }
+    if erasure {
+        hash, err = k.StoreErasure(data)
+    } else if chunking == "cdc" {
+        hash, err = k.StoreCDC(data)
+    } else {
+        hash, err = k.Store(data)
+    }
+    if err == kademlia.StoreFullError {
+        sendResponse(w, http.StatusInsufficientStorage, "507 - "+err.Error())
+        return
+    } else if err != nil {
+        sendResponse(w, http.StatusInternalServerError, "500 - "+err.Error())
+        return
+    }
+
+    // With a name, the content is described by a metadata manifest, whose hash is returned instead
+    if name := r.URL.Query().Get("name"); name != "" {
+        modTime := time.Now()
+        if seconds, err := strconv.ParseInt(r.URL.Query().Get("modtime"), 10, 64); err == nil {
+            modTime = time.Unix(seconds, 0)
+        }
+        meta := kademlia.Metadata{Name: name, Size: int64(len(data)), MimeType: kademlia.DetectMimeType(name, data),
+            ModTime: modTime, Content: hash}
+        if hash, err = k.StoreMetadata(meta); err == kademlia.StoreFullError {
+            sendResponse(w, http.StatusInsufficientStorage, "507 - "+err.Error())
+            return
+        } else if err != nil {
+            sendResponse(w, http.StatusBadRequest, "400 - "+err.Error())
+            return
+        }
+    }
+    // Respond with the multihash
+    sendResponse(w, http.StatusOK, string(hash.Multihash()))
 }
@@ -0,0 +1,58 @@
+package rest
+
+import (
+    "net/http"
+    "github.com/gorilla/mux"
+    "fmt"
+    "kademlia"
+    "io/ioutil"
+)
+
+// POST publishes the request body to a topic. GET subscribes to it and streams each message as one line
+// until the client disconnects.
+func topicHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
+    req := mux.Vars(r)
+    name := req["name"]
+    topic := kademlia.TopicFromName(name)
+
+    switch r.Method {
+    case "POST":
+        // Larger messages would be refused anyway, do not read them
+        r.Body = http.MaxBytesReader(w, r.Body, int64(k.Config.MaxValueSize))
+        payload, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            sendResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Message to %s is too large.", name))
+            return
+        }
+        defer r.Body.Close()
+        if err := k.Publish(topic, payload); err == kademlia.MessageTooLargeError {
+            sendResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Message to %s is too large.", name))
+        } else if err != nil {
+            sendResponse(w, 500, fmt.Sprintf("Couldn't publish to %s: %s.", name, err))
+        } else {
+            sendResponse(w, http.StatusOK, fmt.Sprintf("Published to %s.", name))
+        }
+    case "GET":
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+            sendResponse(w, http.StatusInternalServerError, "500 - Streaming not supported")
+            return
+        }
+        sub := k.Subscribe(topic)
+        defer k.Unsubscribe(sub)
+        w.Header().Set("Content-Type", "text/plain")
+        w.WriteHeader(http.StatusOK)
+        flusher.Flush()
+        for {
+            select {
+            case message := <-sub.Messages:
+                w.Write(append(message.Payload, '\n'))
+                flusher.Flush()
+            case <-r.Context().Done():
+                return
+            }
+        }
+    default:
+        sendResponse(w, http.StatusBadRequest, "400 - Not a POST or GET request")
+    }
+}
@@ -15,7 +15,10 @@ func unpinHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request)
         return
     }
 
-    h := kademlia.NewKademliaID(hash)
+    h := parseHash(w, hash)
+    if h == nil {
+        return
+    }
     if err := k.Net.Store.Unpin(*h); err == kademlia.NotFoundError {
         sendResponse(w, http.StatusNotFound, fmt.Sprintf("%s could not be found.", hash))
     } else if err != nil {
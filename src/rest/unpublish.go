@@ -0,0 +1,29 @@
+package rest
+
+import (
+    "net/http"
+    "github.com/gorilla/mux"
+    "fmt"
+    "kademlia"
+)
+
+func unpublishHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
+    req := mux.Vars(r)
+    hash := req["hash"]
+    if r.Method != "DELETE" {
+        sendResponse(w, http.StatusBadRequest, "400 - Not a DELETE request")
+        return
+    }
+
+    h := parseHash(w, hash)
+    if h == nil {
+        return
+    }
+    if err := k.Unpublish(h); err == kademlia.NotFoundError {
+        sendResponse(w, http.StatusNotFound, fmt.Sprintf("%s could not be found.", hash))
+    } else if err != nil {
+        sendResponse(w, 500, fmt.Sprintf("%s could't be unpublished: %s.", hash, err))
+    } else {
+        sendResponse(w, http.StatusOK, fmt.Sprintf("%s was unpublished.", hash))
+    }
+}
@@ -0,0 +1,46 @@
+package rest
+
+import (
+    "net/http"
+    "github.com/gorilla/mux"
+    "fmt"
+    "kademlia"
+    "io/ioutil"
+)
+
+// PUT stores the request body under a name, GET responds with the value stored under it.
+// Names are hashed into keys, so any string works as a registry entry.
+func valueHandler(k *kademlia.Kademlia, w http.ResponseWriter, r *http.Request) {
+    req := mux.Vars(r)
+    name := req["name"]
+    key := kademlia.KeyFromName(name)
+
+    switch r.Method {
+    case "PUT":
+        value, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            sendResponse(w, http.StatusInternalServerError, "500 - Couldn't read body")
+            return
+        }
+        defer r.Body.Close()
+        if err := k.Put(key, value); err == kademlia.ValueTooLargeError {
+            sendResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s is too large.", name))
+        } else if err == kademlia.StoreFullError {
+            sendResponse(w, http.StatusInsufficientStorage, fmt.Sprintf("No room for %s.", name))
+        } else if err != nil {
+            sendResponse(w, 500, fmt.Sprintf("%s could't be put: %s.", name, err))
+        } else {
+            sendResponse(w, http.StatusOK, fmt.Sprintf("%s was put.", name))
+        }
+    case "GET":
+        if value, err := k.Get(key); err == kademlia.NotFoundError {
+            sendResponse(w, http.StatusNotFound, fmt.Sprintf("%s could not be found.", name))
+        } else if err != nil {
+            sendResponse(w, 500, fmt.Sprintf("%s could't be read: %s.", name, err))
+        } else {
+            sendResponse(w, http.StatusOK, string(value))
+        }
+    default:
+        sendResponse(w, http.StatusBadRequest, "400 - Not a PUT or GET request")
+    }
+}
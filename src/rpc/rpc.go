@@ -7,6 +7,19 @@ const (
     STORE_DATA_MSG
     PING_MSG
     PONG_MSG
+    CACHE_DATA_MSG
+    UNPUBLISH_MSG
+    PUT_RECORD_MSG
+    GET_RECORD_MSG
+    PUT_VALUE_MSG
+    GET_VALUE_MSG
+    SUBSCRIBE_MSG
+    UNSUBSCRIBE_MSG
+    PUBLISH_MSG
+    DELIVER_MSG
+    STORE_DATA_BATCH_MSG
+    FIND_DATA_BATCH_MSG
+    PUSH_DATA_MSG
 )
 
 func EnumToString(enum int) string {
@@ -23,6 +36,32 @@ func EnumToString(enum int) string {
         return "PING_MSG"
     case PONG_MSG:
         return "PONG_MSG"
+    case CACHE_DATA_MSG:
+        return "CACHE_DATA_MSG"
+    case UNPUBLISH_MSG:
+        return "UNPUBLISH_MSG"
+    case PUT_RECORD_MSG:
+        return "PUT_RECORD_MSG"
+    case GET_RECORD_MSG:
+        return "GET_RECORD_MSG"
+    case PUT_VALUE_MSG:
+        return "PUT_VALUE_MSG"
+    case GET_VALUE_MSG:
+        return "GET_VALUE_MSG"
+    case SUBSCRIBE_MSG:
+        return "SUBSCRIBE_MSG"
+    case UNSUBSCRIBE_MSG:
+        return "UNSUBSCRIBE_MSG"
+    case PUBLISH_MSG:
+        return "PUBLISH_MSG"
+    case DELIVER_MSG:
+        return "DELIVER_MSG"
+    case STORE_DATA_BATCH_MSG:
+        return "STORE_DATA_BATCH_MSG"
+    case FIND_DATA_BATCH_MSG:
+        return "FIND_DATA_BATCH_MSG"
+    case PUSH_DATA_MSG:
+        return "PUSH_DATA_MSG"
     default:
         return "UNKNOWN_MSG"
     }
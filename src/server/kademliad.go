@@ -1,11 +1,14 @@
 package main
 
 import (
+    "crypto/ed25519"
+    "encoding/hex"
     "strconv"
     "log"
     "os"
     "github.com/BurntSushi/toml"
     "time"
+    "kademlia"
 )
 
 const config_file = "kademliad.toml"
@@ -27,15 +30,120 @@ type daemonConfig struct {
     ReplicationFactor    int
     BootAddr             string
     BootPort             int
+    Seeds                []string
     EvictionTime         time.Duration
     RepublishTime        time.Duration
     ConnectionTimeout    time.Duration
     ConnectionRetryDelay time.Duration
     ReceiveBufferSize    int
+    BootstrapAttempts    int
+    BootstrapBackoff     time.Duration
+    BootstrapMaxBackoff  time.Duration
+    MaxProviders         int
+    MaxValueSize         int
+    SubscriptionTime     time.Duration
+    DownloadAttempts     int
+    BlockSize            int
+    BanTime              time.Duration
+    DataShards           int
+    ParityShards         int
+    CompressTransfers    bool
+    CompressStore        bool
+    Capacity             int
+    EvictionPolicy       string
+    UploadLimit          int
+    DownloadLimit        int
+    PeerUploadLimit      int
+    PeerDownloadLimit    int
+    LegacyAddresses      bool
+    Backend              string
+    DataDir              string
+    // Hex encoded ed25519 seed, keeps the record key of the node stable across restarts
+    SigningKey           string
+}
+
+// Settings missing from the config file keep the kademlia defaults
+func newDaemonConfig() daemonConfig {
+    defaults := kademlia.DefaultConfig()
+    return daemonConfig{
+        Alpha:                defaults.Alpha,
+        ReplicationFactor:    defaults.ReplicationFactor,
+        EvictionTime:         defaults.EvictionTime,
+        RepublishTime:        defaults.RepublishTime,
+        ConnectionTimeout:    defaults.ConnectionTimeout,
+        ConnectionRetryDelay: defaults.ConnectionRetryDelay,
+        ReceiveBufferSize:    defaults.ReceiveBufferSize,
+        BootstrapAttempts:    defaults.BootstrapAttempts,
+        BootstrapBackoff:     defaults.BootstrapBackoff,
+        BootstrapMaxBackoff:  defaults.BootstrapMaxBackoff,
+        MaxProviders:         defaults.MaxProviders,
+        MaxValueSize:         defaults.MaxValueSize,
+        SubscriptionTime:     defaults.SubscriptionTime,
+        DownloadAttempts:     defaults.DownloadAttempts,
+        BlockSize:            defaults.BlockSize,
+        BanTime:              defaults.BanTime,
+        DataShards:           defaults.DataShards,
+        ParityShards:         defaults.ParityShards,
+        CompressTransfers:    defaults.CompressTransfers,
+        CompressStore:        defaults.CompressStore,
+        Capacity:             defaults.Capacity,
+        EvictionPolicy:       defaults.EvictionPolicy,
+        UploadLimit:          defaults.UploadLimit,
+        DownloadLimit:        defaults.DownloadLimit,
+        PeerUploadLimit:      defaults.PeerUploadLimit,
+        PeerDownloadLimit:    defaults.PeerDownloadLimit,
+        LegacyAddresses:      defaults.LegacyAddresses,
+        Backend:              defaults.Backend,
+        DataDir:              defaults.DataDir,
+    }
+}
+
+// Map the daemon settings onto the settings of the node
+func (config *daemonConfig) kademliaConfig() (*kademlia.Config, error) {
+    var signingKey ed25519.PrivateKey
+    if len(config.SigningKey) > 0 {
+        seed, err := hex.DecodeString(config.SigningKey)
+        if err != nil || len(seed) != ed25519.SeedSize {
+            return nil, kademlia.InvalidSigningKeyError
+        }
+        signingKey = ed25519.NewKeyFromSeed(seed)
+    }
+    return &kademlia.Config{
+        Alpha:                config.Alpha,
+        ReplicationFactor:    config.ReplicationFactor,
+        ConnectionTimeout:    config.ConnectionTimeout,
+        ConnectionRetryDelay: config.ConnectionRetryDelay,
+        ReceiveBufferSize:    config.ReceiveBufferSize,
+        EvictionTime:         config.EvictionTime,
+        RepublishTime:        config.RepublishTime,
+        BootstrapAttempts:    config.BootstrapAttempts,
+        BootstrapBackoff:     config.BootstrapBackoff,
+        BootstrapMaxBackoff:  config.BootstrapMaxBackoff,
+        MaxProviders:         config.MaxProviders,
+        MaxValueSize:         config.MaxValueSize,
+        SubscriptionTime:     config.SubscriptionTime,
+        DownloadAttempts:     config.DownloadAttempts,
+        BlockSize:            config.BlockSize,
+        BanTime:              config.BanTime,
+        DataShards:           config.DataShards,
+        ParityShards:         config.ParityShards,
+        CompressTransfers:    config.CompressTransfers,
+        CompressStore:        config.CompressStore,
+        Capacity:             config.Capacity,
+        EvictionPolicy:       config.EvictionPolicy,
+        UploadLimit:          config.UploadLimit,
+        DownloadLimit:        config.DownloadLimit,
+        PeerUploadLimit:      config.PeerUploadLimit,
+        PeerDownloadLimit:    config.PeerDownloadLimit,
+        LegacyAddresses:      config.LegacyAddresses,
+        Backend:              config.Backend,
+        DataDir:              config.DataDir,
+        SigningKey:           signingKey,
+    }, nil
 }
 
 func main() {
-    var config daemonConfig
+    config := newDaemonConfig()
     if _, err := toml.DecodeFile(config_file, &config); err != nil {
         errlog.Println("Error while parsing", config_file, ":", err)
         os.Exit(1)
@@ -1,10 +1,14 @@
 package main
 
 import (
+    "context"
     "os/signal"
     "github.com/takama/daemon"
     "os"
+    "net"
+    "strconv"
     "syscall"
+    "time"
     "kademlia"
     "rest"
 )
@@ -15,6 +19,26 @@ type Service struct {
     daemon.Daemon
 }
 
+// Collect bootstrap seeds, the legacy bootAddr/bootPort pair first and then every "host:udpport" in seeds
+func bootstrapSeeds(config *daemonConfig) []kademlia.Address {
+    seeds := []kademlia.Address{}
+    if len(config.BootAddr) > 0 && config.BootPort > 0 {
+        seeds = append(seeds, kademlia.Address{IP: config.BootAddr, TcpPort: config.TcpPort, UdpPort: config.BootPort})
+    }
+    for _, seed := range config.Seeds {
+        host, port, err := net.SplitHostPort(seed)
+        if err != nil {
+            panic("Invalid seed " + seed)
+        }
+        udpPort, err := strconv.Atoi(port)
+        if err != nil || udpPort < 1 {
+            panic("Invalid seed port " + seed)
+        }
+        seeds = append(seeds, kademlia.Address{IP: host, TcpPort: config.TcpPort, UdpPort: udpPort})
+    }
+    return seeds
+}
+
 func runDaemon(config *daemonConfig) {
     srv, err := daemon.New("kademliad", "Kademlia Storage Daemon", dependencies...)
     if err != nil {
@@ -51,45 +75,39 @@ func (service *Service) Manage(config *daemonConfig) (string, error) { // Start
         }
     }
 
-    if config.Alpha < 1 {
-        panic("Invalid alpha value")
-    }
-    if config.ReplicationFactor < 1 {
-        panic("Invalid replication factor")
-    }
-    if config.RepublishTime < 1 {
-        panic("Invalid republish time")
-    }
-    if config.EvictionTime < 1 {
-        panic("Invalid eviction time")
-    }
-    if config.ReceiveBufferSize < 1024 {
-        panic("Receive buffer size too small")
-    }
-    if config.ConnectionTimeout < 0 {
-        panic("Invalid connection timeout")
+    kConfig, err := config.kademliaConfig()
+    if err == nil {
+        err = kConfig.Validate()
     }
-    if config.ConnectionRetryDelay < 0 {
-        panic("Invalid connection retry timeout")
+    if err != nil {
+        return "Invalid configuration", err
     }
     if config.RestPort < 1 || config.UdpPort < 1 || config.TcpPort < 1 {
         panic("Invalid port setting")
     }
-    if len(config.Address) == 0 || len(config.BootAddr) == 0 {
+    if len(config.Address) == 0 {
         panic("Invalid IP address setting")
     }
-    kademlia.Alpha = config.Alpha
-    kademlia.ReplicationFactor = config.ReplicationFactor
-    kademlia.ConnectionTimeout = config.ConnectionTimeout
-    kademlia.ConnectionRetryDelay = config.ConnectionRetryDelay
-    kademlia.ReceiveBufferSize = config.ReceiveBufferSize
-    kademlia.EvictionTime = config.EvictionTime
-    kademlia.RepublishTime = config.RepublishTime
-
-    k := kademlia.NewKademlia(config.Address, config.TcpPort, config.UdpPort)
-    k.Bootstrap(config.BootAddr, config.TcpPort, config.BootPort)
+    seeds := bootstrapSeeds(config)
+    if len(seeds) == 0 {
+        panic("No bootstrap seeds set")
+    }
 
+    k, err := kademlia.NewKademlia(config.Address, config.TcpPort, config.UdpPort, kConfig)
+    if err != nil {
+        return "Could not create kademlia node", err
+    }
+    if err := k.Start(context.Background()); err != nil {
+        return "Could not start kademlia node", err
+    }
+    stdlog.Println("Listening on", k.Net.Routing.Me.Address)
     go rest.Initialize(k, config.RestPort)
+    if result, err := k.Bootstrap(seeds); err != nil {
+        errlog.Println("Bootstrap failed, retrying in background:", err, result.String())
+    } else {
+        stdlog.Println("Bootstrap done:", result.String())
+    }
+
     interrupt := make(chan os.Signal, 1)
     signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
 
@@ -98,6 +116,11 @@ func (service *Service) Manage(config *daemonConfig) (string, error) { // Start
         //TODO: add case(s) to actually do stuff
         case signal := <-interrupt:
             stdlog.Println("Got signal:", signal)
+            ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+            if err := k.Stop(ctx); err != nil {
+                errlog.Println("Node did not stop cleanly:", err)
+            }
+            cancel()
             if signal == os.Interrupt {
                 return "Daemon was interrupted by system signal", nil
             }